@@ -22,7 +22,18 @@ func main() {
 func rootCommand(args []string) error {
 	commands := []tools.ICommand{
 		tools.NewArchiveExportCmd(),
+		tools.NewExportDatasetCmd(),
 		tools.NewUploadRunsCmd(),
+		tools.NewReingestCmd(),
+		tools.NewImportRunsCmd(),
+		tools.NewDeleteRunsCmd(),
+		tools.NewGcStringsCmd(),
+		tools.NewTokensCmd(),
+		tools.NewRetryFailedCmd(),
+		tools.NewReconcileCmd(),
+		tools.NewCompactRunsCmd(),
+		tools.NewVerifyArchiveCmd(),
+		tools.NewVerifyRoundTripCmd(),
 	}
 	// Make sure we have at least one arg, so we can get through
 	// the loop and print the subcommand names
@@ -47,7 +58,7 @@ func rootCommand(args []string) error {
 	if args[0] == "-h" || args[0] == "--help" {
 		fmt.Println("subcommands:")
 		for _, cmd := range commands {
-			fmt.Printf("  %-12s %s\n", cmd.Flags().Name(), cmd.Description())
+			fmt.Printf("  %-18s %s\n", cmd.Flags().Name(), cmd.Description())
 		}
 		return nil
 	} else {
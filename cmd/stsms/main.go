@@ -30,23 +30,32 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	server := &http.Server{Addr: cmd.srv.Config.Listen, Handler: cmd.r}
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalln(err)
-		}
-	}()
+	servers := []*http.Server{{Addr: cmd.srv.Config.Listen, Handler: cmd.r}}
+	if cmd.admin != nil {
+		servers = append(servers, &http.Server{Addr: cmd.srv.Config.AdminListen, Handler: cmd.admin})
+	}
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}(server)
+	}
 
 	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
 	<-sigC
-	server.Shutdown(context.Background())
+	for _, server := range servers {
+		server.Shutdown(context.Background())
+	}
 }
 
 type MainCmd struct {
 	Config string
 	r      *gin.Engine
-	srv    *web.Services
+	// Engine for the admin listener, nil if admin_listen is empty
+	admin *gin.Engine
+	srv   *web.Services
 }
 
 func (m *MainCmd) setup() (err error) {
@@ -72,5 +81,11 @@ func (m *MainCmd) setup() (err error) {
 	if err = ctrlMain.Init(m.r); err != nil {
 		return
 	}
+	if m.srv.Config.AdminListen != "" {
+		m.admin = gin.Default()
+		if err = ctrlMain.InitAdmin(m.admin); err != nil {
+			return
+		}
+	}
 	return
 }
@@ -0,0 +1,69 @@
+// Package blob stores raw runs, keyed by play_id, on local disk, in segment files, or
+// in an S3-compatible object store.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error when a blob doesn't exist
+var ErrNotFound = errors.New("blob not found")
+
+// Error when a key can't be used as a blob name
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Longest key accepted, play_ids are much shorter
+const maxKeyLen = 255
+
+// Longest checksum accepted
+const maxSumLen = 255
+
+// Extension of raw run files
+const runExt = ".run"
+
+// Storage for raw runs. Implementations are safe for concurrent use.
+//
+// Each blob may have a checksum of the run it holds, which is kept with the blob rather
+// than as a separate one.
+type BlobStore interface {
+	// Store data under key, along with sum unless it's nil. If the key already exists its
+	// data is kept, since a play_id always refers to the same run.
+	Put(ctx context.Context, key string, data []byte, sum []byte) error
+	// Returns the data stored under key and its checksum, which is nil if none was stored,
+	// or ErrNotFound
+	Get(ctx context.Context, key string) (data []byte, sum []byte, err error)
+	// Returns true if key exists
+	Exists(ctx context.Context, key string) (bool, error)
+	// Removes key, returning true if it existed
+	Delete(ctx context.Context, key string) (bool, error)
+	// Calls fn for every key, in no particular order. Stops at the first error returned by fn.
+	List(ctx context.Context, fn func(key string) error) error
+	// Releases any resources held by the store
+	Close() error
+}
+
+// Returns an error wrapping ErrInvalidKey unless key only contains letters, digits,
+// '-', '_' and '.', and doesn't start with '.'. This keeps keys safe to use as file names.
+func CheckKey(key string) error {
+	if key == "" || len(key) > maxKeyLen || key[0] == '.' {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for _, ch := range key {
+		ok := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.'
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// Returns an error if sum is too long to be stored with a blob
+func checkSum(key string, sum []byte) error {
+	if len(sum) > maxSumLen {
+		return fmt.Errorf("checksum of blob %s is too long: %d bytes", key, len(sum))
+	}
+	return nil
+}
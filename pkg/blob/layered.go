@@ -0,0 +1,145 @@
+package blob
+
+import (
+	"context"
+	"errors"
+)
+
+// Number of blobs moved by Compact between syncs
+const compactBatchSize = 1000
+
+// Writes new blobs to the first store, and reads from each store in order. Used to keep
+// new runs in a local directory until they're compacted into segments.
+type Layered struct {
+	stores []BlobStore
+}
+
+func NewLayered(stores ...BlobStore) *Layered {
+	return &Layered{stores: stores}
+}
+
+func (s *Layered) Put(ctx context.Context, key string, data []byte, sum []byte) error {
+	if ok, err := s.Exists(ctx, key); err != nil || ok {
+		return err
+	}
+	return s.stores[0].Put(ctx, key, data, sum)
+}
+
+func (s *Layered) Get(ctx context.Context, key string) ([]byte, []byte, error) {
+	for _, st := range s.stores {
+		data, sum, err := st.Get(ctx, key)
+		if !errors.Is(err, ErrNotFound) {
+			return data, sum, err
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
+func (s *Layered) Exists(ctx context.Context, key string) (bool, error) {
+	for _, st := range s.stores {
+		if ok, err := st.Exists(ctx, key); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (s *Layered) Delete(ctx context.Context, key string) (bool, error) {
+	found := false
+	for _, st := range s.stores {
+		ok, err := st.Delete(ctx, key)
+		if err != nil {
+			return found, err
+		}
+		found = found || ok
+	}
+	return found, nil
+}
+
+// Lists each key once. A key which is in more than one store, ex. while it's being
+// compacted, is listed from the first store it's in.
+func (s *Layered) List(ctx context.Context, fn func(key string) error) error {
+	for i, st := range s.stores {
+		err := st.List(ctx, func(key string) error {
+			for _, prev := range s.stores[:i] {
+				if ok, err := prev.Exists(ctx, key); err != nil {
+					return err
+				} else if ok {
+					return nil
+				}
+			}
+			return fn(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Layered) Close() error {
+	var err error
+	for _, st := range s.stores {
+		if err2 := st.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Returns the stores, in the order they're read from
+func (s *Layered) Stores() []BlobStore {
+	return s.stores
+}
+
+// Move every blob in src into segments in dst, returning the number moved. Blobs are
+// only removed from src once dst has been synced to disk. Blobs deleted while they're
+// being moved stay deleted.
+func Compact(ctx context.Context, src BlobStore, dst *SegmentStore) (int, error) {
+	moved := 0
+	var batch []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := dst.Sync(); err != nil {
+			return err
+		}
+		for _, key := range batch {
+			if _, err := src.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		moved += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err := src.List(ctx, func(key string) error {
+		data, sum, err := src.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := dst.put(key, data, sum); err != nil {
+			return err
+		}
+		// A Layered.Delete may have removed the key from both stores before it was added
+		// to dst, in which case it has to be deleted again
+		if ok, err := src.Exists(ctx, key); err != nil {
+			return err
+		} else if !ok {
+			_, err := dst.Delete(ctx, key)
+			return err
+		}
+		batch = append(batch, key)
+		if len(batch) >= compactBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return moved, err
+}
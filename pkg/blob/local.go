@@ -0,0 +1,157 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Start of a file holding a checksum, which is followed by the checksum's length, the
+// checksum and then the data. Files without a checksum hold just the data.
+var localSumHeader = []byte("\x00sum")
+
+// Stores each blob as a file, sharded into two levels of directories by the hash of its
+// key so no directory gets too large. Files in the root of the directory, written by
+// older versions, are still found.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// Path of the file for key, ex. "<dir>/3f/a0/<key>.run"
+func (s *LocalStore) Path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	shard := hex.EncodeToString(h[:2])
+	return filepath.Join(s.dir, shard[:2], shard[2:], key+runExt)
+}
+
+// Path of the file for key in the old flat layout
+func (s *LocalStore) legacyPath(key string) string {
+	return filepath.Join(s.dir, key+runExt)
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, data []byte, sum []byte) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if err := checkSum(key, sum); err != nil {
+		return err
+	}
+	if ok, err := s.Exists(ctx, key); err != nil || ok {
+		return err
+	}
+	fpath := s.Path(key)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial file, then link it
+	// into place, which fails instead of replacing an existing file.
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if sum != nil {
+		hdr := append([]byte(nil), localSumHeader...)
+		hdr = append(append(hdr, byte(len(sum))), sum...)
+		_, err = tmp.Write(hdr)
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), fpath); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) ([]byte, []byte, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = os.ReadFile(s.legacyPath(key))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if n := len(localSumHeader); bytes.HasPrefix(data, localSumHeader) && len(data) > n {
+		if end := n + 1 + int(data[n]); len(data) >= end {
+			return data[end:], data[n+1 : end], nil
+		}
+	}
+	return data, nil, nil
+}
+
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	for _, fpath := range []string{s.Path(key), s.legacyPath(key)} {
+		if _, err := os.Stat(fpath); err == nil {
+			return true, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) (bool, error) {
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	found := false
+	for _, fpath := range []string{s.Path(key), s.legacyPath(key)} {
+		if err := os.Remove(fpath); err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, fn func(key string) error) error {
+	return filepath.WalkDir(s.dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || !strings.HasSuffix(name, runExt) || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		return fn(strings.TrimSuffix(name, runExt))
+	})
+}
+
+func (s *LocalStore) Close() error {
+	return nil
+}
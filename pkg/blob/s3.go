@@ -0,0 +1,354 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Header holding a blob's checksum, as hex
+const s3SumHeader = "X-Amz-Meta-Sha256"
+
+// Layouts of the dates used when signing requests
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// Settings for S3Store
+type S3Config struct {
+	// Base URL of the S3 API, ex. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000"
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prepended to every object name, ex. "runs/"
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Put the bucket in the path instead of the host name, needed for most S3-compatible servers
+	PathStyle bool
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Stores blobs as objects in an S3-compatible object store, using the REST API with
+// Signature Version 4.
+type S3Store struct {
+	cfg  S3Config
+	base *url.URL
+	now  func() time.Time
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	if cfg.PathStyle {
+		base.Path += "/" + cfg.Bucket
+	} else {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &S3Store{cfg: cfg, base: base, now: time.Now}, nil
+}
+
+// Name of the object for key
+func (s *S3Store) objectName(key string) string {
+	return s.cfg.Prefix + key + runExt
+}
+
+func (s *S3Store) objectUrl(key string) string {
+	u := *s.base
+	u.Path += "/" + s.objectName(key)
+	return u.String()
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, sum []byte) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if err := checkSum(key, sum); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.objectUrl(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if sum != nil {
+		req.Header.Set(s3SumHeader, hex.EncodeToString(sum))
+	}
+	// Keep the existing object, if any
+	req.Header.Set("If-None-Match", "*")
+	res, err := s.do(req, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200, 201, 204, http.StatusPreconditionFailed:
+		return nil
+	default:
+		return s.responseError(res)
+	}
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, []byte, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectUrl(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := s.do(req, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, nil, ErrNotFound
+	default:
+		return nil, nil, s.responseError(res)
+	}
+	var sum []byte
+	if v := res.Header.Get(s3SumHeader); v != "" {
+		if sum, err = hex.DecodeString(v); err != nil {
+			return nil, nil, fmt.Errorf("s3: %s: %s: %w", s.objectName(key), s3SumHeader, err)
+		}
+	}
+	data, err := io.ReadAll(res.Body)
+	return data, sum, err
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.objectUrl(key), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.do(req, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, s.responseError(res)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) (bool, error) {
+	// S3 doesn't say whether the object existed
+	ok, err := s.Exists(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.objectUrl(key), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.do(req, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		return false, s.responseError(res)
+	}
+	return true, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(ctx context.Context, fn func(key string) error) error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := *s.base
+		u.Path += "/"
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := s.do(req, nil)
+		if err != nil {
+			return err
+		}
+		var page s3ListResult
+		if res.StatusCode != 200 {
+			err = s.responseError(res)
+		} else {
+			err = xml.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(obj.Key, s.cfg.Prefix)
+			if !strings.HasSuffix(name, runExt) || strings.Contains(name, "/") {
+				continue
+			}
+			if err := fn(strings.TrimSuffix(name, runExt)); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Store) Close() error {
+	return nil
+}
+
+// Sign and send a request with the given body
+func (s *S3Store) do(req *http.Request, body []byte) (*http.Response, error) {
+	signV4(req, body, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, s.now())
+	return s.cfg.Client.Do(req)
+}
+
+func (s *S3Store) responseError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3: %s %s: %s: %s", res.Request.Method, res.Request.URL.Path, res.Status, bytes.TrimSpace(msg))
+}
+
+// Adds AWS Signature Version 4 headers to req for the "s3" service
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: host and every header set on the request
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := t.Format(amzShortFormat) + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format(amzDateFormat) + "\n" + scope + "\n" + sha256Hex([]byte(canonRequest))
+
+	key := hmacSha256([]byte("AWS4"+secretKey), t.Format(amzShortFormat))
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// URI-encodes each segment of the path, S3 doesn't normalize or double-encode it
+func canonicalPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		if raw, err := url.PathUnescape(seg); err == nil {
+			segs[i] = uriEncode(raw)
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent-encodes everything except unreserved characters, as required by SigV4
+func uriEncode(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
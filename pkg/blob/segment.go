@@ -0,0 +1,582 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extension of segment files
+const segmentExt = ".seg"
+
+// Marks the start of every record
+const segmentMagic uint32 = 0x534d5231 // "SMR1"
+
+// Record types
+const (
+	recordPut    byte = 0
+	recordDelete byte = 1
+	// Written when a segment is closed, nothing is appended after it
+	recordSeal byte = 2
+)
+
+// magic, type, key length, checksum length, data length
+const recordHeaderSize = 4 + 1 + 2 + 1 + 4
+
+// Size of the checksum after each record
+const recordCrcSize = 4
+
+// Default size at which a segment is closed and a new one started
+const DefaultSegmentSize = 256 << 20
+
+// Location of a blob's checksum in a segment, which is followed by its data
+type segmentLoc struct {
+	seg     *segmentFile
+	off     int64
+	sumSize int
+	size    int
+}
+
+type segmentFile struct {
+	name string
+	fd   *os.File
+	// Offset up to which the file has been indexed
+	scanned int64
+	// Number of blobs in the segment which were deleted or replaced
+	dead int
+	// Set once the seal record is indexed, after which the segment may be rewritten
+	sealed bool
+}
+
+// Stores blobs in append-only segment files, so millions of runs don't need millions of
+// files. Each record is checksummed, and an incomplete record at the end of a segment
+// (ex. after a crash) is ignored.
+//
+// Every process writes to its own segment files, so several processes may share a
+// directory. Segments written by other processes are picked up when a key isn't found.
+// Deleted blobs are marked with a record, and their data stays on disk until Purge
+// rewrites the segment they're in.
+type SegmentStore struct {
+	dir     string
+	maxSize int64
+
+	// Held while rewriting segments
+	purgeLock sync.Mutex
+
+	lock  sync.RWMutex
+	index map[string]segmentLoc
+	segs  map[string]*segmentFile
+
+	// Segment this process appends to, nil until the first write
+	writeLock sync.Mutex
+	active    *os.File
+	activeSeg *segmentFile
+	activeLen int64
+}
+
+// Opens the segments in dir, creating dir if needed. A new segment is started once the
+// current one reaches maxSize bytes; 0 uses DefaultSegmentSize.
+func NewSegmentStore(dir string, maxSize int64) (*SegmentStore, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{
+		dir:     dir,
+		maxSize: maxSize,
+		index:   make(map[string]segmentLoc),
+		segs:    make(map[string]*segmentFile),
+	}
+	if err := s.refresh(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SegmentStore) Put(ctx context.Context, key string, data []byte, sum []byte) error {
+	if err := s.put(key, data, sum); err != nil {
+		return err
+	}
+	return s.Sync()
+}
+
+// Append a blob without syncing, used when adding many blobs at once
+func (s *SegmentStore) put(key string, data []byte, sum []byte) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if err := checkSum(key, sum); err != nil {
+		return err
+	}
+	if len(data) > DefaultSegmentSize {
+		return fmt.Errorf("blob %s is too large for a segment: %d bytes", key, len(data))
+	}
+	if ok, err := s.exists(key); err != nil || ok {
+		return err
+	}
+	return s.append(recordPut, key, sum, data)
+}
+
+func (s *SegmentStore) Get(ctx context.Context, key string) ([]byte, []byte, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, nil, err
+	}
+	if ok, err := s.exists(key); err != nil {
+		return nil, nil, err
+	} else if !ok {
+		return nil, nil, ErrNotFound
+	}
+	// Hold the lock while reading, so the segment isn't rewritten and closed
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	buf := make([]byte, loc.sumSize+loc.size)
+	if _, err := loc.seg.fd.ReadAt(buf, loc.off); err != nil {
+		return nil, nil, err
+	}
+	var sum []byte
+	if loc.sumSize > 0 {
+		sum = buf[:loc.sumSize]
+	}
+	return buf[loc.sumSize:], sum, nil
+}
+
+func (s *SegmentStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	return s.exists(key)
+}
+
+func (s *SegmentStore) Delete(ctx context.Context, key string) (bool, error) {
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	if ok, err := s.exists(key); err != nil || !ok {
+		return false, err
+	}
+	if err := s.append(recordDelete, key, nil, nil); err != nil {
+		return false, err
+	}
+	return true, s.Sync()
+}
+
+func (s *SegmentStore) List(ctx context.Context, fn func(key string) error) error {
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	s.lock.RLock()
+	keys := make([]string, 0, len(s.index))
+	for k := range s.index {
+		keys = append(keys, k)
+	}
+	s.lock.RUnlock()
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush the current segment to disk
+func (s *SegmentStore) Sync() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	return s.active.Sync()
+}
+
+// Seals the current segment and closes every segment
+func (s *SegmentStore) Close() error {
+	var err error
+	s.writeLock.Lock()
+	if s.active != nil {
+		err = s.seal()
+	}
+	s.writeLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, seg := range s.segs {
+		seg.fd.Close()
+	}
+	s.segs = nil
+	s.index = nil
+	return err
+}
+
+func (s *SegmentStore) exists(key string) (bool, error) {
+	_, ok, err := s.lookup(key)
+	return ok, err
+}
+
+// Finds key in the index, checking for new records if it's missing
+func (s *SegmentStore) lookup(key string) (segmentLoc, bool, error) {
+	s.lock.RLock()
+	loc, ok := s.index[key]
+	s.lock.RUnlock()
+	if ok {
+		return loc, true, nil
+	}
+	if err := s.refresh(); err != nil {
+		return loc, false, err
+	}
+	s.lock.RLock()
+	loc, ok = s.index[key]
+	s.lock.RUnlock()
+	return loc, ok, nil
+}
+
+// Rewrite sealed segments which contain deleted or replaced blobs without them, so their
+// data is removed from disk, returning the number of segments rewritten. The active
+// segment is sealed first if it contains any.
+//
+// Segments other processes are still appending to aren't sealed, so they're skipped until
+// the process closes the store. A segment left by a process which crashed is never sealed.
+func (s *SegmentStore) Purge(ctx context.Context) (int, error) {
+	s.purgeLock.Lock()
+	defer s.purgeLock.Unlock()
+	s.writeLock.Lock()
+	var err error
+	if s.active != nil {
+		s.lock.RLock()
+		dead := s.activeSeg.dead
+		s.lock.RUnlock()
+		if dead > 0 {
+			err = s.seal()
+		}
+	}
+	s.writeLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.refresh(); err != nil {
+		return 0, err
+	}
+	var segs []*segmentFile
+	s.lock.RLock()
+	for _, seg := range s.segs {
+		if seg.sealed && seg.dead > 0 {
+			segs = append(segs, seg)
+		}
+	}
+	s.lock.RUnlock()
+	for i, seg := range segs {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := s.rewrite(seg); err != nil {
+			return i, fmt.Errorf("%s: %w", seg.name, err)
+		}
+	}
+	return len(segs), nil
+}
+
+// Copy the live blobs, deletions and seal of a sealed segment to a new segment which is
+// read in the same order, then remove it. Must hold s.purgeLock.
+func (s *SegmentStore) rewrite(seg *segmentFile) error {
+	// Keep the time the segment was created, which orders it against other segments
+	created, _, _ := strings.Cut(seg.name, "-")
+	name := fmt.Sprintf("%s-%08x%s", created, rand.Uint32(), segmentExt)
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	wr, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer wr.Close()
+
+	// Index offsets of each blob copied, in the old and new segment
+	type movedBlob struct {
+		key      string
+		from, to int64
+	}
+	var moved []movedBlob
+	bw := bufio.NewWriter(wr)
+	rd := bufio.NewReader(io.NewSectionReader(seg.fd, 0, seg.scanned))
+	var off, newLen int64
+	for off < seg.scanned {
+		typ, key, sum, data, n, err := readRecord(rd)
+		if err != nil {
+			return err
+		}
+		locOff := off + recordHeaderSize + int64(len(key))
+		off += n
+		if typ == recordPut {
+			s.lock.RLock()
+			loc, ok := s.index[key]
+			s.lock.RUnlock()
+			if !ok || loc.seg != seg || loc.off != locOff {
+				continue
+			}
+			moved = append(moved, movedBlob{key: key, from: locOff, to: newLen + recordHeaderSize + int64(len(key))})
+		}
+		rec := encodeRecord(typ, key, sum, data)
+		if _, err := bw.Write(rec); err != nil {
+			return err
+		}
+		newLen += int64(len(rec))
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := wr.Sync(); err != nil {
+		return err
+	}
+	fd, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	newSeg := &segmentFile{name: name, fd: fd, scanned: newLen, sealed: true}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, name)); err != nil {
+		fd.Close()
+		return err
+	}
+	for _, m := range moved {
+		if loc, ok := s.index[m.key]; ok && loc.seg == seg && loc.off == m.from {
+			s.index[m.key] = segmentLoc{seg: newSeg, off: m.to, sumSize: loc.sumSize, size: loc.size}
+		} else {
+			// Deleted while it was being copied
+			newSeg.dead++
+		}
+	}
+	s.segs[name] = newSeg
+	delete(s.segs, seg.name)
+	seg.fd.Close()
+	return os.Remove(filepath.Join(s.dir, seg.name))
+}
+
+// Append a record to the active segment, starting a new segment if needed
+func (s *SegmentStore) append(typ byte, key string, sum []byte, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.active != nil && s.activeLen >= s.maxSize {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	if s.active == nil {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+	return s.write(typ, key, sum, data)
+}
+
+// Seal the active segment and close it, so a new one is started by the next write.
+// Must hold s.writeLock.
+func (s *SegmentStore) seal() error {
+	if err := s.write(recordSeal, "", nil, nil); err != nil {
+		return err
+	}
+	err := s.active.Sync()
+	if err2 := s.active.Close(); err == nil {
+		err = err2
+	}
+	s.active = nil
+	return err
+}
+
+// Append a record to the active segment and index it. Must hold s.writeLock.
+func (s *SegmentStore) write(typ byte, key string, sum []byte, data []byte) error {
+	rec := encodeRecord(typ, key, sum, data)
+	off := s.activeLen
+	if _, err := s.active.Write(rec); err != nil {
+		// Don't leave a partial record for the next one to be appended after
+		s.active.Truncate(off)
+		s.active.Seek(off, io.SeekStart)
+		return err
+	}
+	s.activeLen += int64(len(rec))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.indexRecord(typ, key, segmentLoc{seg: s.activeSeg, off: off + recordHeaderSize + int64(len(key)), sumSize: len(sum), size: len(data)})
+	if s.activeSeg.scanned == off {
+		s.activeSeg.scanned = s.activeLen
+	}
+	return nil
+}
+
+// Create a new segment for this process. Names start with the time so they sort in the
+// order they were created.
+func (s *SegmentStore) startSegment() error {
+	name := fmt.Sprintf("%016x-%08x%s", time.Now().UnixNano(), rand.Uint32(), segmentExt)
+	fpath := filepath.Join(s.dir, name)
+	wr, err := os.OpenFile(fpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	rd, err := os.Open(fpath)
+	if err != nil {
+		wr.Close()
+		return err
+	}
+	seg := &segmentFile{name: name, fd: rd}
+	s.lock.Lock()
+	s.segs[name] = seg
+	s.lock.Unlock()
+	s.active, s.activeSeg, s.activeLen = wr, seg, 0
+	return nil
+}
+
+// Index any segments or records added since the last refresh
+func (s *SegmentStore) refresh() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, ent := range entries {
+		if ent.Type().IsRegular() && strings.HasSuffix(ent.Name(), segmentExt) {
+			names = append(names, ent.Name())
+		}
+	}
+	sort.Strings(names)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+		seg, ok := s.segs[name]
+		if !ok {
+			fd, err := os.Open(filepath.Join(s.dir, name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			seg = &segmentFile{name: name, fd: fd}
+			s.segs[name] = seg
+		}
+		if err := s.scan(seg); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	// Drop segments another process removed after rewriting them. Their blobs were indexed
+	// again from the new segments, anything left was deleted.
+	for name, seg := range s.segs {
+		if listed[name] {
+			continue
+		}
+		for key, loc := range s.index {
+			if loc.seg == seg {
+				delete(s.index, key)
+			}
+		}
+		seg.fd.Close()
+		delete(s.segs, name)
+	}
+	return nil
+}
+
+// Index the records in seg after the last scanned offset. Stops at the first incomplete
+// or corrupt record, which may still be being written. Must hold s.lock.
+func (s *SegmentStore) scan(seg *segmentFile) error {
+	rd := bufio.NewReader(io.NewSectionReader(seg.fd, seg.scanned, 1<<62))
+	for {
+		typ, key, sum, data, n, err := readRecord(rd)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorruptRecord) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		loc := segmentLoc{seg: seg, off: seg.scanned + recordHeaderSize + int64(len(key)), sumSize: len(sum), size: len(data)}
+		s.indexRecord(typ, key, loc)
+		seg.scanned += n
+	}
+}
+
+// Apply a record at loc to the index, counting the blob it replaces or deletes as dead.
+// Must hold s.lock.
+func (s *SegmentStore) indexRecord(typ byte, key string, loc segmentLoc) {
+	if typ == recordSeal {
+		loc.seg.sealed = true
+		return
+	}
+	if old, ok := s.index[key]; ok {
+		old.seg.dead++
+	}
+	if typ == recordDelete {
+		delete(s.index, key)
+	} else {
+		s.index[key] = loc
+	}
+}
+
+// Error for a record with the wrong magic number or checksum
+var errCorruptRecord = errors.New("corrupt segment record")
+
+func encodeRecord(typ byte, key string, sum []byte, data []byte) []byte {
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+len(key)+len(sum)+len(data)+recordCrcSize)
+	binary.LittleEndian.PutUint32(rec[0:], segmentMagic)
+	rec[4] = typ
+	binary.LittleEndian.PutUint16(rec[5:], uint16(len(key)))
+	rec[7] = byte(len(sum))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(data)))
+	rec = append(rec, key...)
+	rec = append(rec, sum...)
+	rec = append(rec, data...)
+	return binary.LittleEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+}
+
+// Read one record, returning its type, key, checksum, data and total size
+func readRecord(rd io.Reader) (byte, string, []byte, []byte, int64, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return 0, "", nil, nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != segmentMagic {
+		return 0, "", nil, nil, 0, errCorruptRecord
+	}
+	keyLen := int(binary.LittleEndian.Uint16(hdr[5:]))
+	sumLen := int(hdr[7])
+	dataLen := int64(binary.LittleEndian.Uint32(hdr[8:]))
+	if keyLen > maxKeyLen || dataLen > DefaultSegmentSize {
+		return 0, "", nil, nil, 0, errCorruptRecord
+	}
+	body := make([]byte, int64(keyLen+sumLen)+dataLen+recordCrcSize)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return 0, "", nil, nil, 0, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[:])
+	crc.Write(body[:len(body)-recordCrcSize])
+	if crc.Sum32() != binary.LittleEndian.Uint32(body[len(body)-recordCrcSize:]) {
+		return 0, "", nil, nil, 0, errCorruptRecord
+	}
+	key := string(body[:keyLen])
+	var sum []byte
+	if sumLen > 0 {
+		sum = body[keyLen : keyLen+sumLen]
+	}
+	data := body[keyLen+sumLen : len(body)-recordCrcSize]
+	return hdr[4], key, sum, data, int64(len(hdr) + len(body)), nil
+}
@@ -202,7 +202,7 @@ INSERT INTO RawJsonArchive(bdata, play_id) VALUES ($1, $2)
 `
 
 type ArchiveAddParams struct {
-	Bdata  pgtype.JSON
+	Bdata  []byte
 	PlayID string
 }
 
@@ -211,12 +211,44 @@ func (q *Queries) ArchiveAdd(ctx context.Context, arg ArchiveAddParams) error {
 	return err
 }
 
-const archiveBegin = `-- name: ArchiveBegin :many
-UPDATE rawjsonarchive ra SET status = $1 WHERE status = 0 RETURNING ra.id, ra.bdata, ra.play_id, ra.status
+const archiveClaim = `-- name: ArchiveClaim :many
+UPDATE RawJsonArchive ra SET status = 1, claimed_by = $1, claimed_at = now()
+WHERE ra.id IN (
+    SELECT a.id FROM RawJsonArchive a
+    LEFT JOIN RunsData r ON r.play_id = a.play_id
+    WHERE a.status = 0 AND a.id > $2
+      AND ($3::timestamp IS NULL OR r."timestamp" >= $3)
+      AND ($4::timestamp IS NULL OR r."timestamp" < $4)
+      AND ($5::text IS NULL OR r.character_id = (SELECT id FROM StrCache WHERE str = $5))
+      AND ($6::text IS NULL OR r.build_version = (SELECT id FROM StrCache WHERE str = $6))
+    ORDER BY a.id
+    LIMIT $7
+    FOR UPDATE OF a SKIP LOCKED
+)
+RETURNING ra.id, ra.bdata, ra.play_id, ra.status, ra.claimed_by, ra.claimed_at, ra.sha256
 `
 
-func (q *Queries) ArchiveBegin(ctx context.Context, status int16) ([]Rawjsonarchive, error) {
-	rows, err := q.db.Query(ctx, archiveBegin, status)
+type ArchiveClaimParams struct {
+	ClaimedBy sql.NullString
+	AfterID   int32
+	Since     sql.NullTime
+	Until     sql.NullTime
+	Character sql.NullString
+	Build     sql.NullString
+	Limit     int32
+}
+
+// Claims the next unexported rows after after_id, optionally only runs matching the filters.
+func (q *Queries) ArchiveClaim(ctx context.Context, arg ArchiveClaimParams) ([]Rawjsonarchive, error) {
+	rows, err := q.db.Query(ctx, archiveClaim,
+		arg.ClaimedBy,
+		arg.AfterID,
+		arg.Since,
+		arg.Until,
+		arg.Character,
+		arg.Build,
+		arg.Limit,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -229,6 +261,9 @@ func (q *Queries) ArchiveBegin(ctx context.Context, status int16) ([]Rawjsonarch
 			&i.Bdata,
 			&i.PlayID,
 			&i.Status,
+			&i.ClaimedBy,
+			&i.ClaimedAt,
+			&i.Sha256,
 		); err != nil {
 			return nil, err
 		}
@@ -240,23 +275,115 @@ func (q *Queries) ArchiveBegin(ctx context.Context, status int16) ([]Rawjsonarch
 	return items, nil
 }
 
-const archiveComplete = `-- name: ArchiveComplete :many
-UPDATE rawjsonarchive ra SET status = -1 WHERE status = $1 RETURNING ra.id
+const archiveClaimed = `-- name: ArchiveClaimed :many
+SELECT id, bdata, play_id, status, claimed_by, claimed_at, sha256 FROM RawJsonArchive WHERE status = 1 AND claimed_by = $1 AND id > $2 ORDER BY id LIMIT $3
 `
 
-func (q *Queries) ArchiveComplete(ctx context.Context, status int16) ([]int32, error) {
-	rows, err := q.db.Query(ctx, archiveComplete, status)
+type ArchiveClaimedParams struct {
+	ClaimedBy sql.NullString
+	ID        int32
+	Limit     int32
+}
+
+func (q *Queries) ArchiveClaimed(ctx context.Context, arg ArchiveClaimedParams) ([]Rawjsonarchive, error) {
+	rows, err := q.db.Query(ctx, archiveClaimed, arg.ClaimedBy, arg.ID, arg.Limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []int32
+	var items []Rawjsonarchive
+	for rows.Next() {
+		var i Rawjsonarchive
+		if err := rows.Scan(
+			&i.ID,
+			&i.Bdata,
+			&i.PlayID,
+			&i.Status,
+			&i.ClaimedBy,
+			&i.ClaimedAt,
+			&i.Sha256,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const archiveComplete = `-- name: ArchiveComplete :execrows
+UPDATE RawJsonArchive SET status = 2, claimed_at = NULL
+WHERE status = 1 AND claimed_by = $1 AND id = ANY($2::int[])
+`
+
+type ArchiveCompleteParams struct {
+	ClaimedBy sql.NullString
+	Ids       []int32
+}
+
+func (q *Queries) ArchiveComplete(ctx context.Context, arg ArchiveCompleteParams) (int64, error) {
+	result, err := q.db.Exec(ctx, archiveComplete, arg.ClaimedBy, arg.Ids)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const archiveEstimate = `-- name: ArchiveEstimate :one
+SELECT reltuples::int8 FROM pg_class WHERE oid = 'rawjsonarchive'::regclass
+`
+
+// Estimated number of archived runs, from the planner statistics
+func (q *Queries) ArchiveEstimate(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, archiveEstimate)
+	var reltuples int64
+	err := row.Scan(&reltuples)
+	return reltuples, err
+}
+
+const archiveGet = `-- name: ArchiveGet :one
+SELECT bdata FROM RawJsonArchive WHERE play_id = $1
+`
+
+func (q *Queries) ArchiveGet(ctx context.Context, playID string) ([]byte, error) {
+	row := q.db.QueryRow(ctx, archiveGet, playID)
+	var bdata []byte
+	err := row.Scan(&bdata)
+	return bdata, err
+}
+
+const archiveList = `-- name: ArchiveList :many
+SELECT id, bdata, play_id, status, claimed_by, claimed_at, sha256 FROM RawJsonArchive WHERE id > $1 ORDER BY id LIMIT $2
+`
+
+type ArchiveListParams struct {
+	ID    int32
+	Limit int32
+}
+
+func (q *Queries) ArchiveList(ctx context.Context, arg ArchiveListParams) ([]Rawjsonarchive, error) {
+	rows, err := q.db.Query(ctx, archiveList, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Rawjsonarchive
 	for rows.Next() {
-		var id int32
-		if err := rows.Scan(&id); err != nil {
+		var i Rawjsonarchive
+		if err := rows.Scan(
+			&i.ID,
+			&i.Bdata,
+			&i.PlayID,
+			&i.Status,
+			&i.ClaimedBy,
+			&i.ClaimedAt,
+			&i.Sha256,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, id)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -264,6 +391,100 @@ func (q *Queries) ArchiveComplete(ctx context.Context, status int16) ([]int32, e
 	return items, nil
 }
 
+const archiveReclaim = `-- name: ArchiveReclaim :execrows
+UPDATE RawJsonArchive SET status = 0, claimed_by = NULL, claimed_at = NULL
+WHERE status = 1 AND claimed_at < now() - make_interval(secs => $1::float8)
+`
+
+func (q *Queries) ArchiveReclaim(ctx context.Context, ageSecs float64) (int64, error) {
+	result, err := q.db.Exec(ctx, archiveReclaim, ageSecs)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const archiveRelease = `-- name: ArchiveRelease :execrows
+UPDATE RawJsonArchive SET status = 0, claimed_by = NULL, claimed_at = NULL
+WHERE status = 1 AND claimed_by = $1 AND id = ANY($2::int[])
+`
+
+type ArchiveReleaseParams struct {
+	ClaimedBy sql.NullString
+	Ids       []int32
+}
+
+// Releases claimed rows which couldn't be exported, so they're not claimed by the export again
+func (q *Queries) ArchiveRelease(ctx context.Context, arg ArchiveReleaseParams) (int64, error) {
+	result, err := q.db.Exec(ctx, archiveRelease, arg.ClaimedBy, arg.Ids)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const archiveSample = `-- name: ArchiveSample :many
+SELECT play_id, bdata FROM RawJsonArchive WHERE id IN (
+    SELECT id FROM RawJsonArchive TABLESAMPLE BERNOULLI ($1::float4)
+    ORDER BY random() LIMIT $2
+)
+`
+
+type ArchiveSampleParams struct {
+	Percent float32
+	Limit   int32
+}
+
+type ArchiveSampleRow struct {
+	PlayID string
+	Bdata  []byte
+}
+
+// Picks the ids from a sample of about percent of the rows, so only the sampled ids are sorted
+func (q *Queries) ArchiveSample(ctx context.Context, arg ArchiveSampleParams) ([]ArchiveSampleRow, error) {
+	rows, err := q.db.Query(ctx, archiveSample, arg.Percent, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ArchiveSampleRow
+	for rows.Next() {
+		var i ArchiveSampleRow
+		if err := rows.Scan(&i.PlayID, &i.Bdata); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteRunsArchive = `-- name: DeleteRunsArchive :execrows
+DELETE FROM RawJsonArchive WHERE play_id = ANY($1::text[])
+`
+
+func (q *Queries) DeleteRunsArchive(ctx context.Context, playIds []string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteRunsArchive, playIds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteRunsParsed = `-- name: DeleteRunsParsed :execrows
+DELETE FROM RunsData WHERE play_id = ANY($1::text[])
+`
+
+func (q *Queries) DeleteRunsParsed(ctx context.Context, playIds []string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteRunsParsed, playIds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const doesRunExist = `-- name: DoesRunExist :one
 SELECT count(id)::boolean FROM RunsData R WHERE R.play_id = $1
 `
@@ -276,7 +497,7 @@ func (q *Queries) DoesRunExist(ctx context.Context, playID string) (bool, error)
 }
 
 const getRun = `-- name: GetRun :one
-SELECT id, ascension_level, build_version, campfire_rested, campfire_upgraded, character_id, choose_seed, circlet_count, floor_reached, gold, killed_by, local_time, neow_bonus_id, neow_cost_id, path_per_floor, path_taken, play_id, player_experience, playtime, purchased_purges, score, seed_played, seed_source_timestamp, special_seed, timestamp, victory, win_rate, added FROM RunsData WHERE id = $1 LIMIT 1
+SELECT id, ascension_level, build_version, campfire_rested, campfire_upgraded, character_id, choose_seed, circlet_count, floor_reached, gold, killed_by, local_time, neow_bonus_id, neow_cost_id, path_per_floor, path_taken, play_id, player_experience, playtime, purchased_purges, score, seed_played, seed_source_timestamp, special_seed, timestamp, victory, win_rate, added, uploader FROM RunsData WHERE id = $1 LIMIT 1
 `
 
 func (q *Queries) GetRun(ctx context.Context, id int32) (Runsdatum, error) {
@@ -311,6 +532,7 @@ func (q *Queries) GetRun(ctx context.Context, id int32) (Runsdatum, error) {
 		&i.Victory,
 		&i.WinRate,
 		&i.Added,
+		&i.Uploader,
 	)
 	return i, err
 }
@@ -326,6 +548,30 @@ func (q *Queries) GetStr(ctx context.Context, str string) (int32, error) {
 	return id, err
 }
 
+const playIdsByUploader = `-- name: PlayIdsByUploader :many
+SELECT play_id FROM RunsData WHERE uploader = $1
+`
+
+func (q *Queries) PlayIdsByUploader(ctx context.Context, uploader sql.NullString) ([]string, error) {
+	rows, err := q.db.Query(ctx, playIdsByUploader, uploader)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var play_id string
+		if err := rows.Scan(&play_id); err != nil {
+			return nil, err
+		}
+		items = append(items, play_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const runToJson = `-- name: RunToJson :one
 SELECT r.raw::json, r.path_per_floor::text, r.path_taken::text, r.extra::json
 FROM run_to_json((SELECT id FROM runsdata WHERE play_id = $1)) r
@@ -350,6 +596,20 @@ func (q *Queries) RunToJson(ctx context.Context, playID string) (RunToJsonRow, e
 	return i, err
 }
 
+const setRunUploader = `-- name: SetRunUploader :exec
+UPDATE RunsData SET uploader = $2 WHERE id = $1
+`
+
+type SetRunUploaderParams struct {
+	ID       int32
+	Uploader sql.NullString
+}
+
+func (q *Queries) SetRunUploader(ctx context.Context, arg SetRunUploaderParams) error {
+	_, err := q.db.Exec(ctx, setRunUploader, arg.ID, arg.Uploader)
+	return err
+}
+
 const strCacheAdd = `-- name: StrCacheAdd :exec
 SELECT str_cache_add($1::text[])
 `
@@ -137,6 +137,32 @@ type Eventchoice struct {
 	RelicsObtainedIds []int32
 }
 
+type Failedupload struct {
+	ID       int64
+	PlayID   string
+	Body     pgtype.JSON
+	Uploader sql.NullString
+	Stage    string
+	Error    string
+	Attempts int32
+	Created  time.Time
+	Updated  time.Time
+}
+
+type Ingestqueue struct {
+	ID        int64
+	PlayID    string
+	Token     string
+	Body      pgtype.JSON
+	Uploader  sql.NullString
+	Status    int16
+	Attempts  int32
+	LastError sql.NullString
+	Created   time.Time
+	Updated   time.Time
+	RunAfter  time.Time
+}
+
 type Itemspurchased struct {
 	RunID  int32
 	CardID int32
@@ -165,10 +191,20 @@ type Potionobtain struct {
 }
 
 type Rawjsonarchive struct {
-	ID     int32
-	Bdata  pgtype.JSON
-	PlayID string
-	Status int16
+	ID        int32
+	Bdata     []byte
+	PlayID    string
+	Status    int16
+	ClaimedBy sql.NullString
+	ClaimedAt sql.NullTime
+	Sha256    []byte
+}
+
+type Rawdiskoutbox struct {
+	PlayID  string
+	Bdata   []byte
+	Created time.Time
+	Sha256  []byte
 }
 
 type Relicobtain struct {
@@ -235,6 +271,7 @@ type Runsdatum struct {
 	Victory             bool
 	WinRate             float64
 	Added               time.Time
+	Uploader            sql.NullString
 }
 
 type Scope struct {
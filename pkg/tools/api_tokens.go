@@ -0,0 +1,98 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/samber/lo"
+)
+
+type TokensCmd struct {
+	flags *flag.FlagSet
+	// Create a token with the given name
+	Create string
+	// Revoke the token with this id
+	Revoke int
+	// Email of the token owner
+	Email string
+	// Comma-separated list of scopes to restrict a new token to
+	Scopes string
+	// How long until a new token expires
+	Expires string
+}
+
+func NewTokensCmd() *TokensCmd {
+	cmd := new(TokensCmd)
+	fg := flag.NewFlagSet("tokens", flag.ExitOnError)
+	fg.StringVar(&cmd.Create, "create", "", "Create a token with this name for -email")
+	fg.IntVar(&cmd.Revoke, "revoke", 0, "Revoke the token with this id")
+	fg.StringVar(&cmd.Email, "email", "", "Owner of the new token, or only list tokens for this user")
+	fg.StringVar(&cmd.Scopes, "scopes", "", "Comma-separated scopes to restrict a new token to, empty for all of the user's scopes")
+	fg.StringVar(&cmd.Expires, "expires", "", "How long until a new token expires (ex. 720h), empty for never")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *TokensCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *TokensCmd) Description() string {
+	return `list, create or revoke API tokens`
+}
+
+func (cmd *TokensCmd) Run() error {
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	db := orm.New(pool)
+
+	switch {
+	case cmd.Revoke != 0:
+		if err := web.RevokeApiToken(ctx, db, int32(cmd.Revoke)); err != nil {
+			return err
+		}
+		fmt.Printf("revoked token %d\n", cmd.Revoke)
+	case cmd.Create != "":
+		if cmd.Email == "" {
+			return errors.New("-create requires -email")
+		}
+		var scopes []string
+		if cmd.Scopes != "" {
+			scopes = strings.Split(cmd.Scopes, ",")
+		}
+		tok, err := web.CreateApiToken(ctx, db, web.CreateApiTokenParams{
+			Email:     cmd.Email,
+			Name:      cmd.Create,
+			Scopes:    scopes,
+			ExpiresIn: cmd.Expires,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created token %d, it will not be shown again:\n%s\n", tok.ID, tok.Token)
+	default:
+		tokens, err := web.ListApiTokens(ctx, db, cmd.Email)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			scopes := lo.Ternary(t.Scopes == nil, "*", strings.Join(t.Scopes, ","))
+			expires := "never"
+			if t.Expires != nil {
+				expires = t.Expires.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-5d %-30s %-20s scopes=%s expires=%s\n", t.ID, t.Email, t.Name, scopes, expires)
+		}
+	}
+	return nil
+}
@@ -1,32 +1,69 @@
 package tools
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
+	"github.com/bindernews/sts-msr/pkg/blob"
 	"github.com/bindernews/sts-msr/pkg/orm"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/bindernews/sts-msr/pkg/web"
 )
 
+// Layout of the -since and -until flags
+const exportDateFormat = "2006-01-02"
+
 type ArchiveExportCmd struct {
 	// CLI flag set
 	flags *flag.FlagSet
-	// Path to archive file to write into
+	// Prefix of the archive parts to write, also identifies the export for -resume
 	OutFile string
+	// Compression of each part, ArchiveGzip or ArchiveZstd
+	Compress string
+	// Start a new part once the current one reaches this many bytes
+	PartSize int64
+	// Number of rows to claim from the database at a time
+	BatchSize int
+	// Continue an export with the same -out which didn't finish
+	Resume bool
+	// If set, release rows claimed longer ago than this and exit
+	Reclaim time.Duration
+	// Only export runs which ended on or after this date
+	Since string
+	// Only export runs which ended before this date
+	Until string
+	// Only export runs for this character
+	Character string
+	// Only export runs from this game build
+	Build string
+	// Server config file, used to find the blob store
+	Config string
+	// Export every run in the blob store instead of the raw archive table
+	FromBlobs bool
 }
 
 func NewArchiveExportCmd() *ArchiveExportCmd {
 	cmd := new(ArchiveExportCmd)
 	fg := flag.NewFlagSet("export-runs", flag.ExitOnError)
-	defaultOut := fmt.Sprintf("json-archive_%s.tar.gz", time.Now().UTC().Format(time.RFC3339))
-	fg.StringVar(&cmd.OutFile, "out", defaultOut, "Output file name")
+	defaultOut := fmt.Sprintf("json-archive_%s", time.Now().UTC().Format("2006-01-02T150405Z"))
+	fg.StringVar(&cmd.OutFile, "out", defaultOut, "Output file prefix, parts are named <out>-0001.tar.gz etc.")
+	fg.StringVar(&cmd.Compress, "compress", ArchiveGzip, "Compression for each part, gzip or zstd")
+	fg.Int64Var(&cmd.PartSize, "part-size", 1<<30, "Start a new part once the current one reaches this many bytes, 0 for a single part")
+	fg.IntVar(&cmd.BatchSize, "batch", 500, "Number of runs to claim from the database at a time")
+	fg.BoolVar(&cmd.Resume, "resume", false, "Continue an export with the same -out which was interrupted")
+	fg.DurationVar(&cmd.Reclaim, "reclaim", 0, "Release runs claimed by exports longer ago than this, so they're exported again, then exit")
+	fg.StringVar(&cmd.Since, "since", "", "Only export runs which ended on or after this date (YYYY-MM-DD)")
+	fg.StringVar(&cmd.Until, "until", "", "Only export runs which ended before this date (YYYY-MM-DD)")
+	fg.StringVar(&cmd.Character, "character", "", "Only export runs for this character, ex. IRONCLAD")
+	fg.StringVar(&cmd.Build, "build", "", "Only export runs from this game build, ex. 2022-12-18")
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file, used with -from-blobs")
+	fg.BoolVar(&cmd.FromBlobs, "from-blobs", false, "Export every run in the server's blob store instead of the raw archive table")
 	cmd.flags = fg
 	return cmd
 }
@@ -36,67 +73,174 @@ func (cmd *ArchiveExportCmd) Flags() *flag.FlagSet {
 }
 
 func (cmd *ArchiveExportCmd) Description() string {
-	return `export runs from the raw archive table into a .tar.gz file`
+	return `export runs from the raw archive table or blob store into .tar.gz files`
 }
 
 func (cmd *ArchiveExportCmd) Run() error {
 	ctx := context.Background()
-	pool, err := pgxpool.Connect(ctx, os.Getenv(EnvPostgresConn))
+	if cmd.BatchSize < 1 {
+		return fmt.Errorf("-batch must be at least 1")
+	}
+	if cmd.FromBlobs {
+		return cmd.exportBlobs(ctx)
+	}
+	filters, err := cmd.claimFilters()
 	if err != nil {
 		return err
 	}
-	// Try to open the file we'll use for writing
-	tarFile, err := os.Create(cmd.OutFile)
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
 	if err != nil {
 		return err
 	}
-	defer tarFile.Close()
-
+	defer pool.Close()
 	db := orm.New(pool)
-	// Pick random status value, low-enough chance of collision to be fine
-	// as long as we're not running 1000s of copies of this at the same time.
-	myStatus := int16((rand.Uint32() % 32760) + 1)
-	// Get rows we're going to update and set them as in-progress
-	rowData, err := db.ArchiveBegin(ctx, myStatus)
+
+	if cmd.Reclaim > 0 {
+		n, err := db.ArchiveReclaim(ctx, cmd.Reclaim.Seconds())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("released %d runs\n", n)
+		return nil
+	}
+
+	parts, err := newArchiveParts(cmd.OutFile, cmd.Compress, cmd.PartSize, cmd.Resume)
 	if err != nil {
 		return err
 	}
-	// Uncompress data, then tar and compress
-	if err := cmd.recompress(rowData, tarFile); err != nil {
+	// Rows are claimed with the name of the export, so -resume can find them again
+	claimedBy := sql.NullString{String: filepath.Base(cmd.OutFile), Valid: true}
+	var pending []int32
+	skipped := 0
+	// Only mark rows done once the part they're in is safely on disk. If we crash after
+	// the rename but before this, -resume writes those runs again in a later part.
+	parts.onFinish = func(name string) error {
+		_, err := db.ArchiveComplete(ctx, orm.ArchiveCompleteParams{ClaimedBy: claimedBy, Ids: pending})
+		pending = pending[:0]
 		return err
 	}
-	// Mark as completed
-	_, err = db.ArchiveComplete(ctx, myStatus)
+	add := func(rows []orm.Rawjsonarchive) error {
+		for _, row := range rows {
+			// Added first, since Add may finish the part
+			pending = append(pending, row.ID)
+			err := parts.Add(row.PlayID, row.Bdata, row.Sha256)
+			if isBadRun(err) {
+				// Released so it doesn't stop the export, later exports report it again
+				pending = pending[:len(pending)-1]
+				fmt.Fprintf(os.Stderr, "skipped %v\n", err)
+				skipped++
+				_, err = db.ArchiveRelease(ctx, orm.ArchiveReleaseParams{ClaimedBy: claimedBy, Ids: []int32{row.ID}})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = func() error {
+		if cmd.Resume {
+			// Runs claimed before the previous export was interrupted
+			params := orm.ArchiveClaimedParams{ClaimedBy: claimedBy, Limit: int32(cmd.BatchSize)}
+			for {
+				rows, err := db.ArchiveClaimed(ctx, params)
+				if err != nil {
+					return err
+				}
+				if err := add(rows); err != nil {
+					return err
+				}
+				if len(rows) < cmd.BatchSize {
+					break
+				}
+				params.ID = rows[len(rows)-1].ID
+			}
+		}
+		filters.ClaimedBy = claimedBy
+		filters.Limit = int32(cmd.BatchSize)
+		for {
+			rows, err := db.ArchiveClaim(ctx, filters)
+			if err != nil {
+				return err
+			}
+			// RETURNING doesn't keep the subquery's order
+			sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+			if err := add(rows); err != nil {
+				return err
+			}
+			if len(rows) < cmd.BatchSize {
+				break
+			}
+			filters.AfterID = rows[len(rows)-1].ID
+		}
+		return parts.Finish()
+	}()
 	if err != nil {
+		parts.Abort()
+		fmt.Printf("export interrupted after %d runs, run again with -out %s -resume to continue\n", parts.Runs, cmd.OutFile)
 		return err
 	}
+	fmt.Printf("exported %d runs into %d parts, skipped %d bad runs\n", parts.Runs, len(parts.Parts), skipped)
 	return nil
 }
 
-func (cmd *ArchiveExportCmd) recompress(rowData []orm.Rawjsonarchive, dst io.Writer) error {
-	tarGz, err := gzip.NewWriterLevel(dst, gzip.BestCompression)
+// Parse the filter flags
+func (cmd *ArchiveExportCmd) claimFilters() (orm.ArchiveClaimParams, error) {
+	var params orm.ArchiveClaimParams
+	for _, f := range []struct {
+		flag string
+		val  string
+		dst  *sql.NullTime
+	}{{"since", cmd.Since, &params.Since}, {"until", cmd.Until, &params.Until}} {
+		if f.val == "" {
+			continue
+		}
+		t, err := time.Parse(exportDateFormat, f.val)
+		if err != nil {
+			return params, fmt.Errorf("-%s: %w", f.flag, err)
+		}
+		*f.dst = sql.NullTime{Time: t, Valid: true}
+	}
+	params.Character = sql.NullString{String: cmd.Character, Valid: cmd.Character != ""}
+	params.Build = sql.NullString{String: cmd.Build, Valid: cmd.Build != ""}
+	return params, nil
+}
+
+// Write every run in the blob store into parts. The blob store isn't modified, so this
+// may be run as often as needed.
+func (cmd *ArchiveExportCmd) exportBlobs(ctx context.Context) error {
+	blobs, err := requireServerBlobs(cmd.Config)
 	if err != nil {
 		return err
 	}
-	defer tarGz.Close()
-	tarWr := tar.NewWriter(tarGz)
-	for _, arc := range rowData {
-		data := arc.Bdata.Bytes
-		hdr := tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     arc.PlayID + ".run",
-			Size:     int64(len(data)),
-			Mode:     0660, // octal!
-		}
-		if err := tarWr.WriteHeader(&hdr); err != nil {
+	defer blobs.Close()
+	parts, err := newArchiveParts(cmd.OutFile, cmd.Compress, cmd.PartSize, false)
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	err = blobs.List(ctx, func(key string) error {
+		data, sum, err := blobs.Get(ctx, key)
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil
+		} else if err != nil {
 			return err
 		}
-		if _, err := tarWr.Write(data); err != nil {
-			return err
+		err = parts.Add(key, data, sum)
+		if isBadRun(err) {
+			fmt.Fprintf(os.Stderr, "skipped %v\n", err)
+			skipped++
+			return nil
 		}
+		return err
+	})
+	if err == nil {
+		err = parts.Finish()
 	}
-	if err := tarWr.Close(); err != nil {
+	if err != nil {
+		parts.Abort()
 		return err
 	}
+	fmt.Printf("exported %d runs into %d parts, skipped %d bad runs\n", parts.Runs, len(parts.Parts), skipped)
 	return nil
 }
@@ -0,0 +1,124 @@
+package tools
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Name of the manifest written at the end of each export part
+const ArchiveManifestName = "MANIFEST.json"
+
+// Current version of ArchiveManifest
+const archiveManifestVersion = 1
+
+// Error when a run doesn't match its recorded checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Lists every run in an export part, so the part can be checked with verify-archive
+type ArchiveManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Number of runs in the part
+	Runs int `json:"runs"`
+	// Total uncompressed size of the runs
+	Bytes int64                  `json:"bytes"`
+	Files []ArchiveManifestEntry `json:"files"`
+}
+
+type ArchiveManifestEntry struct {
+	// Name of the file in the tar
+	Name   string `json:"name"`
+	PlayID string `json:"play_id"`
+	Size   int64  `json:"size"`
+	// Hex SHA-256 of the uncompressed run
+	Sha256 string `json:"sha256"`
+}
+
+func (m *ArchiveManifest) add(ent ArchiveManifestEntry) {
+	m.Files = append(m.Files, ent)
+	m.Runs++
+	m.Bytes += ent.Size
+}
+
+// Add the manifest to the end of a tar
+func (m *ArchiveManifest) writeTo(tarWr *tar.Writer) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ArchiveManifestName,
+		Size:     int64(len(data)),
+		Mode:     0660,
+		ModTime:  m.Created,
+	}
+	if err := tarWr.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err = tarWr.Write(data)
+	return err
+}
+
+// Reads a manifest and the checksum of every other file from an export part
+func readArchivePart(tarPath string) (*ArchiveManifest, map[string]ArchiveManifestEntry, error) {
+	var manifest *ArchiveManifest
+	found := make(map[string]ArchiveManifestEntry)
+	err := walkTar(tarPath, func(hdr *tar.Header, rd io.Reader) error {
+		if hdr.Name == ArchiveManifestName {
+			manifest = new(ArchiveManifest)
+			return json.NewDecoder(rd).Decode(manifest)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, rd)
+		if err != nil {
+			return err
+		}
+		found[hdr.Name] = ArchiveManifestEntry{
+			Name:   hdr.Name,
+			PlayID: strings.TrimSuffix(hdr.Name, ".run"),
+			Size:   n,
+			Sha256: hex.EncodeToString(h.Sum(nil)),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%s has no %s", tarPath, ArchiveManifestName)
+	}
+	return manifest, found, nil
+}
+
+// Compares the files in a part with its manifest, returning a description of each problem
+func checkArchiveManifest(manifest *ArchiveManifest, found map[string]ArchiveManifestEntry) []string {
+	var problems []string
+	if manifest.Runs != len(manifest.Files) {
+		problems = append(problems, fmt.Sprintf("manifest says %d runs but lists %d", manifest.Runs, len(manifest.Files)))
+	}
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, want := range manifest.Files {
+		listed[want.Name] = true
+		got, ok := found[want.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing from archive", want.Name))
+		} else if got.Size != want.Size || got.Sha256 != want.Sha256 {
+			problems = append(problems, fmt.Sprintf("%s: %v, manifest has %s (%d bytes), archive has %s (%d bytes)",
+				want.Name, ErrChecksumMismatch, want.Sha256, want.Size, got.Sha256, got.Size))
+		}
+	}
+	for name := range found {
+		if !listed[name] {
+			problems = append(problems, fmt.Sprintf("%s: not in manifest", name))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckArchiveManifest(t *testing.T) {
+	a := ArchiveManifestEntry{Name: "a.run", PlayID: "a", Size: 3, Sha256: "aa"}
+	b := ArchiveManifestEntry{Name: "b.run", PlayID: "b", Size: 5, Sha256: "bb"}
+	changed := func(ent ArchiveManifestEntry, size int64, sum string) ArchiveManifestEntry {
+		ent.Size, ent.Sha256 = size, sum
+		return ent
+	}
+	cases := []struct {
+		name     string
+		runs     int
+		files    []ArchiveManifestEntry
+		found    []ArchiveManifestEntry
+		problems []string
+	}{
+		{"ok", 2, []ArchiveManifestEntry{a, b}, []ArchiveManifestEntry{a, b}, nil},
+		{"empty", 0, nil, nil, nil},
+		{"missing", 2, []ArchiveManifestEntry{a, b}, []ArchiveManifestEntry{a}, []string{"b.run: missing from archive"}},
+		{"extra", 1, []ArchiveManifestEntry{a}, []ArchiveManifestEntry{a, b}, []string{"b.run: not in manifest"}},
+		{"size", 1, []ArchiveManifestEntry{a}, []ArchiveManifestEntry{changed(a, 4, "aa")},
+			[]string{"a.run: checksum mismatch, manifest has aa (3 bytes), archive has aa (4 bytes)"}},
+		{"hash", 1, []ArchiveManifestEntry{a}, []ArchiveManifestEntry{changed(a, 3, "ab")},
+			[]string{"a.run: checksum mismatch, manifest has aa (3 bytes), archive has ab (3 bytes)"}},
+		{"runs", 3, []ArchiveManifestEntry{a, b}, []ArchiveManifestEntry{a, b}, []string{"manifest says 3 runs but lists 2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			found := make(map[string]ArchiveManifestEntry)
+			for _, ent := range c.found {
+				found[ent.Name] = ent
+			}
+			manifest := &ArchiveManifest{Runs: c.runs, Files: c.files}
+			assert.Equal(t, c.problems, checkArchiveManifest(manifest, found))
+		})
+	}
+}
+
+// Parts written by archiveParts read back with the same runs and checksums
+func TestArchivePartRoundTrip(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "export")
+	for _, compress := range []string{ArchiveGzip, ArchiveZstd} {
+		ap, err := newArchiveParts(prefix, compress, 0, false)
+		require.NoError(t, err)
+		var want []ArchiveManifestEntry
+		for i := 0; i < 3; i++ {
+			body := []byte(fmt.Sprintf(`{"play_id": "run-%d"}`, i))
+			playId := fmt.Sprint("run-", i)
+			// Runs without a recorded checksum are exported too
+			sum := web.RunSum(body)
+			if i == 2 {
+				require.NoError(t, ap.Add(playId, body, nil))
+			} else {
+				require.NoError(t, ap.Add(playId, web.CompressRaw(body), sum))
+			}
+			want = append(want, ArchiveManifestEntry{
+				Name:   playId + ".run",
+				PlayID: playId,
+				Size:   int64(len(body)),
+				Sha256: hex.EncodeToString(sum),
+			})
+		}
+		require.NoError(t, ap.Finish())
+		require.Len(t, ap.Parts, 1)
+
+		manifest, found, err := readArchivePart(ap.Parts[0])
+		require.NoError(t, err)
+		assert.Equal(t, archiveManifestVersion, manifest.Version)
+		assert.Equal(t, 3, manifest.Runs)
+		assert.Equal(t, want, manifest.Files)
+		assert.Equal(t, want[0].Size+want[1].Size+want[2].Size, manifest.Bytes)
+		assert.Len(t, found, 3)
+		assert.Empty(t, checkArchiveManifest(manifest, found))
+	}
+}
+
+func TestCheckArchiveDb(t *testing.T) {
+	sums := map[string][]byte{
+		"same":  {0xaa},
+		"other": {0xbb},
+		"old":   nil,
+	}
+	var lookups int
+	archiveSums := func(ctx context.Context, playIds []string) ([]orm.ArchiveSumsRow, error) {
+		lookups++
+		assert.LessOrEqual(t, len(playIds), verifyPageSize)
+		var rows []orm.ArchiveSumsRow
+		for _, id := range playIds {
+			if sum, ok := sums[id]; ok {
+				rows = append(rows, orm.ArchiveSumsRow{PlayID: id, Sha256: sum})
+			}
+		}
+		return rows, nil
+	}
+	manifest := &ArchiveManifest{Files: []ArchiveManifestEntry{
+		{Name: "same.run", PlayID: "same", Sha256: "aa"},
+		{Name: "other.run", PlayID: "other", Sha256: "aa"},
+		{Name: "old.run", PlayID: "old", Sha256: "aa"},
+		{Name: "gone.run", PlayID: "gone", Sha256: "aa"},
+	}}
+	// Enough runs for a second page
+	for i := 0; i < verifyPageSize; i++ {
+		manifest.Files = append(manifest.Files, ArchiveManifestEntry{Name: "same.run", PlayID: "same", Sha256: "aa"})
+	}
+	problems, unchecked, err := checkArchiveDb(context.Background(), archiveSums, manifest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"other.run: checksum mismatch, database has bb, manifest has aa",
+		"gone.run: not in the database",
+	}, problems)
+	assert.Equal(t, 1, unchecked)
+	assert.Equal(t, 2, lookups)
+}
@@ -0,0 +1,237 @@
+package tools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression used for export parts
+const (
+	ArchiveGzip = "gzip"
+	ArchiveZstd = "zstd"
+)
+
+// Suffix of a part which is still being written
+const partTmpExt = ".tmp"
+
+// Error when a stored run can't be decompressed
+var ErrCorruptRun = errors.New("stored run is corrupt")
+
+// Returns true if err from archiveParts.Add means the run was bad and was left out. The
+// part is still fine, so the export can carry on without the run.
+func isBadRun(err error) bool {
+	return errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrCorruptRun)
+}
+
+// Writes runs into a series of numbered .tar.gz or .tar.zst parts named
+// <prefix>-0001.tar.gz etc, each ending with a manifest of its runs. A part is written
+// to a .tmp file and only renamed once it's complete, so a crash never leaves a
+// truncated part behind.
+type archiveParts struct {
+	prefix   string
+	ext      string
+	compress string
+	// A new part is started once the current one reaches this many bytes, 0 for no limit
+	maxSize int64
+	// Number of the next part
+	next int
+	// Called after each part is complete, with the part's file name
+	onFinish func(name string) error
+
+	// Part being written, nil if none
+	fd      *os.File
+	counter *countingWriter
+	comp    io.WriteCloser
+	tarWr   *tar.Writer
+	// Runs in the current part
+	manifest *ArchiveManifest
+
+	// Totals, for the summary
+	Runs  int
+	Parts []string
+}
+
+// Prepare to write parts starting with prefix. With resume, numbering continues after
+// any existing parts, otherwise existing parts are an error.
+func newArchiveParts(prefix, compress string, maxSize int64, resume bool) (*archiveParts, error) {
+	ap := &archiveParts{prefix: prefix, compress: compress, maxSize: maxSize, next: 1}
+	switch compress {
+	case ArchiveGzip:
+		ap.ext = ".tar.gz"
+	case ArchiveZstd:
+		ap.ext = ".tar.zst"
+	default:
+		return nil, fmt.Errorf("unknown compression %q, expected %s or %s", compress, ArchiveGzip, ArchiveZstd)
+	}
+	existing, err := filepath.Glob(prefix + "-*" + ap.ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range existing {
+		num, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix+"-"), ap.ext))
+		if err != nil {
+			continue
+		}
+		if !resume {
+			return nil, fmt.Errorf("%s already exists, use -resume to continue that export", name)
+		}
+		if num >= ap.next {
+			ap.next = num + 1
+		}
+	}
+	// Leftovers from a crash, the runs in them are still claimed and will be written again
+	tmps, _ := filepath.Glob(prefix + "-*" + ap.ext + partTmpExt)
+	for _, name := range tmps {
+		os.Remove(name)
+	}
+	return ap, nil
+}
+
+func (ap *archiveParts) partName(num int) string {
+	return fmt.Sprintf("%s-%04d%s", ap.prefix, num, ap.ext)
+}
+
+// Decompress a raw run and add it to the current part, finishing the part if it's full.
+// If sum isn't nil the run must match it, otherwise ErrChecksumMismatch is returned. Runs
+// which can't be decompressed return ErrCorruptRun. See isBadRun.
+func (ap *archiveParts) Add(playId string, raw []byte, sum []byte) error {
+	if ap.fd == nil {
+		if err := ap.start(); err != nil {
+			return err
+		}
+	}
+	ent, err := writeTarRun(ap.tarWr, playId, raw, sum)
+	if err != nil {
+		return err
+	}
+	ap.manifest.add(ent)
+	ap.Runs++
+	// The compressor buffers data, so parts may go over by up to one block
+	if ap.maxSize > 0 && ap.counter.n >= ap.maxSize {
+		return ap.Finish()
+	}
+	return nil
+}
+
+func (ap *archiveParts) start() error {
+	fd, err := os.OpenFile(ap.partName(ap.next)+partTmpExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	ap.fd = fd
+	ap.counter = &countingWriter{w: fd}
+	if ap.compress == ArchiveZstd {
+		ap.comp, err = zstd.NewWriter(ap.counter, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	} else {
+		ap.comp, err = gzip.NewWriterLevel(ap.counter, gzip.BestCompression)
+	}
+	if err != nil {
+		ap.Abort()
+		return err
+	}
+	ap.tarWr = tar.NewWriter(ap.comp)
+	ap.manifest = &ArchiveManifest{Version: archiveManifestVersion, Created: time.Now().UTC()}
+	return nil
+}
+
+// Complete the current part, if any, and call onFinish
+func (ap *archiveParts) Finish() error {
+	if ap.fd == nil {
+		return nil
+	}
+	err := ap.manifest.writeTo(ap.tarWr)
+	if err == nil {
+		err = ap.tarWr.Close()
+	}
+	if err == nil {
+		err = ap.comp.Close()
+	}
+	if err == nil {
+		err = ap.fd.Sync()
+	}
+	if err2 := ap.fd.Close(); err == nil {
+		err = err2
+	}
+	name := ap.partName(ap.next)
+	if err == nil {
+		err = os.Rename(name+partTmpExt, name)
+	}
+	ap.fd = nil
+	if err != nil {
+		os.Remove(name + partTmpExt)
+		return err
+	}
+	ap.next++
+	ap.Parts = append(ap.Parts, name)
+	if ap.onFinish != nil {
+		return ap.onFinish(name)
+	}
+	return nil
+}
+
+// Discard the part being written
+func (ap *archiveParts) Abort() {
+	if ap.fd == nil {
+		return
+	}
+	ap.fd.Close()
+	os.Remove(ap.fd.Name())
+	ap.fd = nil
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Decompress a raw run and add it to the tar as <playId>.run, returning its manifest entry.
+// If sum isn't nil the run must match it. Nothing is written if the run is bad.
+func writeTarRun(tarWr *tar.Writer, playId string, raw []byte, sum []byte) (ArchiveManifestEntry, error) {
+	var ent ArchiveManifestEntry
+	data, err := web.DecompressRaw(raw)
+	if err != nil {
+		return ent, fmt.Errorf("%s: %w, %v", playId, ErrCorruptRun, err)
+	}
+	actual := web.RunSum(data)
+	if sum != nil && !bytes.Equal(sum, actual) {
+		return ent, fmt.Errorf("%s: %w, recorded %x but the stored run is %x", playId, ErrChecksumMismatch, sum, actual)
+	}
+	hdr := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     playId + ".run",
+		Size:     int64(len(data)),
+		Mode:     0660, // octal!
+	}
+	if err := tarWr.WriteHeader(&hdr); err != nil {
+		return ent, err
+	}
+	if _, err := tarWr.Write(data); err != nil {
+		return ent, err
+	}
+	return ArchiveManifestEntry{
+		Name:   hdr.Name,
+		PlayID: playId,
+		Size:   hdr.Size,
+		Sha256: hex.EncodeToString(actual),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a compressed run and its checksum
+func testArchiveRun(i int) ([]byte, []byte) {
+	body := []byte(fmt.Sprintf(`{"play_id": "run-%d"}`, i))
+	return web.CompressRaw(body), web.RunSum(body)
+}
+
+func TestArchiveParts(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "export")
+	ap, err := newArchiveParts(prefix, ArchiveGzip, 1, false)
+	require.NoError(t, err)
+	var finished []string
+	ap.onFinish = func(name string) error {
+		// Parts are complete before onFinish is called
+		assert.FileExists(t, name)
+		assert.NoFileExists(t, name+partTmpExt)
+		finished = append(finished, name)
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		raw, sum := testArchiveRun(i)
+		require.NoError(t, ap.Add(fmt.Sprint(i), raw, sum))
+	}
+	require.NoError(t, ap.Finish())
+	want := []string{prefix + "-0001.tar.gz", prefix + "-0002.tar.gz", prefix + "-0003.tar.gz"}
+	assert.Equal(t, want, finished)
+	assert.Equal(t, want, ap.Parts)
+	assert.Equal(t, 3, ap.Runs)
+
+	// Existing parts need -resume, which continues the numbering and removes unfinished parts
+	_, err = newArchiveParts(prefix, ArchiveGzip, 0, false)
+	assert.ErrorContains(t, err, "-resume")
+	require.NoError(t, os.WriteFile(prefix+"-0004.tar.gz"+partTmpExt, nil, 0644))
+	ap, err = newArchiveParts(prefix, ArchiveGzip, 0, true)
+	require.NoError(t, err)
+	assert.Equal(t, 4, ap.next)
+	assert.NoFileExists(t, prefix+"-0004.tar.gz"+partTmpExt)
+
+	// Parts with another compression are numbered separately
+	ap, err = newArchiveParts(prefix, ArchiveZstd, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ap.next)
+	_, err = newArchiveParts(prefix, "lz4", 0, false)
+	assert.Error(t, err)
+}
+
+func TestArchivePartsBadRun(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "export")
+	ap, err := newArchiveParts(prefix, ArchiveZstd, 0, false)
+	require.NoError(t, err)
+	raw, sum := testArchiveRun(1)
+	_, otherSum := testArchiveRun(2)
+
+	err = ap.Add("mismatch", raw, otherSum)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.True(t, isBadRun(err))
+	err = ap.Add("corrupt", raw[:8], nil)
+	assert.ErrorIs(t, err, ErrCorruptRun)
+	assert.True(t, isBadRun(err))
+
+	// The part is still usable, and only has the good run
+	require.NoError(t, ap.Add("good", raw, sum))
+	require.NoError(t, ap.Finish())
+	assert.Equal(t, 1, ap.Runs)
+	manifest, found, err := readArchivePart(ap.Parts[0])
+	require.NoError(t, err)
+	assert.Empty(t, checkArchiveManifest(manifest, found))
+	require.Len(t, manifest.Files, 1)
+	assert.Equal(t, "good", manifest.Files[0].PlayID)
+	assert.Len(t, found, 1)
+}
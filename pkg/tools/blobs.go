@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+// Load the server config, a missing file uses the defaults
+func loadServerConfig(configPath string) (*web.Config, error) {
+	cfg := web.NewConfig()
+	if err := cfg.LoadFile(configPath, true); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load the server config and open the blob store raw runs are saved to. The store is
+// nil if raw runs aren't saved, otherwise the caller must close it.
+func openServerBlobs(configPath string) (*web.Config, blob.BlobStore, error) {
+	cfg, err := loadServerConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	blobs, err := web.OpenBlobStore(cfg.Upload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, blobs, nil
+}
+
+// Like openServerBlobs, but returns an error if raw runs aren't saved
+func requireServerBlobs(configPath string) (blob.BlobStore, error) {
+	_, blobs, err := openServerBlobs(configPath)
+	if err == nil && blobs == nil {
+		err = fmt.Errorf("%s: save_raw_to_disk is false, there's no blob store", configPath)
+	}
+	return blobs, err
+}
+
+// Submits every run in the blob store to the worker pool
+func submitBlobStore(ctx context.Context, blobs blob.BlobStore, wp *WorkerPool[rawRun]) error {
+	return blobs.List(ctx, func(key string) error {
+		data, _, err := blobs.Get(ctx, key)
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		wp.Submit(rawRun{Name: key, Data: data})
+		return nil
+	})
+}
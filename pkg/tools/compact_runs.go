@@ -0,0 +1,42 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+type CompactRunsCmd struct {
+	flags *flag.FlagSet
+	// Server config file, used to find the blob store
+	Config string
+}
+
+func NewCompactRunsCmd() *CompactRunsCmd {
+	cmd := new(CompactRunsCmd)
+	fg := flag.NewFlagSet("compact-runs", flag.ExitOnError)
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *CompactRunsCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *CompactRunsCmd) Description() string {
+	return `move raw run files into segment files and remove deleted runs from them`
+}
+
+func (cmd *CompactRunsCmd) Run() error {
+	blobs, err := requireServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	defer blobs.Close()
+	moved, rewritten, err := web.CompactBlobStore(context.Background(), blobs)
+	fmt.Printf("moved %d runs into segments, rewrote %d segments\n", moved, rewritten)
+	return err
+}
@@ -1,6 +1,8 @@
 package tools
 
+import "github.com/bindernews/sts-msr/pkg/web"
+
 const (
 	// Environment variable to get postgres connection
-	EnvPostgresConn = "POSTGRES_CONN"
+	EnvPostgresConn = web.EnvPostgresConn
 )
@@ -0,0 +1,145 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Writes query results to a Parquet file, with a nullable column for each result column.
+// Parquet sorts the columns of a schema by name, so they may be in a different order
+// than in the query.
+type datasetParquetWriter struct {
+	pw     *parquet.Writer
+	fields []pgproto3.FieldDescription
+	// Index of each result column in the schema
+	columns []int
+	row     parquet.Row
+}
+
+func newDatasetParquetWriter(wr io.Writer, name string, fields []pgproto3.FieldDescription) *datasetParquetWriter {
+	group := make(parquet.Group, len(fields))
+	for _, f := range fields {
+		group[string(f.Name)] = parquet.Optional(parquetNode(f.DataTypeOID))
+	}
+	schema := parquet.NewSchema(name, group)
+	columns := make([]int, len(fields))
+	for i, f := range fields {
+		leaf, _ := schema.Lookup(string(f.Name))
+		columns[i] = leaf.ColumnIndex
+	}
+	return &datasetParquetWriter{
+		pw:      parquet.NewWriter(wr, schema, parquet.Compression(&parquet.Zstd)),
+		fields:  fields,
+		columns: columns,
+		row:     make(parquet.Row, len(fields)),
+	}
+}
+
+// Write a row, given its values from pgx.Rows.Values and RawValues
+func (w *datasetParquetWriter) Write(values []any, raw [][]byte) error {
+	for i, f := range w.fields {
+		v, err := parquetValue(f.DataTypeOID, values[i], raw[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", f.Name, err)
+		}
+		def := 1
+		if v.IsNull() {
+			def = 0
+		}
+		w.row[w.columns[i]] = v.Level(0, def, w.columns[i])
+	}
+	_, err := w.pw.WriteRows([]parquet.Row{w.row})
+	return err
+}
+
+// Flush the remaining rows and write the footer, doesn't close the underlying writer
+func (w *datasetParquetWriter) Close() error {
+	return w.pw.Close()
+}
+
+// Parquet type for a Postgres type. Types the export doesn't produce are written as strings.
+func parquetNode(oid uint32) parquet.Node {
+	switch oid {
+	case pgtype.BoolOID:
+		return parquet.Leaf(parquet.BooleanType)
+	case pgtype.Int2OID, pgtype.Int4OID:
+		return parquet.Int(32)
+	case pgtype.Int8OID:
+		return parquet.Int(64)
+	case pgtype.Float4OID:
+		return parquet.Leaf(parquet.FloatType)
+	case pgtype.Float8OID:
+		return parquet.Leaf(parquet.DoubleType)
+	case pgtype.DateOID:
+		return parquet.Date()
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return parquet.Timestamp(parquet.Microsecond)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return parquet.JSON()
+	default:
+		return parquet.String()
+	}
+}
+
+// Converts a value of a Postgres type to its parquetNode type. JSON is taken from the raw
+// value, since pgx decodes it.
+func parquetValue(oid uint32, v any, raw []byte) (parquet.Value, error) {
+	if v == nil {
+		return parquet.NullValue(), nil
+	}
+	var ok bool
+	var pv parquet.Value
+	switch oid {
+	case pgtype.BoolOID:
+		var b bool
+		b, ok = v.(bool)
+		pv = parquet.BooleanValue(b)
+	case pgtype.Int2OID:
+		var n int16
+		n, ok = v.(int16)
+		pv = parquet.Int32Value(int32(n))
+	case pgtype.Int4OID:
+		var n int32
+		n, ok = v.(int32)
+		pv = parquet.Int32Value(n)
+	case pgtype.Int8OID:
+		var n int64
+		n, ok = v.(int64)
+		pv = parquet.Int64Value(n)
+	case pgtype.Float4OID:
+		var f float32
+		f, ok = v.(float32)
+		pv = parquet.FloatValue(f)
+	case pgtype.Float8OID:
+		var f float64
+		f, ok = v.(float64)
+		pv = parquet.DoubleValue(f)
+	case pgtype.DateOID:
+		var t time.Time
+		t, ok = v.(time.Time)
+		pv = parquet.Int32Value(int32(t.Unix() / 86400))
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		var t time.Time
+		t, ok = v.(time.Time)
+		pv = parquet.Int64Value(t.UnixMicro())
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		data := raw
+		if oid == pgtype.JSONBOID {
+			// The binary format starts with a version number
+			data = raw[1:]
+		}
+		// raw is reused for the next row
+		ok, pv = true, parquet.ByteArrayValue(append([]byte(nil), data...))
+	default:
+		ok, pv = true, parquet.ByteArrayValue([]byte(fmt.Sprint(v)))
+	}
+	if !ok {
+		return pv, fmt.Errorf("unexpected %T for type %d", v, oid)
+	}
+	return pv, nil
+}
@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+type DeleteRunsCmd struct {
+	flags *flag.FlagSet
+	// Comma-separated list of play_ids to delete
+	PlayIds string
+	// Delete all runs uploaded by this email
+	Uploader string
+	// Server config file, used to find where raw runs are stored
+	Config string
+}
+
+func NewDeleteRunsCmd() *DeleteRunsCmd {
+	cmd := new(DeleteRunsCmd)
+	fg := flag.NewFlagSet("delete-runs", flag.ExitOnError)
+	fg.StringVar(&cmd.PlayIds, "play-id", "", "Comma-separated list of play_ids to delete")
+	fg.StringVar(&cmd.Uploader, "uploader", "", "Delete all runs uploaded by this email")
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file, raw runs are deleted from its blob store")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *DeleteRunsCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *DeleteRunsCmd) Description() string {
+	return `delete runs by play_id or uploader, including raw archives`
+}
+
+func (cmd *DeleteRunsCmd) Run() error {
+	var playIds []string
+	if cmd.PlayIds != "" {
+		playIds = strings.Split(cmd.PlayIds, ",")
+	}
+	if len(playIds) == 0 && cmd.Uploader == "" {
+		return errors.New("must provide -play-id or -uploader")
+	}
+
+	_, blobs, err := openServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	if blobs != nil {
+		defer blobs.Close()
+	}
+
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if cmd.Uploader != "" {
+		ids, err := web.PlayIdsByUploader(ctx, orm.New(pool), cmd.Uploader)
+		if err != nil {
+			return err
+		}
+		playIds = append(playIds, ids...)
+	}
+	res, err := web.DeleteRuns(ctx, pool, blobs, playIds)
+	fmt.Printf("deleted runs=%d archives=%d files=%d queued=%d failed=%d outbox=%d\n",
+		res.Runs, res.Archives, res.Files, res.Queued, res.Failed, res.Outbox)
+	return err
+}
@@ -0,0 +1,418 @@
+package tools
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// Dataset layouts, see ExportDatasetCmd.Layout
+const (
+	// One file per table, joined on run_id
+	DatasetLayoutTables = "tables"
+	// A single runs file, with the other tables nested as JSON columns
+	DatasetLayoutRuns = "runs"
+)
+
+// Dataset file formats, see ExportDatasetCmd.Format
+const (
+	DatasetFormatParquet = "parquet"
+	DatasetFormatCsv     = "csv"
+)
+
+// Resolved columns of RunsData, aliased as r. The uploader is left out on purpose.
+const datasetRunColumns = `r.id AS run_id, r.play_id,
+	get_str(r.character_id) AS character, r.ascension_level, get_str(r.build_version) AS build_version,
+	r.victory, r.floor_reached, r.score, r.playtime, r.gold, get_str(r.killed_by) AS killed_by,
+	get_str(r.neow_bonus_id) AS neow_bonus, get_str(r.neow_cost_id) AS neow_cost,
+	r.campfire_rested, r.campfire_upgraded, r.choose_seed, r.circlet_count, r.local_time,
+	r.path_per_floor, r.path_taken, r.player_experience, r.purchased_purges, r.seed_played,
+	r.seed_source_timestamp, r.special_seed, r."timestamp", r.win_rate, r.added`
+
+// Resolves an array of CardSpecs IDs to card names, keeping their order
+func datasetCardNames(expr string) string {
+	return `to_json(array(SELECT cs.card_full FROM unnest(` + expr + `) WITH ORDINALITY AS u(id, nr)
+		JOIN CardSpecsEx cs ON cs.id = u.id ORDER BY u.nr))`
+}
+
+// Resolves an array of StrCache IDs to strings, keeping their order
+func datasetStrNames(expr string) string {
+	return `to_json(array(SELECT str_cache_to_str(` + expr + `)))`
+}
+
+// A table related to RunsData by run_id, with IDs resolved to names
+type datasetTable struct {
+	Name string
+	// Select list, not including run_id
+	Columns string
+	// Source of the rows, which must be aliased as x
+	From string
+	// Order of rows within a run
+	Order string
+	// The table has at most one row per run
+	PerRun bool
+}
+
+var datasetTables = []datasetTable{
+	{
+		Name:    "run_flags",
+		Columns: "x.flag",
+		From:    "RunFlags x",
+		Order:   "x.flag",
+	},
+	{
+		Name: "run_arrays",
+		Columns: "to_json(x.daily_mods) AS daily_mods, to_json(x.master_deck) AS master_deck, " +
+			"to_json(x.potions_floor_spawned) AS potions_floor_spawned, " +
+			"to_json(x.potions_floor_usage) AS potions_floor_usage, to_json(x.relics) AS relics",
+		From:   "RunArraysExt x",
+		Order:  "x.run_id",
+		PerRun: true,
+	},
+	{
+		Name:    "per_floor",
+		Columns: "x.floor, x.gold, x.current_hp, x.max_hp",
+		From:    "PerFloorData x",
+		Order:   "x.floor",
+	},
+	{
+		Name:    "card_choices",
+		Columns: "x.floor, s.card_full AS picked, " + datasetCardNames("x.not_picked") + " AS not_picked",
+		From:    "CardChoices x JOIN CardSpecsEx s ON s.id = x.picked",
+		Order:   "x.id",
+	},
+	{
+		Name: "event_choices",
+		Columns: "x.floor, get_str(x.event_name_id) AS event_name, get_str(x.player_choice_id) AS player_choice, " +
+			"x.damage_delta, x.gold_delta, x.max_hp_delta, " + datasetStrNames("x.relics_obtained_ids") + " AS relics_obtained",
+		From:  "EventChoices x",
+		Order: "x.id",
+	},
+	{
+		Name:    "damage_taken",
+		Columns: "x.floor, get_str(x.enemies) AS enemies, x.damage, x.turns",
+		From:    "DamageTaken x",
+		Order:   "x.id",
+	},
+	{
+		Name:    "boss_relics",
+		Columns: "x.ord, get_str(x.picked) AS picked, " + datasetStrNames("x.not_picked") + " AS not_picked",
+		From:    "BossRelics x",
+		Order:   "x.ord",
+	},
+	{
+		Name:    "campfire_choices",
+		Columns: "x.floor, x.key, x.data",
+		From:    "CampfireChoicesStrings x",
+		Order:   "x.id",
+	},
+	{
+		Name:    "items_purchased",
+		Columns: "x.floor, s.card_full AS card",
+		From:    "ItemsPurchased x JOIN CardSpecsEx s ON s.id = x.card_id",
+		Order:   "x.floor",
+	},
+	{
+		Name:    "items_purged",
+		Columns: "x.floor, s.card_full AS card",
+		From:    "ItemsPurged x JOIN CardSpecsEx s ON s.id = x.card_id",
+		Order:   "x.floor",
+	},
+	{
+		Name:    "potion_obtains",
+		Columns: "x.floor, get_str(x.key) AS potion",
+		From:    "PotionObtains x",
+		Order:   "x.id",
+	},
+	{
+		Name:    "relic_obtains",
+		Columns: "x.floor, get_str(x.key) AS relic",
+		From:    "RelicObtains x",
+		Order:   "x.id",
+	},
+}
+
+// Query for the rows of the table belonging to the selected runs
+func (t datasetTable) query() string {
+	return fmt.Sprintf("SELECT x.run_id, %s FROM %s JOIN dataset_runs d ON d.id = x.run_id ORDER BY x.run_id, %s",
+		t.Columns, t.From, t.Order)
+}
+
+// Column expression with the table's rows for run r as JSON
+func (t datasetTable) nested() string {
+	agg := "json_agg(t)"
+	if t.PerRun {
+		agg = "row_to_json(t)"
+	}
+	return fmt.Sprintf("(SELECT %s FROM (SELECT %s FROM %s WHERE x.run_id = r.id ORDER BY %s) t) AS %s",
+		agg, t.Columns, t.From, t.Order, t.Name)
+}
+
+// Query for the runs table. If nested is true every other table is added as a JSON column.
+func datasetRunsQuery(nested bool) string {
+	cols := []string{datasetRunColumns}
+	if nested {
+		for _, t := range datasetTables {
+			cols = append(cols, t.nested())
+		}
+	}
+	return "SELECT " + strings.Join(cols, ",\n") + " FROM RunsData r JOIN dataset_runs d ON d.id = r.id ORDER BY r.id"
+}
+
+// Selects the runs to export, using the filters as parameters in order
+const datasetSelectRuns = `CREATE TEMPORARY TABLE dataset_runs ON COMMIT DROP AS
+SELECT r.id FROM RunsData r
+WHERE ($1::text IS NULL OR r.character_id = (SELECT id FROM StrCache WHERE str = $1))
+  AND ($2::int IS NULL OR r.ascension_level >= $2)
+  AND ($3::int IS NULL OR r.ascension_level <= $3)
+  AND ($4::timestamp IS NULL OR r."timestamp" >= $4)
+  AND ($5::timestamp IS NULL OR r."timestamp" < $5)`
+
+type ExportDatasetCmd struct {
+	flags *flag.FlagSet
+	// Directory to write files into
+	OutDir string
+	// DatasetFormatParquet or DatasetFormatCsv
+	Format string
+	// DatasetLayoutTables or DatasetLayoutRuns
+	Layout string
+	// Comma-separated tables to export with the tables layout, empty for all
+	Tables string
+	// Compress each CSV file with gzip
+	Gzip bool
+	// Only export runs for this character
+	Character string
+	// Only export runs at or above this ascension, -1 for any
+	MinAscension int
+	// Only export runs at or below this ascension, -1 for any
+	MaxAscension int
+	// Only export runs which ended on or after this date
+	Since string
+	// Only export runs which ended before this date
+	Until string
+}
+
+func NewExportDatasetCmd() *ExportDatasetCmd {
+	cmd := new(ExportDatasetCmd)
+	fg := flag.NewFlagSet("export-dataset", flag.ExitOnError)
+	fg.StringVar(&cmd.OutDir, "out", "dataset", "Directory to write files into")
+	fg.StringVar(&cmd.Format, "format", DatasetFormatParquet, "'parquet' or 'csv'")
+	fg.StringVar(&cmd.Layout, "layout", DatasetLayoutTables,
+		"'tables' for one file per table joined on run_id, 'runs' for a single file with the other tables as JSON columns")
+	fg.StringVar(&cmd.Tables, "tables", "", "Comma-separated tables to export with -layout tables, defaults to all of them")
+	fg.BoolVar(&cmd.Gzip, "gzip", false, "Write .csv.gz files, Parquet files are always compressed")
+	fg.StringVar(&cmd.Character, "character", "", "Only export runs for this character, ex. IRONCLAD")
+	fg.IntVar(&cmd.MinAscension, "min-ascension", -1, "Only export runs at or above this ascension level")
+	fg.IntVar(&cmd.MaxAscension, "max-ascension", -1, "Only export runs at or below this ascension level")
+	fg.StringVar(&cmd.Since, "since", "", "Only export runs which ended on or after this date (YYYY-MM-DD)")
+	fg.StringVar(&cmd.Until, "until", "", "Only export runs which ended before this date (YYYY-MM-DD)")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *ExportDatasetCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *ExportDatasetCmd) Description() string {
+	return `export parsed runs as Parquet or CSV files for offline analysis`
+}
+
+func (cmd *ExportDatasetCmd) Run() error {
+	if err := cmd.checkFormat(); err != nil {
+		return err
+	}
+	queries, err := cmd.queries()
+	if err != nil {
+		return err
+	}
+	filters, err := cmd.filters()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cmd.OutDir, 0755); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Every file is read from the same snapshot, so they agree with each other
+	return pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead}, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, datasetSelectRuns, filters...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("exporting %d runs\n", tag.RowsAffected())
+		if _, err := tx.Exec(ctx, "ANALYZE dataset_runs"); err != nil {
+			return err
+		}
+		for _, q := range queries {
+			start := time.Now()
+			rows, err := cmd.writeFile(ctx, tx, q.Name, q.Query)
+			if err != nil {
+				return fmt.Errorf("%s: %w", q.Name, err)
+			}
+			fmt.Printf("%s: %d rows in %s\n", q.Name, rows, time.Since(start).Round(time.Millisecond))
+		}
+		return nil
+	})
+}
+
+// A file to write, named without the extension
+type datasetFile struct {
+	Name  string
+	Query string
+}
+
+// Returns the files to write for the layout and tables
+func (cmd *ExportDatasetCmd) queries() ([]datasetFile, error) {
+	switch cmd.Layout {
+	case DatasetLayoutRuns:
+		if cmd.Tables != "" {
+			return nil, fmt.Errorf("-tables can only be used with -layout %s", DatasetLayoutTables)
+		}
+		return []datasetFile{{"runs", datasetRunsQuery(true)}}, nil
+	case DatasetLayoutTables:
+		all := []datasetFile{{"runs", datasetRunsQuery(false)}}
+		for _, t := range datasetTables {
+			all = append(all, datasetFile{t.Name, t.query()})
+		}
+		if cmd.Tables == "" {
+			return all, nil
+		}
+		names := lo.Map(all, func(f datasetFile, _ int) string { return f.Name })
+		var out []datasetFile
+		for _, name := range strings.Split(cmd.Tables, ",") {
+			name = strings.TrimSpace(name)
+			f, ok := lo.Find(all, func(f datasetFile) bool { return f.Name == name })
+			if !ok {
+				return nil, fmt.Errorf("unknown table %q, expected one of %s", name, strings.Join(names, ", "))
+			}
+			out = append(out, f)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown layout %q, expected %s or %s", cmd.Layout, DatasetLayoutTables, DatasetLayoutRuns)
+	}
+}
+
+func (cmd *ExportDatasetCmd) checkFormat() error {
+	switch cmd.Format {
+	case DatasetFormatParquet:
+		if cmd.Gzip {
+			return fmt.Errorf("-gzip can only be used with -format %s", DatasetFormatCsv)
+		}
+		return nil
+	case DatasetFormatCsv:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, expected %s or %s", cmd.Format, DatasetFormatParquet, DatasetFormatCsv)
+	}
+}
+
+// Returns the parameters of datasetSelectRuns
+func (cmd *ExportDatasetCmd) filters() ([]any, error) {
+	var dates [2]sql.NullTime
+	for i, f := range []struct{ flag, val string }{{"since", cmd.Since}, {"until", cmd.Until}} {
+		if f.val == "" {
+			continue
+		}
+		t, err := time.Parse(exportDateFormat, f.val)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %w", f.flag, err)
+		}
+		dates[i] = sql.NullTime{Time: t, Valid: true}
+	}
+	return []any{
+		sql.NullString{String: cmd.Character, Valid: cmd.Character != ""},
+		sql.NullInt32{Int32: int32(cmd.MinAscension), Valid: cmd.MinAscension >= 0},
+		sql.NullInt32{Int32: int32(cmd.MaxAscension), Valid: cmd.MaxAscension >= 0},
+		dates[0],
+		dates[1],
+	}, nil
+}
+
+// Stream the result of query into <name>.parquet or <name>.csv, returning the number of
+// rows written. The file is written under a temporary name and renamed once complete.
+func (cmd *ExportDatasetCmd) writeFile(ctx context.Context, tx pgx.Tx, name string, query string) (int64, error) {
+	fpath := filepath.Join(cmd.OutDir, name+"."+cmd.Format)
+	if cmd.Gzip {
+		fpath += ".gz"
+	}
+	fd, err := os.Create(fpath + partTmpExt)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fpath + partTmpExt)
+	defer fd.Close()
+	var wr io.Writer = fd
+	var gz *gzip.Writer
+	if cmd.Gzip {
+		gz = gzip.NewWriter(fd)
+		wr = gz
+	}
+	var n int64
+	if cmd.Format == DatasetFormatParquet {
+		n, err = writeParquet(ctx, tx, wr, name, query)
+	} else {
+		n, err = writeCsv(ctx, tx, wr, query)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(fpath+partTmpExt, fpath)
+}
+
+// Copy the result of query to wr as CSV with a header
+func writeCsv(ctx context.Context, tx pgx.Tx, wr io.Writer, query string) (int64, error) {
+	tag, err := tx.Conn().PgConn().CopyTo(ctx, wr, "COPY ("+query+") TO STDOUT WITH (FORMAT csv, HEADER)")
+	return tag.RowsAffected(), err
+}
+
+// Write the result of query to wr as a Parquet file
+func writeParquet(ctx context.Context, tx pgx.Tx, wr io.Writer, name string, query string) (int64, error) {
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	pw := newDatasetParquetWriter(wr, name, rows.FieldDescriptions())
+	var n int64
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return n, err
+		}
+		if err := pw.Write(values, rows.RawValues()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, pw.Close()
+}
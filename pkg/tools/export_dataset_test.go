@@ -0,0 +1,129 @@
+package tools
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/parquet-go/parquet-go"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func datasetFileNames(files []datasetFile) []string {
+	return lo.Map(files, func(f datasetFile, _ int) string { return f.Name })
+}
+
+func TestDatasetQueries(t *testing.T) {
+	cmd := ExportDatasetCmd{Layout: DatasetLayoutTables}
+	files, err := cmd.queries()
+	require.NoError(t, err)
+	require.Len(t, files, len(datasetTables)+1)
+	assert.Equal(t, "runs", files[0].Name)
+	assert.NotContains(t, files[0].Query, "json_agg")
+	for i, table := range datasetTables {
+		assert.Equal(t, table.Name, files[i+1].Name)
+		assert.Contains(t, files[i+1].Query, "FROM "+table.From+" JOIN dataset_runs d ON d.id = x.run_id")
+	}
+
+	// Tables are written in the order given
+	cmd.Tables = "per_floor, runs"
+	files, err = cmd.queries()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"per_floor", "runs"}, datasetFileNames(files))
+
+	cmd.Tables = "per_floor,nope"
+	_, err = cmd.queries()
+	assert.ErrorContains(t, err, `unknown table "nope"`)
+
+	// Every table is nested into the runs file
+	cmd = ExportDatasetCmd{Layout: DatasetLayoutRuns}
+	files, err = cmd.queries()
+	require.NoError(t, err)
+	require.Equal(t, []string{"runs"}, datasetFileNames(files))
+	for _, table := range datasetTables {
+		assert.Contains(t, files[0].Query, ") t) AS "+table.Name)
+	}
+	assert.Contains(t, files[0].Query, "row_to_json(t)")
+	assert.NotContains(t, files[0].Query, "uploader")
+
+	cmd.Tables = "runs"
+	_, err = cmd.queries()
+	assert.Error(t, err)
+	cmd = ExportDatasetCmd{Layout: "nope"}
+	_, err = cmd.queries()
+	assert.Error(t, err)
+}
+
+func TestDatasetFilters(t *testing.T) {
+	cmd := ExportDatasetCmd{MinAscension: -1, MaxAscension: -1}
+	params, err := cmd.filters()
+	require.NoError(t, err)
+	assert.Equal(t, []any{sql.NullString{}, sql.NullInt32{Int32: -1}, sql.NullInt32{Int32: -1}, sql.NullTime{}, sql.NullTime{}}, params)
+
+	cmd = ExportDatasetCmd{Character: "IRONCLAD", MinAscension: 0, MaxAscension: 20, Since: "2023-01-02", Until: "2023-02-01"}
+	params, err = cmd.filters()
+	require.NoError(t, err)
+	assert.Equal(t, []any{
+		sql.NullString{String: "IRONCLAD", Valid: true},
+		sql.NullInt32{Int32: 0, Valid: true},
+		sql.NullInt32{Int32: 20, Valid: true},
+		sql.NullTime{Time: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), Valid: true},
+		sql.NullTime{Time: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), Valid: true},
+	}, params)
+
+	cmd.Until = "02/01/2023"
+	_, err = cmd.filters()
+	assert.ErrorContains(t, err, "-until")
+}
+
+func TestDatasetFormat(t *testing.T) {
+	assert.NoError(t, (&ExportDatasetCmd{Format: DatasetFormatParquet}).checkFormat())
+	assert.NoError(t, (&ExportDatasetCmd{Format: DatasetFormatCsv, Gzip: true}).checkFormat())
+	assert.Error(t, (&ExportDatasetCmd{Format: DatasetFormatParquet, Gzip: true}).checkFormat())
+	assert.Error(t, (&ExportDatasetCmd{Format: "xlsx"}).checkFormat())
+}
+
+func TestDatasetParquetWriter(t *testing.T) {
+	fields := []pgproto3.FieldDescription{
+		{Name: []byte("run_id"), DataTypeOID: pgtype.Int4OID},
+		{Name: []byte("character"), DataTypeOID: pgtype.TextOID},
+		{Name: []byte("victory"), DataTypeOID: pgtype.BoolOID},
+		{Name: []byte("added"), DataTypeOID: pgtype.TimestampOID},
+		{Name: []byte("relics"), DataTypeOID: pgtype.JSONOID},
+	}
+	added := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	var buf bytes.Buffer
+	pw := newDatasetParquetWriter(&buf, "runs", fields)
+	require.NoError(t, pw.Write(
+		[]any{int32(1), "IRONCLAD", true, added, []any{"Anchor"}},
+		[][]byte{nil, nil, nil, nil, []byte(`["Anchor"]`)},
+	))
+	require.NoError(t, pw.Write([]any{int32(2), nil, false, added, nil}, make([][]byte, 5)))
+	assert.ErrorContains(t, pw.Write([]any{"3", nil, nil, nil, nil}, make([][]byte, 5)), "run_id")
+	require.NoError(t, pw.Close())
+
+	rd := parquet.NewReader(bytes.NewReader(buf.Bytes()))
+	defer rd.Close()
+	assert.Equal(t, int64(2), rd.NumRows())
+	schema := rd.Schema()
+	col := func(row parquet.Row, name string) parquet.Value {
+		leaf, ok := schema.Lookup(name)
+		require.True(t, ok, name)
+		return row[leaf.ColumnIndex]
+	}
+	rows := make([]parquet.Row, 2)
+	n, _ := rd.ReadRows(rows)
+	require.Equal(t, 2, n)
+	assert.Equal(t, int32(1), col(rows[0], "run_id").Int32())
+	assert.Equal(t, "IRONCLAD", col(rows[0], "character").String())
+	assert.True(t, col(rows[0], "victory").Boolean())
+	assert.Equal(t, added.UnixMicro(), col(rows[0], "added").Int64())
+	assert.Equal(t, `["Anchor"]`, col(rows[0], "relics").String())
+	assert.True(t, col(rows[1], "character").IsNull())
+	assert.True(t, col(rows[1], "relics").IsNull())
+}
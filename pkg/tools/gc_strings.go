@@ -0,0 +1,91 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+type GcStringsCmd struct {
+	flags *flag.FlagSet
+	// Only consider entries added in the last Age
+	Age time.Duration
+	// Flag entries used by this many runs or fewer
+	OutlierRuns int64
+	// Print every entry, not just outliers
+	All bool
+	// Delete unreferenced entries
+	Delete bool
+	// Prune *New rows older than this
+	PruneAge time.Duration
+}
+
+func NewGcStringsCmd() *GcStringsCmd {
+	cmd := new(GcStringsCmd)
+	fg := flag.NewFlagSet("gc-strings", flag.ExitOnError)
+	fg.DurationVar(&cmd.Age, "age", 30*24*time.Hour, "Only consider strings and cards added within this duration")
+	fg.Int64Var(&cmd.OutlierRuns, "outlier-runs", 1, "Flag entries used by this many runs or fewer")
+	fg.BoolVar(&cmd.All, "all", false, "Print every entry, not just outliers")
+	fg.BoolVar(&cmd.Delete, "delete", false, "Delete entries that no run references")
+	fg.DurationVar(&cmd.PruneAge, "prune-age", 0, "Remove entries from StrCacheNew and CardSpecsNew older than this, 0 to skip")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *GcStringsCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *GcStringsCmd) Description() string {
+	return `list and clean up rarely used strings and card specs`
+}
+
+func (cmd *GcStringsCmd) Run() error {
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	now := time.Now().UTC()
+	since := now.Add(-cmd.Age)
+	entries, err := web.ListNewEntries(ctx, orm.New(pool), since, cmd.OutlierRuns)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tID\tRUNS\tADDED\tVALUE")
+	outliers := 0
+	for _, e := range entries {
+		if e.Outlier {
+			outliers++
+		}
+		if e.Outlier || cmd.All {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%q\n", e.Kind, e.ID, e.Runs, e.Added.Format("2006-01-02 15:04:05"), e.Value)
+		}
+	}
+	tw.Flush()
+	fmt.Printf("%d entries, %d outliers\n", len(entries), outliers)
+
+	if !cmd.Delete && cmd.PruneAge == 0 {
+		return nil
+	}
+	opts := web.GcStringsOptions{DeleteUnused: cmd.Delete, Since: since}
+	if cmd.PruneAge != 0 {
+		opts.PruneBefore = now.Add(-cmd.PruneAge)
+	}
+	res, err := web.GcStrings(ctx, pool, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted strings=%d cards=%d, pruned strings=%d cards=%d\n",
+		res.Strings, res.Cards, res.PrunedStrings, res.PrunedCards)
+	return nil
+}
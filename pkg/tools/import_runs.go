@@ -0,0 +1,86 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type ImportRunsCmd struct {
+	flags *flag.FlagSet
+	// Path to either .run file or .tar.gz or .tar.zst file with runs in it, or directory to search for .run files
+	Source string
+	// Number of workers, each with its own database connection
+	Workers int
+	// Print progress every N runs
+	Progress int
+	// Server config file, used to find the blob store
+	Config string
+	// Import every run in the blob store instead of Source
+	FromBlobs bool
+}
+
+func NewImportRunsCmd() *ImportRunsCmd {
+	cmd := new(ImportRunsCmd)
+	fg := flag.NewFlagSet("import-runs", flag.ExitOnError)
+	fg.StringVar(&cmd.Source, "src", "", "Either a .run file, a .tar.gz or .tar.zst file containing runs, or a directory to recursively search")
+	fg.IntVar(&cmd.Workers, "workers", 4, "Number of workers (and database connections)")
+	fg.IntVar(&cmd.Progress, "progress", 1000, "Print progress every N runs, 0 to disable")
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file, used with -from-blobs")
+	fg.BoolVar(&cmd.FromBlobs, "from-blobs", false, "Import every run in the server's blob store instead of -src")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *ImportRunsCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *ImportRunsCmd) Description() string {
+	return `import runs from a file, directory, or archive directly into the database`
+}
+
+func (cmd *ImportRunsCmd) Run() error {
+	if cmd.Source == "" && !cmd.FromBlobs {
+		return fmt.Errorf("must provide -src or -from-blobs")
+	}
+	if cmd.Workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn), func(c *pgxpool.Config) {
+		c.MaxConns = int32(cmd.Workers)
+	})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	ri := newRunIngester(pool, false, false, cmd.Progress)
+	wp := NewWorkerPool(cmd.Workers, func(item rawRun) {
+		ri.Ingest(ctx, item)
+	})
+	if cmd.FromBlobs {
+		var blobs blob.BlobStore
+		if blobs, err = requireServerBlobs(cmd.Config); err == nil {
+			err = submitBlobStore(ctx, blobs, wp)
+			blobs.Close()
+		}
+	} else {
+		err = submitRunSource(cmd.Source, wp)
+	}
+	wp.Close()
+	fmt.Println(ri.Summary())
+	if err != nil {
+		return err
+	}
+	if n := ri.Count(ingestFailed); n > 0 {
+		return fmt.Errorf("%d runs failed", n)
+	}
+	return nil
+}
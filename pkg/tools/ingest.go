@@ -0,0 +1,172 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Outcome of ingesting a single run
+type ingestResult string
+
+const (
+	ingestStored    ingestResult = "stored"
+	ingestReplaced  ingestResult = "replaced"
+	ingestDuplicate ingestResult = "duplicate"
+	ingestInvalid   ingestResult = "invalid"
+	ingestFailed    ingestResult = "failed"
+)
+
+// Order the results are printed in
+var ingestResultOrder = []ingestResult{
+	ingestStored, ingestReplaced, ingestDuplicate, ingestInvalid, ingestFailed,
+}
+
+// A run body and where it came from
+type rawRun struct {
+	Name string
+	Data []byte
+}
+
+// Parses runs and writes them directly into the database, keeping a tally
+// of the results. Safe to use from multiple goroutines.
+type runIngester struct {
+	pool *pgxpool.Pool
+	oc   *web.OrmContext
+	// If true, existing parsed data for a run is deleted before the run is added
+	replace bool
+	// If true, runs are parsed but nothing is written to the database
+	dryRun bool
+	// Print progress every N runs, 0 to disable
+	progress int
+	lock     sync.Mutex
+	counts   map[ingestResult]int
+	total    int
+}
+
+func newRunIngester(pool *pgxpool.Pool, replace bool, dryRun bool, progress int) *runIngester {
+	return &runIngester{
+		pool:     pool,
+		oc:       web.NewOrmContext(orm.New(pool)),
+		replace:  replace,
+		dryRun:   dryRun,
+		progress: progress,
+		counts:   make(map[ingestResult]int),
+	}
+}
+
+// Ingest a single run, printing any errors
+func (ri *runIngester) Ingest(ctx context.Context, item rawRun) {
+	res, err := ri.ingestOne(ctx, item.Data)
+	if err != nil {
+		fmt.Printf("%s %s %s\n", item.Name, res, err.Error())
+	}
+	ri.record(res)
+}
+
+func (ri *runIngester) ingestOne(ctx context.Context, raw []byte) (ingestResult, error) {
+	body, err := web.DecompressRaw(raw)
+	if err != nil {
+		return ingestInvalid, err
+	}
+	var run web.RunSchemaJson
+	if err := web.ParseRun(body, &run); err != nil {
+		return ingestInvalid, err
+	}
+	if err := web.ValidateRun(body, &run); err != nil {
+		return ingestInvalid, err
+	}
+	playId := run.PlayId.String()
+
+	if ri.dryRun {
+		exists, err := orm.New(ri.pool).DoesRunExist(ctx, playId)
+		if err != nil {
+			return ingestFailed, err
+		}
+		if !exists {
+			return ingestStored, nil
+		} else if ri.replace {
+			return ingestReplaced, nil
+		} else {
+			return ingestDuplicate, nil
+		}
+	}
+
+	replaced := false
+	err = ri.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if ri.replace {
+			n, err := db.DeleteRunsParsed(ctx, []string{playId})
+			if err != nil {
+				return err
+			}
+			replaced = n > 0
+		}
+		_, err := run.AddToDb(ctx, ri.oc.Copy(), db)
+		return err
+	})
+	if web.IsDuplicateRunErr(err) {
+		return ingestDuplicate, nil
+	} else if err != nil {
+		return ingestFailed, err
+	} else if replaced {
+		return ingestReplaced, nil
+	} else {
+		return ingestStored, nil
+	}
+}
+
+func (ri *runIngester) record(res ingestResult) {
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	ri.counts[res]++
+	ri.total++
+	if ri.progress > 0 && ri.total%ri.progress == 0 {
+		fmt.Println(ri.summaryLocked())
+	}
+}
+
+// Returns the number of runs with the given result
+func (ri *runIngester) Count(res ingestResult) int {
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	return ri.counts[res]
+}
+
+// Returns a one-line summary of the results so far
+func (ri *runIngester) Summary() string {
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	return ri.summaryLocked()
+}
+
+func (ri *runIngester) summaryLocked() string {
+	parts := []string{fmt.Sprintf("%d runs", ri.total)}
+	for _, res := range ingestResultOrder {
+		parts = append(parts, fmt.Sprintf("%s=%d", res, ri.counts[res]))
+	}
+	if ri.dryRun {
+		parts = append(parts, "(dry run)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reads all runs from src (see WalkRunSource) and submits them to the worker pool
+func submitRunSource(src string, wp *WorkerPool[rawRun]) error {
+	return WalkRunSource(src, func(name string, data io.ReadCloser) error {
+		defer data.Close()
+		body, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		wp.Submit(rawRun{Name: name, Data: body})
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+type ReconcileCmd struct {
+	flags *flag.FlagSet
+	// Server config file, used to find where runs are stored
+	Config string
+	// Also compare files in runs_dir against the database
+	CheckFiles bool
+}
+
+func NewReconcileCmd() *ReconcileCmd {
+	cmd := new(ReconcileCmd)
+	fg := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file")
+	fg.BoolVar(&cmd.CheckFiles, "check-files", false, "Also check every file in runs_dir, this is slow")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *ReconcileCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *ReconcileCmd) Description() string {
+	return `repair runs which are only partially stored`
+}
+
+func (cmd *ReconcileCmd) Run() error {
+	cfg, blobs, err := openServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	if blobs != nil {
+		defer blobs.Close()
+	}
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	res, err := web.Reconcile(ctx, pool, web.NewOrmContext(orm.New(pool)), web.ReconcileOptions{
+		PersistOptions: web.PersistOptionsFromConfig(cfg.Upload, blobs),
+		CheckFiles:     cmd.CheckFiles,
+	})
+	fmt.Println(res)
+	return err
+}
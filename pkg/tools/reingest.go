@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type ReingestCmd struct {
+	flags *flag.FlagSet
+	// Either a .run file, .tar.gz or .tar.zst file, or directory. If empty, runs are read from RawJsonArchive.
+	Source string
+	// If true, only parse the runs and report what would happen
+	DryRun bool
+	// Print progress every N runs
+	Progress int
+	// Number of workers
+	Workers int
+	// Number of rows to read from RawJsonArchive at a time
+	PageSize int
+	// Server config file, used to find the blob store
+	Config string
+	// Read runs from the blob store instead of RawJsonArchive
+	FromBlobs bool
+}
+
+func NewReingestCmd() *ReingestCmd {
+	cmd := new(ReingestCmd)
+	fg := flag.NewFlagSet("reingest", flag.ExitOnError)
+	fg.StringVar(&cmd.Source, "src", "", "Either a .run file, a .tar.gz or .tar.zst file containing runs, or a directory to recursively search. Defaults to the raw archive table.")
+	fg.BoolVar(&cmd.DryRun, "dry-run", false, "Parse runs and report what would change, without writing anything")
+	fg.IntVar(&cmd.Progress, "progress", 1000, "Print progress every N runs, 0 to disable")
+	fg.IntVar(&cmd.Workers, "workers", 4, "Number of runs to process in parallel")
+	fg.IntVar(&cmd.PageSize, "page-size", 500, "Number of archived runs to read from the database at a time")
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file, used with -from-blobs")
+	fg.BoolVar(&cmd.FromBlobs, "from-blobs", false, "Read runs from the server's blob store instead of the raw archive table")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *ReingestCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *ReingestCmd) Description() string {
+	return `re-parse archived runs, replacing their parsed data`
+}
+
+func (cmd *ReingestCmd) Run() error {
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	ri := newRunIngester(pool, true, cmd.DryRun, cmd.Progress)
+	wp := NewWorkerPool(cmd.Workers, func(item rawRun) {
+		ri.Ingest(ctx, item)
+	})
+	if cmd.FromBlobs {
+		err = cmd.submitBlobs(ctx, wp)
+	} else if cmd.Source == "" {
+		err = cmd.submitArchive(ctx, pool, wp)
+	} else {
+		err = submitRunSource(cmd.Source, wp)
+	}
+	wp.Close()
+	fmt.Println(ri.Summary())
+	if err != nil {
+		return err
+	}
+	if n := ri.Count(ingestFailed); n > 0 {
+		return fmt.Errorf("%d runs failed", n)
+	}
+	return nil
+}
+
+// Submit every run in the RawJsonArchive table, one page at a time
+func (cmd *ReingestCmd) submitArchive(ctx context.Context, pool *pgxpool.Pool, wp *WorkerPool[rawRun]) error {
+	db := orm.New(pool)
+	params := orm.ArchiveListParams{ID: 0, Limit: int32(cmd.PageSize)}
+	for {
+		rows, err := db.ArchiveList(ctx, params)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			wp.Submit(rawRun{Name: row.PlayID, Data: row.Bdata})
+		}
+		if len(rows) < int(params.Limit) {
+			return nil
+		}
+		params.ID = rows[len(rows)-1].ID
+	}
+}
+
+// Submit every run in the server's blob store
+func (cmd *ReingestCmd) submitBlobs(ctx context.Context, wp *WorkerPool[rawRun]) error {
+	blobs, err := requireServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	defer blobs.Close()
+	return submitBlobStore(ctx, blobs, wp)
+}
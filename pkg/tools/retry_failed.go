@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+type RetryFailedCmd struct {
+	flags *flag.FlagSet
+	// Comma-separated list of failed upload ids to retry
+	Ids string
+	// Only list failed uploads
+	List bool
+	// Maximum number of failed uploads to list
+	Limit int
+	// Server config file, used to find where runs are stored
+	Config string
+}
+
+func NewRetryFailedCmd() *RetryFailedCmd {
+	cmd := new(RetryFailedCmd)
+	fg := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	fg.StringVar(&cmd.Ids, "id", "", "Comma-separated list of failed upload ids to retry, empty for all")
+	fg.BoolVar(&cmd.List, "list", false, "List failed uploads instead of retrying them")
+	fg.IntVar(&cmd.Limit, "limit", 1000, "Maximum number of failed uploads to list")
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *RetryFailedCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *RetryFailedCmd) Description() string {
+	return `list or retry uploads which failed to be added to the database`
+}
+
+func (cmd *RetryFailedCmd) Run() error {
+	var ids []int64
+	if cmd.Ids != "" {
+		for _, s := range strings.Split(cmd.Ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if cmd.List {
+		uploads, err := web.ListFailedUploads(ctx, orm.New(pool), int32(cmd.Limit))
+		if err != nil {
+			return err
+		}
+		for _, u := range uploads {
+			fmt.Printf("%-6d %s stage=%s attempts=%d updated=%s error=%s\n",
+				u.ID, u.PlayId, u.Stage, u.Attempts, u.Updated.Format("2006-01-02 15:04:05"), u.Error)
+		}
+		return nil
+	}
+
+	cfg, blobs, err := openServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	if blobs != nil {
+		defer blobs.Close()
+	}
+	opts := web.PersistOptionsFromConfig(cfg.Upload, blobs)
+	res, err := web.RetryFailedUploads(ctx, pool, web.NewOrmContext(orm.New(pool)), opts, ids)
+	fmt.Printf("stored=%d duplicates=%d failed=%d\n", res.Stored, res.Duplicates, res.Failed)
+	return err
+}
@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Function called for each run found by WalkRunSource, with the run's JSON.
+// The function is responsible for closing data.
+type RunSourceFn func(name string, data io.ReadCloser) error
+
+// Calls fn for each run in src, which may be either a .run file, a .tar.gz or .tar.zst
+// file containing runs, or a directory to recursively search for .run files.
+// Compressed runs are decompressed. Stops at the first error returned by fn.
+func WalkRunSource(src string, fn RunSourceFn) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return walkRunDir(src, fn)
+	} else if strings.HasSuffix(src, ".tar.gz") || strings.HasSuffix(src, ".tar.zst") {
+		return walkRunTar(src, fn)
+	} else {
+		fd, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		return callWithRun(fn, src, fd)
+	}
+}
+
+func walkRunTar(tarPath string, fn RunSourceFn) error {
+	return walkTar(tarPath, func(hdr *tar.Header, rd io.Reader) error {
+		if hdr.Name == ArchiveManifestName {
+			return nil
+		}
+		return callWithRun(fn, hdr.Name, rd)
+	})
+}
+
+// Calls fn for each regular file in a .tar.gz or .tar.zst file
+func walkTar(tarPath string, fn func(hdr *tar.Header, rd io.Reader) error) error {
+	srcFd, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer srcFd.Close()
+	var srcRd io.Reader
+	if strings.HasSuffix(tarPath, ".tar.zst") {
+		srcZst, err := zstd.NewReader(srcFd)
+		if err != nil {
+			return err
+		}
+		defer srcZst.Close()
+		srcRd = srcZst
+	} else {
+		srcGz, err := gzip.NewReader(srcFd)
+		if err != nil {
+			return err
+		}
+		defer srcGz.Close()
+		srcRd = srcGz
+	}
+	tarRd := tar.NewReader(srcRd)
+	for {
+		hdr, err := tarRd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr, tarRd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkRunDir(dirPath string, fn RunSourceFn) error {
+	rootFs := os.DirFS(dirPath)
+	return fs.WalkDir(rootFs, ".", func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && path.Ext(fpath) == ".run" {
+			fd, err := rootFs.Open(fpath)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			return callWithRun(fn, fpath, fd)
+		}
+		return nil
+	})
+}
+
+// Reads a run from rd and calls fn with its decompressed contents
+func callWithRun(fn RunSourceFn, name string, rd io.Reader) error {
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	if data, err = web.DecompressRaw(data); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return fn(name, io.NopCloser(bytes.NewReader(data)))
+}
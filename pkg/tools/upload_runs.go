@@ -1,32 +1,38 @@
 package tools
 
 import (
-	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/klauspost/compress/zstd"
 )
 
 type UploadRunsCmd struct {
 	flags *flag.FlagSet
 	// URL to upload to
 	Url string
-	// Path to either .run file or .tar.gz file with runs in it, or directory to search for .run files
+	// Path to either .run file or .tar.gz or .tar.zst file with runs in it, or directory to search for .run files
 	Source string
 	// Number of workers
 	Workers int
+	// If greater than 1, runs are sent in batches of this size to the batch upload route
+	Batch int
+	// Content-Encoding used to compress requests, empty to send them uncompressed
+	Encoding string
 	// Destination URL
 	destUrl *url.URL
 	// Work pool
-	wp *WorkerPool[uploadItem]
+	wp *WorkerPool[[]uploadItem]
+	// Runs waiting to be sent as a batch
+	pending []uploadItem
 }
 
 type uploadItem struct {
@@ -38,7 +44,9 @@ func NewUploadRunsCmd() *UploadRunsCmd {
 	cmd := new(UploadRunsCmd)
 	fg := flag.NewFlagSet("upload-runs", flag.ExitOnError)
 	fg.StringVar(&cmd.Url, "url", "", "URL to upload to")
-	fg.StringVar(&cmd.Source, "src", "", "Either a .run file, a .tar.gz file containing runs, or a directory to recursively search")
+	fg.StringVar(&cmd.Source, "src", "", "Either a .run file, a .tar.gz or .tar.zst file containing runs, or a directory to recursively search")
+	fg.IntVar(&cmd.Batch, "batch", 0, "Send runs in batches of this size, -url must point to the batch upload route")
+	fg.StringVar(&cmd.Encoding, "encoding", "", "Compress requests with either gzip or zstd")
 	cmd.Workers = 4
 	cmd.flags = fg
 	return cmd
@@ -60,6 +68,9 @@ func (cmd *UploadRunsCmd) Run() error {
 	if cmd.Source == "" {
 		return fmt.Errorf("must provide either -src")
 	}
+	if cmd.Encoding != "" && cmd.Encoding != web.EncodingGzip && cmd.Encoding != web.EncodingZstd {
+		return fmt.Errorf("%w: %s", web.ErrUnsupportedEncoding, cmd.Encoding)
+	}
 
 	dstUrl, err := url.Parse(cmd.Url)
 	if err != nil {
@@ -69,85 +80,131 @@ func (cmd *UploadRunsCmd) Run() error {
 
 	cmd.wp = NewWorkerPool(cmd.Workers, cmd.postWorker)
 	defer cmd.wp.Close()
+	defer cmd.flush()
 
-	fi, err := os.Stat(cmd.Source)
-	if err != nil {
-		return err
+	return WalkRunSource(cmd.Source, func(name string, data io.ReadCloser) error {
+		cmd.putFile(name, data)
+		return nil
+	})
+}
+
+func (cmd *UploadRunsCmd) postWorker(items []uploadItem) {
+	if cmd.Batch > 1 {
+		cmd.postBatch(items)
+		return
 	}
-	if fi.IsDir() {
-		return cmd.uploadDir(cmd.Source)
-	} else if strings.HasSuffix(cmd.Source, ".tar.gz") {
-		return cmd.UploadTar(cmd.Source)
-	} else {
-		fd, err := os.Open(cmd.Source)
+	const LOG_FMT = "%s %s\n"
+	for _, item := range items {
+		resBody, err := cmd.post(item.Data)
 		if err != nil {
-			return err
+			fmt.Printf(LOG_FMT, item.Name, err.Error())
+		} else {
+			fmt.Printf(LOG_FMT, item.Name, string(resBody))
 		}
-		cmd.putFile(cmd.Source, fd)
 	}
-	return nil
 }
 
-func (cmd *UploadRunsCmd) UploadTar(tarPath string) error {
-	srcFd, err := os.Open(tarPath)
-	if err != nil {
-		return err
+// Posts all items as a single JSON array and prints the per-run results
+func (cmd *UploadRunsCmd) postBatch(items []uploadItem) {
+	const LOG_FMT = "%s %s %s\n"
+	readers := []io.Reader{strings.NewReader("[")}
+	for i, item := range items {
+		defer item.Data.Close()
+		if i > 0 {
+			readers = append(readers, strings.NewReader(","))
+		}
+		readers = append(readers, item.Data)
 	}
-	defer srcFd.Close()
-	srcGz, err := gzip.NewReader(srcFd)
-	if err != nil {
-		return err
+	readers = append(readers, strings.NewReader("]"))
+
+	resBody, err := cmd.post(io.NopCloser(io.MultiReader(readers...)))
+	var res struct {
+		Results []struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		} `json:"results"`
 	}
-	defer srcGz.Close()
-	tarRd := tar.NewReader(srcGz)
-	for {
-		hdr, err := tarRd.Next()
-		if err == io.EOF {
-			break
-		}
+	if err == nil {
+		err = json.Unmarshal(resBody, &res)
+	}
+	if err == nil && len(res.Results) != len(items) {
+		err = fmt.Errorf("%s", string(resBody))
+	}
+	for i, item := range items {
 		if err != nil {
-			return err
-		}
-		buf := new(bytes.Buffer)
-		if _, err := io.Copy(buf, tarRd); err != nil {
-			return err
+			fmt.Printf(LOG_FMT, item.Name, "error", err.Error())
+		} else {
+			fmt.Printf(LOG_FMT, item.Name, res.Results[i].Status, res.Results[i].Reason)
 		}
-		cmd.putFile(hdr.Name, io.NopCloser(buf))
 	}
-	return nil
 }
 
-func (cmd *UploadRunsCmd) uploadDir(dirPath string) error {
-	rootFs := os.DirFS(dirPath)
-	return fs.WalkDir(rootFs, ".", func(fpath string, d fs.DirEntry, err error) error {
-		if d.Type().IsRegular() && path.Ext(fpath) == ".run" {
-			fd, err := rootFs.Open(fpath)
-			if err != nil {
-				return err
-			}
-			cmd.putFile(fpath, fd)
+// POST the body to the destination URL, returning the response body
+func (cmd *UploadRunsCmd) post(body io.ReadCloser) ([]byte, error) {
+	defer body.Close()
+	var rd io.Reader = body
+	if cmd.Encoding != "" {
+		buf, err := compressBody(body, cmd.Encoding)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	})
-}
-
-func (cmd *UploadRunsCmd) postWorker(item uploadItem) {
-	const LOG_FMT = "%s %s\n"
-	defer item.Data.Close()
-	res, err := http.Post(cmd.destUrl.String(), "application/json", item.Data)
+		rd = buf
+	}
+	req, err := http.NewRequest("POST", cmd.destUrl.String(), rd)
 	if err != nil {
-		fmt.Printf(LOG_FMT, item.Name, err.Error())
-		return
+		return nil, err
 	}
-	defer res.Body.Close()
-	resBody, err := io.ReadAll(res.Body)
+	req.Header.Set("Content-Type", "application/json")
+	if cmd.Encoding != "" {
+		req.Header.Set("Content-Encoding", cmd.Encoding)
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Printf(LOG_FMT, item.Name, err.Error())
-		return
+		return nil, err
 	}
-	fmt.Printf(LOG_FMT, item.Name, string(resBody))
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
 }
 
 func (cmd *UploadRunsCmd) putFile(name string, src io.ReadCloser) {
-	cmd.wp.Submit(uploadItem{Name: name, Data: src})
+	item := uploadItem{Name: name, Data: src}
+	if cmd.Batch <= 1 {
+		cmd.wp.Submit([]uploadItem{item})
+		return
+	}
+	cmd.pending = append(cmd.pending, item)
+	if len(cmd.pending) >= cmd.Batch {
+		cmd.flush()
+	}
+}
+
+// Submit any pending batch items
+func (cmd *UploadRunsCmd) flush() {
+	if len(cmd.pending) > 0 {
+		cmd.wp.Submit(cmd.pending)
+		cmd.pending = nil
+	}
+}
+
+// Compress everything in src with encoding, which must be either gzip or zstd
+func compressBody(src io.Reader, encoding string) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	var wr io.WriteCloser
+	if encoding == web.EncodingZstd {
+		zw, err := zstd.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		wr = zw
+	} else {
+		wr = gzip.NewWriter(buf)
+	}
+	if _, err := io.Copy(wr, src); err != nil {
+		wr.Close()
+		return nil, err
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
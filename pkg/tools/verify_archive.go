@@ -0,0 +1,133 @@
+package tools
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+)
+
+// Number of play_ids looked up in the database at a time
+const verifyPageSize = 500
+
+type VerifyArchiveCmd struct {
+	flags *flag.FlagSet
+	// Also compare checksums with RawJsonArchive
+	CheckDb bool
+}
+
+func NewVerifyArchiveCmd() *VerifyArchiveCmd {
+	cmd := new(VerifyArchiveCmd)
+	fg := flag.NewFlagSet("verify-archive", flag.ExitOnError)
+	fg.BoolVar(&cmd.CheckDb, "db", false, "Also compare checksums with the raw archive table")
+	fg.Usage = func() {
+		fmt.Fprintf(fg.Output(), "usage: %s [flags] PART...\n", fg.Name())
+		fg.PrintDefaults()
+	}
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *VerifyArchiveCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *VerifyArchiveCmd) Description() string {
+	return `check exported archives against their manifest and the database`
+}
+
+func (cmd *VerifyArchiveCmd) Run() error {
+	paths := cmd.flags.Args()
+	if len(paths) == 0 {
+		return fmt.Errorf("must provide at least one archive to verify")
+	}
+	var db *orm.Queries
+	ctx := context.Background()
+	if cmd.CheckDb {
+		pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+		if err != nil {
+			return err
+		}
+		defer pool.Close()
+		db = orm.New(pool)
+	}
+
+	failed := 0
+	for _, tarPath := range paths {
+		manifest, found, err := readArchivePart(tarPath)
+		if err != nil {
+			return err
+		}
+		problems := checkArchiveManifest(manifest, found)
+		unchecked := 0
+		if db != nil {
+			var dbProblems []string
+			dbProblems, unchecked, err = checkArchiveDb(ctx, db.ArchiveSums, manifest)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, dbProblems...)
+		}
+		sort.Strings(problems)
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", tarPath, p)
+		}
+		fmt.Printf("%s: %d runs, %d bytes, %d problems", tarPath, manifest.Runs, manifest.Bytes, len(problems))
+		if unchecked > 0 {
+			fmt.Printf(", %d runs have no checksum in the database", unchecked)
+		}
+		fmt.Println()
+		if len(problems) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archives failed verification", failed, len(paths))
+	}
+	return nil
+}
+
+// Looks up the checksums of archived runs, ex. orm.Queries.ArchiveSums
+type archiveSumsFn func(ctx context.Context, playIds []string) ([]orm.ArchiveSumsRow, error)
+
+// Compares the manifest's checksums with RawJsonArchive, returning a description of each
+// problem and the number of runs archived before checksums were recorded
+func checkArchiveDb(ctx context.Context, archiveSums archiveSumsFn, manifest *ArchiveManifest) ([]string, int, error) {
+	var problems []string
+	unchecked := 0
+	for start := 0; start < len(manifest.Files); start += verifyPageSize {
+		page := manifest.Files[start:]
+		if len(page) > verifyPageSize {
+			page = page[:verifyPageSize]
+		}
+		playIds := make([]string, len(page))
+		for i, ent := range page {
+			playIds[i] = ent.PlayID
+		}
+		rows, err := archiveSums(ctx, playIds)
+		if err != nil {
+			return nil, 0, err
+		}
+		sums := make(map[string][]byte, len(rows))
+		for _, row := range rows {
+			sums[row.PlayID] = row.Sha256
+		}
+		for _, ent := range page {
+			sum, ok := sums[ent.PlayID]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: not in the database", ent.Name))
+			} else if sum == nil {
+				unchecked++
+			} else if hex.EncodeToString(sum) != ent.Sha256 {
+				problems = append(problems, fmt.Sprintf("%s: %v, database has %x, manifest has %s",
+					ent.Name, ErrChecksumMismatch, sum, ent.Sha256))
+			}
+		}
+	}
+	return problems, unchecked, nil
+}
@@ -0,0 +1,295 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/bindernews/sts-msr/pkg/web"
+	"github.com/jackc/pgx/v4"
+)
+
+type VerifyRoundTripCmd struct {
+	flags *flag.FlagSet
+	// Server config file, used to find the blob store
+	Config string
+	// Read raw runs from the blob store instead of RawJsonArchive
+	FromBlobs bool
+	// Only check this many random runs, 0 for all
+	Sample int
+	// Comma-separated fields to leave out of the comparison
+	Ignore string
+	// Differences printed per run
+	MaxDiffs int
+	// Print each drifted run as a line of JSON
+	Json bool
+	// Number of runs to check in parallel
+	Workers int
+	// Number of archived runs to read from the database at a time
+	PageSize int
+}
+
+func NewVerifyRoundTripCmd() *VerifyRoundTripCmd {
+	cmd := new(VerifyRoundTripCmd)
+	fg := flag.NewFlagSet("verify-roundtrip", flag.ExitOnError)
+	fg.StringVar(&cmd.Config, "config", "config.toml", "Server config file, used with -from-blobs")
+	fg.BoolVar(&cmd.FromBlobs, "from-blobs", false, "Read raw runs from the server's blob store instead of the raw archive table")
+	fg.IntVar(&cmd.Sample, "sample", 0, "Only check this many random runs, 0 to check every run")
+	fg.StringVar(&cmd.Ignore, "ignore", "", "Comma-separated fields to skip, using [] for array indexes, ex. timestamp,card_choices[].not_picked")
+	fg.IntVar(&cmd.MaxDiffs, "max-diffs", 10, "Differences to print for each run")
+	fg.BoolVar(&cmd.Json, "json", false, "Print each run with differences as a line of JSON")
+	fg.IntVar(&cmd.Workers, "workers", 4, "Number of runs to check in parallel")
+	fg.IntVar(&cmd.PageSize, "page-size", 500, "Number of archived runs to read from the database at a time")
+	cmd.flags = fg
+	return cmd
+}
+
+func (cmd *VerifyRoundTripCmd) Flags() *flag.FlagSet {
+	return cmd.flags
+}
+
+func (cmd *VerifyRoundTripCmd) Description() string {
+	return `check that stored runs rebuild into the JSON that was uploaded`
+}
+
+func (cmd *VerifyRoundTripCmd) Run() error {
+	if cmd.Workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	ctx := context.Background()
+	pool, err := web.ConnectPool(ctx, os.Getenv(EnvPostgresConn))
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	rc := &roundTripChecker{
+		db:       orm.New(pool),
+		maxDiffs: cmd.MaxDiffs,
+		json:     cmd.Json,
+		fields:   make(map[string]int),
+	}
+	for _, f := range strings.Split(cmd.Ignore, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			rc.ignore = append(rc.ignore, f)
+		}
+	}
+	wp := NewWorkerPool(cmd.Workers, func(item rawRun) {
+		rc.Check(ctx, item)
+	})
+	if cmd.FromBlobs {
+		err = cmd.submitBlobs(ctx, wp)
+	} else {
+		err = cmd.submitArchive(ctx, rc.db, wp)
+	}
+	wp.Close()
+	rc.PrintSummary()
+	if err != nil {
+		return err
+	}
+	if rc.drifted > 0 || rc.failed > 0 {
+		return fmt.Errorf("%d runs drifted, %d failed", rc.drifted, rc.failed)
+	}
+	return nil
+}
+
+// Submit archived runs, either a random sample or every run one page at a time
+func (cmd *VerifyRoundTripCmd) submitArchive(ctx context.Context, db *orm.Queries, wp *WorkerPool[rawRun]) error {
+	if cmd.Sample > 0 {
+		estimate, err := db.ArchiveEstimate(ctx)
+		if err != nil {
+			return err
+		}
+		rows, err := db.ArchiveSample(ctx, orm.ArchiveSampleParams{
+			Percent: samplePercent(cmd.Sample, estimate),
+			Limit:   int32(cmd.Sample),
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			wp.Submit(rawRun{Name: row.PlayID, Data: row.Bdata})
+		}
+		return nil
+	}
+	params := orm.ArchiveListParams{Limit: int32(cmd.PageSize)}
+	for {
+		rows, err := db.ArchiveList(ctx, params)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			wp.Submit(rawRun{Name: row.PlayID, Data: row.Bdata})
+		}
+		if len(rows) < int(params.Limit) {
+			return nil
+		}
+		params.ID = rows[len(rows)-1].ID
+	}
+}
+
+// Percent of the archive to sample so it has n runs. Twice as many rows are sampled, since
+// the estimate may be out of date, and everything is sampled if the table hasn't been analyzed.
+func samplePercent(n int, estimate int64) float32 {
+	if estimate <= 0 {
+		return 100
+	}
+	return float32(math.Min(100, 200*float64(n)/float64(estimate)))
+}
+
+// Submit runs from the blob store, either a random sample or every run
+func (cmd *VerifyRoundTripCmd) submitBlobs(ctx context.Context, wp *WorkerPool[rawRun]) error {
+	blobs, err := requireServerBlobs(cmd.Config)
+	if err != nil {
+		return err
+	}
+	defer blobs.Close()
+	if cmd.Sample <= 0 {
+		return submitBlobStore(ctx, blobs, wp)
+	}
+	// Reservoir sample, so the keys don't all need to be held in memory
+	keys := make([]string, 0, cmd.Sample)
+	seen := 0
+	err = blobs.List(ctx, func(key string) error {
+		seen++
+		if len(keys) < cmd.Sample {
+			keys = append(keys, key)
+		} else if i := rand.Intn(seen); i < cmd.Sample {
+			keys[i] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, _, err := blobs.Get(ctx, key)
+		if errors.Is(err, blob.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		wp.Submit(rawRun{Name: key, Data: data})
+	}
+	return nil
+}
+
+// Compares runs with their raw uploads and keeps a tally. Safe to use from multiple goroutines.
+type roundTripChecker struct {
+	db       *orm.Queries
+	ignore   []string
+	maxDiffs int
+	json     bool
+
+	lock      sync.Mutex
+	checked   int
+	matched   int
+	drifted   int
+	notStored int
+	failed    int
+	// Number of runs each field differs in, see web.DiffField
+	fields map[string]int
+}
+
+// Result printed for each run with differences when using -json
+type roundTripResult struct {
+	PlayID string         `json:"play_id"`
+	Diffs  []web.JsonDiff `json:"diffs"`
+}
+
+func (rc *roundTripChecker) Check(ctx context.Context, item rawRun) {
+	diffs, err := web.VerifyRoundTrip(ctx, rc.db, item.Name, item.Data)
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.checked++
+	if errors.Is(err, pgx.ErrNoRows) {
+		rc.notStored++
+		return
+	} else if err != nil {
+		rc.failed++
+		fmt.Fprintf(os.Stderr, "%s: %v\n", item.Name, err)
+		return
+	}
+	kept := diffs[:0]
+	for _, d := range diffs {
+		if !rc.ignored(d.Path) {
+			kept = append(kept, d)
+		}
+	}
+	if len(kept) == 0 {
+		rc.matched++
+		return
+	}
+	rc.drifted++
+	counted := make(map[string]bool)
+	for _, d := range kept {
+		if f := web.DiffField(d.Path); !counted[f] {
+			counted[f] = true
+			rc.fields[f]++
+		}
+	}
+	if rc.json {
+		line, _ := json.Marshal(roundTripResult{PlayID: item.Name, Diffs: kept})
+		fmt.Println(string(line))
+		return
+	}
+	fmt.Printf("%s: %d differences\n", item.Name, len(kept))
+	for i, d := range kept {
+		if i == rc.maxDiffs {
+			fmt.Printf("  ... %d more\n", len(kept)-i)
+			break
+		}
+		fmt.Printf("  %s\n", d)
+	}
+}
+
+func (rc *roundTripChecker) ignored(path string) bool {
+	for _, pattern := range rc.ignore {
+		if web.DiffFieldMatches(path, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the totals, and the fields which differ most often. Output goes to stderr with
+// -json, so stdout only has JSON lines.
+func (rc *roundTripChecker) PrintSummary() {
+	out := os.Stdout
+	if rc.json {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "checked=%d matched=%d drifted=%d not_stored=%d failed=%d\n",
+		rc.checked, rc.matched, rc.drifted, rc.notStored, rc.failed)
+	if len(rc.fields) == 0 {
+		return
+	}
+	fields := make([]string, 0, len(rc.fields))
+	for f := range rc.fields {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if rc.fields[a] != rc.fields[b] {
+			return rc.fields[a] > rc.fields[b]
+		}
+		return a < b
+	})
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tRUNS")
+	for _, f := range fields {
+		fmt.Fprintf(tw, "%s\t%d\n", f, rc.fields[f])
+	}
+	tw.Flush()
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+)
+
+// Error when a request doesn't say which runs to delete
+var ErrNoRunsSelected = errors.New("must provide play_ids or uploader")
+
+// Register admin routes on the group. The caller is responsible for authentication.
+// Used for both the admin group on the main server and the admin listener.
+func (s *MainController) initAdminRoutes(g *gin.RouterGroup) {
+	g.DELETE("/runs", s.deleteRuns)
+	g.GET("/strings", s.listNewStrings)
+	g.POST("/strings/gc", s.gcStrings)
+	s.initUserRoutes(g)
+	s.initTokenRoutes(g)
+	s.initFailedUploadRoutes(g)
+}
+
+// Returns middleware which rejects requests unless their bearer token is token
+func RequireAdminToken(token string) gin.HandlerFunc {
+	want := []byte(token)
+	return func(c *gin.Context) {
+		got := []byte(BearerToken(c.Request))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			AbortMsg(c, 401, ErrUnauthorized)
+		}
+	}
+}
+
+type DeleteRunsRequest struct {
+	// Runs to delete
+	PlayIds []string `json:"play_ids"`
+	// Delete all runs uploaded by this email
+	Uploader string `json:"uploader"`
+}
+
+// Delete runs by play_id and/or uploader, including parsed data, raw archives and raw files.
+func (s *MainController) deleteRuns(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req DeleteRunsRequest
+	if err := c.BindJSON(&req); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	if len(req.PlayIds) == 0 && req.Uploader == "" {
+		AbortMsg(c, 400, ErrNoRunsSelected)
+		return
+	}
+	playIds := req.PlayIds
+	if req.Uploader != "" {
+		ids, err := PlayIdsByUploader(ctx, orm.New(s.Srv.Pool), req.Uploader)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		playIds = append(playIds, ids...)
+	}
+	res, err := DeleteRuns(ctx, s.Srv.Pool, s.blobs, playIds)
+	if errors.Is(err, ErrInvalidPlayId) {
+		AbortMsg(c, 400, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, res)
+}
+
+// List recently added strings and card specs with their usage counts.
+// Query parameters are "since" (a date, defaults to all) and "outlier_runs" (default 1).
+func (s *MainController) listNewStrings(c *gin.Context) {
+	since, err := parseDateParam(c.Query("since"))
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	outlierRuns, err := strconv.ParseInt(c.DefaultQuery("outlier_runs", "1"), 10, 64)
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	entries, err := ListNewEntries(c.Request.Context(), orm.New(s.Srv.Pool), since.Time, outlierRuns)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+// Delete unused strings and card specs, see GcStrings
+func (s *MainController) gcStrings(c *gin.Context) {
+	var opts GcStringsOptions
+	if err := c.BindJSON(&opts); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	res, err := GcStrings(c.Request.Context(), s.Srv.Pool, opts)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	// Don't wait for the notification to come back around
+	s.ormCtx.Invalidate()
+	c.JSON(200, res)
+}
@@ -0,0 +1,182 @@
+package web
+
+import (
+	"errors"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// Error when the user doesn't exist
+var ErrUserNotFound = errors.New("user not found")
+
+// Error when adding a user that already exists
+var ErrUserExists = errors.New("user already exists")
+
+// Postgres error codes
+const (
+	pgUniqueViolation = "23505"
+	pgRaiseException  = "P0001"
+)
+
+type UserJson struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+type ScopeJson struct {
+	Key    string `json:"key"`
+	Desc   string `json:"desc"`
+	Parent string `json:"parent,omitempty"`
+}
+
+type setScopesRequest struct {
+	Scopes []string `json:"scopes"`
+}
+
+// Register user and scope management routes on the group
+func (s *MainController) initUserRoutes(g *gin.RouterGroup) {
+	g.GET("/users", s.listUsers)
+	g.POST("/users", s.addUser)
+	g.GET("/users/:email", s.getUser)
+	g.DELETE("/users/:email", s.deleteUser)
+	g.PUT("/users/:email/scopes", s.setUserScopes)
+	g.GET("/users/:email/effective-scopes", s.getEffectiveScopes)
+	g.GET("/scopes", s.listScopes)
+}
+
+func (s *MainController) listUsers(c *gin.Context) {
+	rows, err := orm.New(s.Srv.Pool).ListUsers(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	users := lo.Map(rows, func(r orm.ListUsersRow, _ int) UserJson {
+		return UserJson{Email: r.Email, Scopes: r.Scopes}
+	})
+	c.JSON(200, gin.H{"users": users})
+}
+
+func (s *MainController) getUser(c *gin.Context) {
+	row, err := orm.New(s.Srv.Pool).GetUser(c.Request.Context(), c.Param("email"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		AbortMsg(c, 404, ErrUserNotFound)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, UserJson{Email: row.Email, Scopes: row.Scopes})
+}
+
+// Add a user, and set their scopes if any are given
+func (s *MainController) addUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req UserJson
+	if err := c.BindJSON(&req); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	if req.Email == "" {
+		AbortMsg(c, 400, errors.New("email is required"))
+		return
+	}
+	err := s.Srv.Pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if _, err := db.UserAdd(ctx, req.Email); err != nil {
+			return err
+		}
+		if len(req.Scopes) == 0 {
+			return nil
+		}
+		return db.UserSetScopes(ctx, orm.UserSetScopesParams{Email: req.Email, Scopes: req.Scopes})
+	})
+	if err != nil {
+		abortPgError(c, err)
+		return
+	}
+	c.JSON(201, UserJson{Email: req.Email, Scopes: lo.Ternary(req.Scopes == nil, []string{}, req.Scopes)})
+}
+
+func (s *MainController) deleteUser(c *gin.Context) {
+	n, err := orm.New(s.Srv.Pool).UserDelete(c.Request.Context(), c.Param("email"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if n == 0 {
+		AbortMsg(c, 404, ErrUserNotFound)
+		return
+	}
+	c.JSON(200, gin.H{"message": "deleted"})
+}
+
+// Replace the user's scopes with the given list
+func (s *MainController) setUserScopes(c *gin.Context) {
+	var req setScopesRequest
+	if err := c.BindJSON(&req); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	email := c.Param("email")
+	err := orm.New(s.Srv.Pool).UserSetScopes(c.Request.Context(), orm.UserSetScopesParams{
+		Email:  email,
+		Scopes: lo.Ternary(req.Scopes == nil, []string{}, req.Scopes),
+	})
+	if err != nil {
+		abortPgError(c, err)
+		return
+	}
+	c.JSON(200, UserJson{Email: email, Scopes: req.Scopes})
+}
+
+// Returns the user's scopes including those granted through parent scopes
+func (s *MainController) getEffectiveScopes(c *gin.Context) {
+	ctx := c.Request.Context()
+	db := orm.New(s.Srv.Pool)
+	email := c.Param("email")
+	if _, err := db.GetUser(ctx, email); errors.Is(err, pgx.ErrNoRows) {
+		AbortMsg(c, 404, ErrUserNotFound)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	scopes, err := db.UserEffectiveScopes(ctx, orm.UserEffectiveScopesParams{Email: email})
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, UserJson{Email: email, Scopes: lo.Ternary(scopes == nil, []string{}, scopes)})
+}
+
+func (s *MainController) listScopes(c *gin.Context) {
+	rows, err := orm.New(s.Srv.Pool).ListScopes(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	scopes := lo.Map(rows, func(r orm.ListScopesRow, _ int) ScopeJson {
+		return ScopeJson{Key: r.Key, Desc: r.Desc, Parent: r.Parent.String}
+	})
+	c.JSON(200, gin.H{"scopes": scopes})
+}
+
+// Aborts with 409 for unique violations, 400 for exceptions raised by the auth functions
+// (unknown user or scope), and 500 for anything else.
+func abortPgError(c *gin.Context, err error) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgUniqueViolation:
+			AbortMsg(c, 409, ErrUserExists)
+			return
+		case pgRaiseException:
+			AbortMsg(c, 400, errors.New(pgErr.Message))
+			return
+		}
+	}
+	c.AbortWithError(500, err)
+}
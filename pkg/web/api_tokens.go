@@ -0,0 +1,213 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// Prefix of every API token, so they're easy to recognize
+const ApiTokenPrefix = "stsms_"
+
+// Error when a bearer token doesn't exist or has expired
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Error when a token is created with a scope that doesn't exist
+var ErrUnknownScope = errors.New("unknown scope")
+
+// Error when a token doesn't exist
+var ErrTokenNotFound = errors.New("token not found")
+
+type CreateApiTokenParams struct {
+	// Email of the user the token belongs to
+	Email string `json:"email"`
+	// Description of what the token is for
+	Name string `json:"name"`
+	// Scopes to restrict the token to, or nil for all of the user's scopes
+	Scopes []string `json:"scopes"`
+	// How long until the token expires (ex. "720h"), or empty for never
+	ExpiresIn string `json:"expires_in"`
+}
+
+type ApiTokenJson struct {
+	ID       int32      `json:"id"`
+	Email    string     `json:"email"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+	// Only set when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+// Generates a new random API token
+func NewApiToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return ApiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Returns the hash of the token as stored in the database
+func HashApiToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// Creates a token for an existing user. The token itself is only returned here,
+// the database only stores its hash.
+func CreateApiToken(ctx context.Context, db *orm.Queries, p CreateApiTokenParams) (ApiTokenJson, error) {
+	// The expiry is computed by the database, so it's compared with now() in the same time zone
+	var expiresSecs sql.NullFloat64
+	if p.ExpiresIn != "" {
+		d, err := time.ParseDuration(p.ExpiresIn)
+		if err != nil {
+			return ApiTokenJson{}, err
+		}
+		expiresSecs = sql.NullFloat64{Float64: d.Seconds(), Valid: true}
+	}
+	if p.Scopes != nil {
+		scopes, err := db.ListScopes(ctx)
+		if err != nil {
+			return ApiTokenJson{}, err
+		}
+		keys := lo.Map(scopes, func(s orm.ListScopesRow, _ int) string { return s.Key })
+		if unknown, _ := lo.Difference(p.Scopes, keys); len(unknown) > 0 {
+			return ApiTokenJson{}, fmt.Errorf("%w - %s", ErrUnknownScope, strings.Join(unknown, ","))
+		}
+	}
+	token, err := NewApiToken()
+	if err != nil {
+		return ApiTokenJson{}, err
+	}
+	row, err := db.ApiTokenCreate(ctx, orm.ApiTokenCreateParams{
+		TokenHash:   HashApiToken(token),
+		Name:        p.Name,
+		Scopes:      p.Scopes,
+		ExpiresSecs: expiresSecs,
+		Email:       p.Email,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ApiTokenJson{}, fmt.Errorf("%w - %s", ErrUserNotFound, p.Email)
+	} else if err != nil {
+		return ApiTokenJson{}, err
+	}
+	return ApiTokenJson{
+		ID:      row.ID,
+		Email:   p.Email,
+		Name:    p.Name,
+		Scopes:  p.Scopes,
+		Created: row.Created,
+		Expires: nullTimePtr(row.Expires),
+		Token:   token,
+	}, nil
+}
+
+// Lists tokens, optionally only those belonging to email
+func ListApiTokens(ctx context.Context, db *orm.Queries, email string) ([]ApiTokenJson, error) {
+	rows, err := db.ApiTokenList(ctx, nullString(email))
+	if err != nil {
+		return nil, err
+	}
+	return lo.Map(rows, func(r orm.ApiTokenListRow, _ int) ApiTokenJson {
+		return ApiTokenJson{
+			ID:       r.ID,
+			Email:    r.Email,
+			Name:     r.Name,
+			Scopes:   r.Scopes,
+			Created:  r.Created,
+			Expires:  nullTimePtr(r.Expires),
+			LastUsed: nullTimePtr(r.LastUsed),
+		}
+	}), nil
+}
+
+// Deletes a token, returning ErrTokenNotFound if it doesn't exist
+func RevokeApiToken(ctx context.Context, db *orm.Queries, id int32) error {
+	n, err := db.ApiTokenRevoke(ctx, id)
+	if err == nil && n == 0 {
+		err = ErrTokenNotFound
+	}
+	return err
+}
+
+// Returns the token from an "Authorization: Bearer" header, or the empty string
+func BearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// Register token management routes on the group
+func (s *MainController) initTokenRoutes(g *gin.RouterGroup) {
+	g.GET("/tokens", s.listTokens)
+	g.POST("/tokens", s.createToken)
+	g.DELETE("/tokens/:id", s.revokeToken)
+}
+
+// List tokens, optionally filtered by the "email" query parameter
+func (s *MainController) listTokens(c *gin.Context) {
+	tokens, err := ListApiTokens(c.Request.Context(), orm.New(s.Srv.Pool), c.Query("email"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, gin.H{"tokens": tokens})
+}
+
+// Create a token. This is the only time the token itself is returned.
+func (s *MainController) createToken(c *gin.Context) {
+	var req CreateApiTokenParams
+	if err := c.BindJSON(&req); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	tok, err := CreateApiToken(c.Request.Context(), orm.New(s.Srv.Pool), req)
+	if errors.Is(err, ErrUserNotFound) {
+		AbortMsg(c, 404, err)
+		return
+	} else if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	c.JSON(201, tok)
+}
+
+func (s *MainController) revokeToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	err = RevokeApiToken(c.Request.Context(), orm.New(s.Srv.Pool), int32(id))
+	if errors.Is(err, ErrTokenNotFound) {
+		AbortMsg(c, 404, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "revoked"})
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	return lo.Ternary(t.Valid, &t.Time, nil)
+}
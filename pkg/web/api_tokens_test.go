@@ -0,0 +1,57 @@
+package web
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewApiToken(t *testing.T) {
+	a, err := NewApiToken()
+	require.NoError(t, err)
+	b, err := NewApiToken()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(a, ApiTokenPrefix))
+	assert.NotEqual(t, a, b)
+	assert.Len(t, HashApiToken(a), 32)
+	assert.Equal(t, HashApiToken(a), HashApiToken(a))
+}
+
+func TestBearerToken(t *testing.T) {
+	cases := map[string]string{
+		"":                  "",
+		"Bearer":            "",
+		"Basic abc":         "",
+		"Bearer stsms_abc":  "stsms_abc",
+		"bearer  stsms_abc": "stsms_abc",
+	}
+	for header, expect := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		assert.Equal(t, expect, BearerToken(r), header)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", RequireAdminToken("secret"), func(c *gin.Context) { c.Status(200) })
+	send := func(auth string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 200, send("Bearer secret"))
+	assert.Equal(t, 401, send("Bearer wrong"))
+	assert.Equal(t, 401, send(""))
+}
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+// Error when a batch upload contains more runs than allowed
+var ErrBatchTooLarge = errors.New("too many runs in batch")
+
+// Outcome of a single run in a batch upload
+type BatchStatus string
+
+const (
+	BatchStored    BatchStatus = "stored"
+	BatchDuplicate BatchStatus = "duplicate"
+	BatchInvalid   BatchStatus = "invalid"
+	BatchError     BatchStatus = "error"
+)
+
+// Result for a single run in a batch upload
+type BatchResult struct {
+	PlayId string      `json:"play_id"`
+	Status BatchStatus `json:"status"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// A run from a batch upload, along with its raw body
+type batchItem struct {
+	Body   []byte
+	Run    RunSchemaJson
+	Result BatchResult
+}
+
+// Accepts either a JSON array of runs, or newline-delimited JSON with one run
+// per line, and stores each run. Responds with one BatchResult per run, in the
+// same order the runs were sent.
+func (s *MainController) postUploadBatch(c *gin.Context) {
+	cfg := s.Srv.Config
+
+	body, ok := readBodyLimited(c, cfg.Upload.BatchMaxBodySize)
+	if !ok {
+		return
+	}
+	bodies, err := SplitBatchBody(body)
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	if len(bodies) > cfg.Upload.BatchMax {
+		AbortMsg(c, 400, fmt.Errorf("%w - max = %d", ErrBatchTooLarge, cfg.Upload.BatchMax))
+		return
+	}
+	// Every run costs a token, and an empty batch still costs one
+	if !s.batchLimit.TakeN(c, lo.Max([]int{len(bodies), 1})) {
+		AbortMsg(c, 429, ErrRateLimited)
+		return
+	}
+	results, err := s.storeBatch(c, bodies)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, gin.H{"results": results})
+}
+
+// Parse, check and store each run, returning one BatchResult per body in the same
+// order. Only returns an error if nothing could be stored.
+func (s *MainController) storeBatch(c *gin.Context, bodies [][]byte) ([]BatchResult, error) {
+	ctx := c.Request.Context()
+	cfg := s.Srv.Config
+
+	// Parse everything first so the caches can be loaded once for the whole batch
+	oc := s.ormCtx.Copy()
+	items := make([]*batchItem, len(bodies))
+	for i, b := range bodies {
+		item := &batchItem{Body: b}
+		items[i] = item
+		if err := ParseRun(b, &item.Run); err != nil {
+			item.Result = BatchResult{PlayId: peekPlayId(b), Status: BatchInvalid, Reason: err.Error()}
+			continue
+		}
+		item.Result.PlayId = item.Run.PlayId.String()
+		if err := s.batchCheckOne(c, item); err != nil {
+			item.Result.Reason = err.Error()
+			continue
+		}
+		item.Run.Preload(oc)
+	}
+	if cfg.Upload.StoreToDb {
+		if err := oc.LoadSets(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		if item.Result.Status == "" {
+			item.Result.Status = s.batchStoreOne(c, oc, item)
+		}
+		results[i] = item.Result
+		s.metrics.RecordUpload(batchOutcomes[item.Result.Status])
+	}
+	return results, nil
+}
+
+// Checks a single parsed run from a batch before anything is stored. If the run
+// should be skipped, sets its status and returns the reason.
+func (s *MainController) batchCheckOne(c *gin.Context, item *batchItem) error {
+	cfg := s.Srv.Config
+	err := CheckArrayLengths(&item.Run, cfg.Upload.MaxArrayLength)
+	if err == nil && cfg.Upload.Validate {
+		err = ValidateRun(item.Body, &item.Run)
+	}
+	if err != nil {
+		item.Result.Status = BatchInvalid
+		return err
+	}
+	if cfg.Upload.StoreToDb {
+		exists, err := orm.New(s.Srv.Pool).DoesRunExist(c.Request.Context(), item.Result.PlayId)
+		if err != nil {
+			c.Error(err)
+			item.Result.Status = BatchError
+			return err
+		} else if exists {
+			item.Result.Status = BatchDuplicate
+			return ErrRunAlreadyUploaded
+		}
+	}
+	return nil
+}
+
+// Archive and store a single parsed run from a batch, returning its status.
+func (s *MainController) batchStoreOne(c *gin.Context, oc *OrmContext, item *batchItem) BatchStatus {
+	if !s.persistOptions().Any() {
+		return BatchStored
+	}
+	defer s.metrics.RecordStage("store", time.Now())
+	if err := s.persistRun(c.Request.Context(), oc, &item.Run, item.Body, c.GetString(CtxEmail)); err != nil {
+		item.Result.Reason = err.Error()
+		if errors.Is(err, ErrRunAlreadyUploaded) {
+			return BatchDuplicate
+		}
+		c.Error(err)
+		s.recordFailedUpload(c, item.Result.PlayId, item.Body, FailedStageBatch, err)
+		return BatchError
+	}
+	return BatchStored
+}
+
+// Splits a batch upload body into the raw JSON of each run. The body may either be
+// a JSON array, or newline-delimited JSON objects.
+func SplitBatchBody(body []byte) ([][]byte, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+		return lo.Map(raw, func(v json.RawMessage, _ int) []byte { return v }), nil
+	}
+	out := make([][]byte, 0)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+// Attempts to get the play_id from a run that failed to parse, returns
+// the empty string if that isn't possible.
+func peekPlayId(body []byte) string {
+	var v struct {
+		PlayId string `json:"play_id"`
+	}
+	json.Unmarshal(body, &v)
+	return v.PlayId
+}
@@ -0,0 +1,22 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitBatchBody(t *testing.T) {
+	exp := [][]byte{[]byte(`{"a":1}`), []byte(`{"b":[1,2]}`)}
+
+	out, err := SplitBatchBody([]byte(" [{\"a\":1}, {\"b\":[1,2]}]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, exp, out)
+
+	out, err = SplitBatchBody([]byte("{\"a\":1}\r\n\n{\"b\":[1,2]}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, exp, out)
+
+	_, err = SplitBatchBody([]byte(`[{"a":1}`))
+	assert.Error(t, err)
+}
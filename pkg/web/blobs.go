@@ -0,0 +1,115 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+)
+
+// Blob store backends, see ConfigBlobs.Backend
+const (
+	BlobBackendLocal   = "local"
+	BlobBackendSegment = "segment"
+	BlobBackendS3      = "s3"
+)
+
+// Error when the blob store backend isn't known
+var ErrUnknownBlobBackend = errors.New("unknown blob store backend")
+
+// Error when compacting a blob store which doesn't use segments
+var ErrNotCompactable = errors.New("blob store doesn't use segments")
+
+// Opens the blob store raw runs are saved to, or returns nil if they aren't saved
+func OpenBlobStore(cfg ConfigUpload) (blob.BlobStore, error) {
+	if !cfg.SaveRawToDisk {
+		return nil, nil
+	}
+	switch cfg.Blobs.Backend {
+	case BlobBackendLocal, "":
+		return blob.NewLocalStore(cfg.RunsDir)
+	case BlobBackendSegment:
+		local, err := blob.NewLocalStore(cfg.RunsDir)
+		if err != nil {
+			return nil, err
+		}
+		segs, err := blob.NewSegmentStore(filepath.Join(cfg.RunsDir, "segments"), cfg.Blobs.SegmentSize)
+		if err != nil {
+			return nil, err
+		}
+		return blob.NewLayered(local, segs), nil
+	case BlobBackendS3:
+		s3 := cfg.Blobs.S3
+		secret := s3.SecretKey
+		if secret == "" {
+			secret = os.Getenv("S3_SECRET_KEY")
+		}
+		return blob.NewS3Store(blob.S3Config{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			Bucket:    s3.Bucket,
+			Prefix:    s3.Prefix,
+			AccessKey: s3.AccessKey,
+			SecretKey: secret,
+			PathStyle: s3.PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBlobBackend, cfg.Blobs.Backend)
+	}
+}
+
+// Returns the SHA-256 of an uncompressed upload body
+func RunSum(body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return sum[:]
+}
+
+// Move runs from the local directory of a "segment" blob store into segment files, then
+// rewrite segments holding deleted runs so their data is removed from disk. Returns the
+// number of runs moved and segments rewritten, or ErrNotCompactable for other backends.
+func CompactBlobStore(ctx context.Context, blobs blob.BlobStore) (moved int, rewritten int, err error) {
+	layered, ok := blobs.(*blob.Layered)
+	if !ok {
+		return 0, 0, ErrNotCompactable
+	}
+	stores := layered.Stores()
+	segs, ok := stores[len(stores)-1].(*blob.SegmentStore)
+	if !ok {
+		return 0, 0, ErrNotCompactable
+	}
+	if moved, err = blob.Compact(ctx, stores[0], segs); err != nil {
+		return
+	}
+	rewritten, err = segs.Purge(ctx)
+	return
+}
+
+// Periodically compact the blob store, if it uses segments. Runs until ctx is cancelled.
+func (s *MainController) runCompaction(ctx context.Context) {
+	cfg := s.Srv.Config.Upload.Blobs
+	if s.blobs == nil || cfg.Backend != BlobBackendSegment || cfg.CompactInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.CompactInterval) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		moved, rewritten, err := CompactBlobStore(ctx, s.blobs)
+		if err != nil {
+			log.Printf("compact blobs: %v", err)
+		}
+		if moved > 0 || rewritten > 0 {
+			log.Printf("compact blobs: moved %d runs into segments, rewrote %d segments", moved, rewritten)
+		}
+	}
+}
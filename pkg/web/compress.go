@@ -0,0 +1,107 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content-Encoding values accepted for uploads
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// Largest raw run that will be decompressed from storage
+const maxRawSize = 64 << 20
+
+// Largest zstd window accepted in uploads, the default compression level uses much less
+const maxZstdWindow = 8 << 20
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// Error when the Content-Encoding of an upload isn't supported
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Error when an upload is larger than allowed after decompression
+var ErrDecompressedTooLarge = errors.New("decompressed body too large")
+
+// Shared encoder and decoder for stored runs, both are safe for concurrent use
+// of EncodeAll and DecodeAll.
+var (
+	rawEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	rawDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxRawSize))
+)
+
+// Read a request body encoded with encoding, which may be empty, "identity", "gzip" or
+// "zstd". Returns ErrDecompressedTooLarge if the decoded body is larger than limit bytes,
+// or ErrUnsupportedEncoding for any other encoding. A limit of 0 means no limit.
+func DecodeBody(r io.Reader, encoding string, limit int64) ([]byte, error) {
+	var rd io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		rd = r
+	case EncodingGzip, "x-gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	case EncodingZstd:
+		zr, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		rd = zr
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	if limit <= 0 {
+		return io.ReadAll(rd)
+	}
+	body, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrDecompressedTooLarge, limit)
+	}
+	return body, nil
+}
+
+// Compress a raw run for storage in the database or runs_dir
+func CompressRaw(data []byte) []byte {
+	return rawEncoder.EncodeAll(data, make([]byte, 0, len(data)/4))
+}
+
+// Returns the original JSON of a stored run. Runs stored before compression was added
+// are plain JSON and are returned unchanged; gzip is accepted too, for files
+// compressed by hand.
+func DecompressRaw(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		return rawDecoder.DecodeAll(data, nil)
+	case bytes.HasPrefix(data, gzipMagic):
+		return DecodeBody(bytes.NewReader(data), EncodingGzip, maxRawSize)
+	default:
+		return data, nil
+	}
+}
+
+// Returns true if data is a compressed run
+func IsCompressedRaw(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic) || bytes.HasPrefix(data, gzipMagic)
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	return enc.EncodeAll(data, nil)
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := []byte(`{"play_id":"abc"}`)
+	for _, tc := range []struct {
+		encoding string
+		data     []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{"gzip", gzipBytes(t, body)},
+		{"zstd", zstdBytes(t, body)},
+		{" GZIP ", gzipBytes(t, body)},
+	} {
+		out, err := DecodeBody(bytes.NewReader(tc.data), tc.encoding, 1024)
+		require.NoError(t, err, tc.encoding)
+		assert.Equal(t, body, out, tc.encoding)
+	}
+
+	_, err := DecodeBody(bytes.NewReader(body), "br", 1024)
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+
+	_, err = DecodeBody(bytes.NewReader(body), "gzip", 1024)
+	assert.Error(t, err)
+}
+
+func TestDecodeBodyBomb(t *testing.T) {
+	// Compresses to a tiny fraction of its size
+	big := []byte(strings.Repeat("a", 1<<20))
+	for _, data := range map[string][]byte{"gzip": gzipBytes(t, big), "zstd": zstdBytes(t, big)} {
+		assert.Less(t, len(data), 64<<10)
+	}
+	_, err := DecodeBody(bytes.NewReader(gzipBytes(t, big)), "gzip", 64<<10)
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+	_, err = DecodeBody(bytes.NewReader(zstdBytes(t, big)), "zstd", 64<<10)
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+
+	// Exactly at the limit is fine
+	out, err := DecodeBody(bytes.NewReader(zstdBytes(t, big)), "zstd", int64(len(big)))
+	require.NoError(t, err)
+	assert.Len(t, out, len(big))
+}
+
+func TestCompressRaw(t *testing.T) {
+	body := []byte(`{"play_id":"abc","floor_reached":50}`)
+	raw := CompressRaw(body)
+	assert.True(t, IsCompressedRaw(raw))
+	out, err := DecompressRaw(raw)
+	require.NoError(t, err)
+	assert.Equal(t, body, out)
+
+	// Legacy rows are plain JSON
+	assert.False(t, IsCompressedRaw(body))
+	out, err = DecompressRaw(body)
+	require.NoError(t, err)
+	assert.Equal(t, body, out)
+
+	out, err = DecompressRaw(gzipBytes(t, body))
+	require.NoError(t, err)
+	assert.Equal(t, body, out)
+}
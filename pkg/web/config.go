@@ -13,8 +13,12 @@ import (
 type Config struct {
 	// Set of IP addresses/ports to listen on
 	Listen string `toml:"listen"`
-	// Set of IP addresses/ports for the admin interface to listen on
+	// Set of IP addresses/ports for the admin interface to listen on, empty to disable.
+	// Admin routes are only served here if admin_token is set, otherwise only metrics are.
 	AdminListen string `toml:"admin_listen"`
+	// Bearer token required by admin routes on admin_listen. If empty it's read from
+	// ADMIN_TOKEN, and if that's empty too the admin routes aren't served there at all.
+	AdminToken string `toml:"admin_token,comment"`
 	// Base path of the server (default: "/")
 	BasePath string `toml:"base_path,comment"`
 	// Runs in release mode by default, unless this is true in which case gin is run in debug mode.
@@ -27,26 +31,131 @@ type Config struct {
 	Stats ConfigStats `toml:"stats"`
 	// Settings for upload
 	Upload ConfigUpload `toml:"upload"`
+	// Settings for admin endpoints
+	Admin ConfigAdmin `toml:"admin"`
+	// Settings for Prometheus metrics
+	Metrics ConfigMetrics `toml:"metrics"`
+	// Settings for built-in OAuth2/OIDC login
+	OAuth ConfigOAuth `toml:"oauth"`
+	// Settings for trusting identity headers from an auth proxy (ex. oauth2-proxy)
+	Proxy ConfigProxy `toml:"proxy"`
 }
 
 type ConfigGetRun struct {
 	// Get-run route
 	Route string `toml:"route,comment"`
-	// Require authentication and "getrun" scope
+	// Route to list and filter runs, set to empty to disable
+	ListRoute string `toml:"list_route,comment"`
+	// Require authentication and "getrun" scope for both routes
 	Auth bool `toml:"auth,comment"`
 }
 
 type ConfigUpload struct {
 	// Upload route
 	Route string `toml:"route,comment"`
+	// Batch upload route (JSON array or newline-delimited JSON), set to empty to disable
+	BatchRoute string `toml:"batch_route,comment"`
+	// Maximum number of runs accepted in a single batch upload
+	BatchMax int `toml:"batch_max,comment"`
+	// Route for the browser upload form, which accepts .run and .tar.gz files. Limited by
+	// batch_max and batch_max_body_size. Set to empty to disable.
+	FileRoute string `toml:"file_route,comment"`
+	// Reject runs that don't match run.schema.json, including nested elements, or have
+	// inconsistent data (negative floors, mismatched per-floor arrays, etc.)
+	Validate bool `toml:"validate,comment"`
 	// Store uploads in the database, the main point of this whole thing
 	StoreToDb bool `toml:"store_to_db,comment"`
-	// If true, stores raw upload json to a file on the disk
+	// If true, stores raw uploads in the blob store configured in [upload.blobs]
 	SaveRawToDisk bool `toml:"save_raw_to_disk,comment"`
 	// If true, stores raw upload json to the database
 	SaveRawToDb bool `toml:"save_raw_to_db,comment"`
-	// Directory where runs are stored if save_raw_to_disk is true
+	// Directory where the "local" and "segment" blob stores keep runs
 	RunsDir string `toml:"runs_dir,comment"`
+	// On startup, store archived runs which were never parsed, restore missing archives
+	// from runs_dir, and write any files that failed to be written
+	Reconcile bool `toml:"reconcile,comment"`
+	// Maximum size in bytes of a single run upload, both as sent and after decompression
+	MaxBodySize int64 `toml:"max_body_size,comment"`
+	// Maximum size in bytes of a batch upload, both as sent and after decompression
+	BatchMaxBodySize int64 `toml:"batch_max_body_size,comment"`
+	// Maximum length of any array in a run, 0 for no limit
+	MaxArrayLength int `toml:"max_array_length,comment"`
+	// Rate limits for the single upload route, in requests. Clients are identified by their
+	// IP, which is taken from X-Forwarded-For only if the peer is in proxy.trusted_cidrs.
+	RateLimit ConfigRateLimit `toml:"rate_limit"`
+	// Rate limits for the batch and file upload routes, in runs rather than requests.
+	// Bursts must be at least batch_max, or the largest batches could never be accepted.
+	BatchRateLimit ConfigRateLimit `toml:"batch_rate_limit"`
+	// Settings for asynchronous processing of single uploads
+	Async ConfigAsync `toml:"async"`
+	// Where raw uploads are stored if save_raw_to_disk is true
+	Blobs ConfigBlobs `toml:"blobs"`
+}
+
+type ConfigBlobs struct {
+	// "local" stores each run as a file in runs_dir, sharded into subdirectories.
+	// "segment" also compacts those files into append-only segment files in runs_dir/segments.
+	// "s3" stores runs in an S3-compatible object store.
+	Backend string `toml:"backend,comment"`
+	// Size in bytes at which a new segment file is started
+	SegmentSize int64 `toml:"segment_size,comment"`
+	// Minutes between compactions for the "segment" backend, 0 to only compact with smtool.
+	// Deleted runs stay in segment files until they're compacted.
+	CompactInterval int `toml:"compact_interval,comment"`
+	// Settings for the "s3" backend
+	S3 ConfigS3 `toml:"s3"`
+}
+
+type ConfigS3 struct {
+	// Base URL of the S3 API, ex. "https://s3.us-east-1.amazonaws.com" or "http://minio:9000"
+	Endpoint string `toml:"endpoint,comment"`
+	Region   string `toml:"region,comment"`
+	Bucket   string `toml:"bucket,comment"`
+	// Prepended to the name of every object, ex. "runs/"
+	Prefix    string `toml:"prefix,comment"`
+	AccessKey string `toml:"access_key,comment"`
+	// Secret key, if empty the S3_SECRET_KEY environment variable is used instead
+	SecretKey string `toml:"secret_key,comment"`
+	// Put the bucket name in the path instead of the host name, needed by most S3-compatible servers
+	PathStyle bool `toml:"path_style,comment"`
+}
+
+type ConfigAsync struct {
+	// If true, uploads are put in a queue and added to the database by background workers.
+	// The upload route responds with 202 and a job token instead of waiting.
+	Enabled bool `toml:"enabled,comment"`
+	// Route to get the status of a queued upload, with the job token appended
+	StatusRoute string `toml:"status_route,comment"`
+	// Number of workers adding queued runs to the database. Each worker holds a database
+	// connection while it works, so the pool needs at least workers + 2 connections
+	// (pool_max_conns in POSTGRES_CONN).
+	Workers int `toml:"workers,comment"`
+	// Number of jobs each worker claims at once
+	BatchSize int `toml:"batch_size,comment"`
+	// Seconds to wait between checks when the queue is empty
+	PollInterval int `toml:"poll_interval,comment"`
+	// Number of times to try adding a run before giving up, including attempts abandoned
+	// because the server stopped or crashed
+	MaxAttempts int `toml:"max_attempts,comment"`
+	// Seconds to wait before retrying a failed job, doubled after each attempt
+	RetryDelay int `toml:"retry_delay,comment"`
+	// Reject uploads with 503 when this many jobs are waiting, 0 for no limit
+	MaxPending int `toml:"max_pending,comment"`
+	// Seconds after which an in-progress job is assumed abandoned and queued again
+	StaleAfter int `toml:"stale_after,comment"`
+	// Hours to keep done and failed jobs so their status can be checked
+	KeepDone int `toml:"keep_done,comment"`
+}
+
+type ConfigRateLimit struct {
+	// Requests per second allowed from a single IP, 0 to disable
+	PerIpRate float64 `toml:"per_ip_rate,comment"`
+	// Number of requests a single IP may make in a burst
+	PerIpBurst int `toml:"per_ip_burst,comment"`
+	// Requests per second allowed across all clients, 0 to disable
+	GlobalRate float64 `toml:"global_rate,comment"`
+	// Number of requests all clients may make in a burst
+	GlobalBurst int `toml:"global_burst,comment"`
 }
 
 type ConfigStats struct {
@@ -54,27 +163,140 @@ type ConfigStats struct {
 	Route string `toml:"route,comment"`
 	// Stats HTTP address
 	Upstream string `toml:"upstream,comment"`
-	// If true, require authentication AND the stats:view scope to access the stats page(s).
+	// Route prefix for the JSON stats API, set to empty to disable
+	ApiRoute string `toml:"api_route,comment"`
+	// If true, require authentication AND the stats:view scope to access the stats page(s) and API.
 	Auth bool `toml:"auth,comment"`
 }
 
+type ConfigAdmin struct {
+	// Route prefix for admin endpoints on the main server, set to empty to disable.
+	// All admin endpoints require the "admin" scope.
+	Route string `toml:"route,comment"`
+}
+
+type ConfigMetrics struct {
+	// Route for Prometheus metrics, set to empty to disable
+	Route string `toml:"route,comment"`
+	// If true, metrics are served on admin_listen instead of the main server,
+	// and aren't served at all if admin_listen is empty
+	AdminListen bool `toml:"admin_listen,comment"`
+}
+
+type ConfigProxy struct {
+	// Header containing the user's email, set by the auth proxy
+	EmailHeader string `toml:"email_header,comment"`
+	// The email header is only trusted from peers in these CIDR ranges.
+	// If empty, it's trusted from any peer, so signature_secret must be set.
+	TrustedCidrs []string `toml:"trusted_cidrs,comment"`
+	// If set, the email header must be signed with HMAC-SHA256 using this secret,
+	// see SignIdentity. If empty it's read from IDENTITY_HMAC_SECRET.
+	SignatureSecret string `toml:"signature_secret,comment"`
+	// Maximum age in seconds of a signed email header
+	SignatureMaxAge int `toml:"signature_max_age,comment"`
+}
+
+type ConfigOAuth struct {
+	// Route prefix for login, logout and callback, set to empty to disable
+	Route string `toml:"route,comment"`
+	// Public URL of the server (ex. "https://example.com"), used to build the callback URL
+	ExternalUrl string `toml:"external_url,comment"`
+	// Login providers by name, selected with /login?provider=<name>
+	Providers map[string]ConfigOAuthProvider `toml:"providers"`
+}
+
+type ConfigOAuthProvider struct {
+	// OIDC issuer URL. If set, endpoints are discovered from the issuer.
+	Issuer string `toml:"issuer,comment"`
+	// OAuth2 client ID
+	ClientId string `toml:"client_id,comment"`
+	// OAuth2 client secret, if empty it's read from OAUTH_<NAME>_SECRET
+	ClientSecret string `toml:"client_secret,comment"`
+	// Authorization endpoint, not needed if issuer is set
+	AuthUrl string `toml:"auth_url,comment"`
+	// Token endpoint, not needed if issuer is set
+	TokenUrl string `toml:"token_url,comment"`
+	// Endpoint which returns the user's email, not needed if issuer is set.
+	// May return an object with an "email" field, or a list of GitHub-style email objects.
+	UserInfoUrl string `toml:"userinfo_url,comment"`
+	// Scopes to request, defaults to "openid email" for OIDC providers
+	Scopes []string `toml:"scopes,comment"`
+}
+
 func (c Config) Default() Config {
 	return Config{
 		BasePath:  "/",
 		DebugMode: false,
 		GetRun: ConfigGetRun{
-			Route: "/getrun",
-			Auth:  true,
+			Route:     "/getrun",
+			ListRoute: "/runs",
+			Auth:      true,
 		},
 		Stats: ConfigStats{
-			Route: "/stats",
-			Auth:  true,
+			Route:    "/stats",
+			ApiRoute: "/api/stats",
+			Auth:     true,
 		},
 		Upload: ConfigUpload{
-			Route:       "/upload",
-			StoreToDb:   true,
-			SaveRawToDb: true,
-			RunsDir:     "data/runs",
+			Route:            "/upload",
+			BatchRoute:       "/upload-batch",
+			BatchMax:         1000,
+			FileRoute:        "/upload-file",
+			Validate:         true,
+			StoreToDb:        true,
+			SaveRawToDb:      true,
+			RunsDir:          "data/runs",
+			Reconcile:        true,
+			MaxBodySize:      1 << 20,
+			BatchMaxBodySize: 64 << 20,
+			MaxArrayLength:   1000,
+			RateLimit: ConfigRateLimit{
+				PerIpRate:   0.5,
+				PerIpBurst:  20,
+				GlobalRate:  20,
+				GlobalBurst: 100,
+			},
+			BatchRateLimit: ConfigRateLimit{
+				PerIpRate:   2,
+				PerIpBurst:  1000,
+				GlobalRate:  50,
+				GlobalBurst: 5000,
+			},
+			Async: ConfigAsync{
+				Enabled:      false,
+				StatusRoute:  "/upload-status",
+				Workers:      4,
+				BatchSize:    10,
+				PollInterval: 1,
+				MaxAttempts:  5,
+				RetryDelay:   10,
+				MaxPending:   10000,
+				StaleAfter:   600,
+				KeepDone:     24,
+			},
+			Blobs: ConfigBlobs{
+				Backend:         BlobBackendLocal,
+				SegmentSize:     256 << 20,
+				CompactInterval: 60,
+				S3: ConfigS3{
+					Region: "us-east-1",
+				},
+			},
+		},
+		Admin: ConfigAdmin{
+			Route: "/admin",
+		},
+		Metrics: ConfigMetrics{
+			Route:       "/metrics",
+			AdminListen: true,
+		},
+		OAuth: ConfigOAuth{
+			Route: "/oauth",
+		},
+		Proxy: ConfigProxy{
+			EmailHeader:     "X-Email",
+			TrustedCidrs:    []string{"127.0.0.0/8", "::1/128"},
+			SignatureMaxAge: 300,
 		},
 	}
 }
@@ -4,21 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/fs"
+	"log"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
-	_ "golang.org/x/oauth2"
-
+	"github.com/bindernews/sts-msr/pkg/blob"
 	"github.com/bindernews/sts-msr/pkg/orm"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
-	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
 	"github.com/samber/lo"
 )
@@ -35,6 +32,10 @@ var (
 const (
 	// gin Context key for the user's email
 	CtxEmail = "Email"
+	// gin context key for the scopes an API token is restricted to, unset if unrestricted
+	CtxTokenScopes = "TokenScopes"
+	// gin context key for the user's effective scopes, set on the first scope check
+	CtxScopes = "Scopes"
 	// gin context key for the string cache
 	CtxStrCache = "StrCache"
 	// context key for the database pool
@@ -52,17 +53,38 @@ const (
 type StrCache = DbCache[string]
 
 type MainController struct {
-	Srv    *Services
-	ormCtx *OrmContext
+	Srv      *Services
+	ormCtx   *OrmContext
+	metrics  *Metrics
+	identity *IdentityHeaders
+	queue    *IngestQueue
+	// Limits runs uploaded through the batch and file routes, nil if disabled
+	batchLimit *RateLimiter
+	// Where raw runs are saved, nil if they aren't
+	blobs blob.BlobStore
 }
 
 func (s *MainController) Init(r *gin.Engine) error {
 	cfg := s.Srv.Config
-	db := orm.New(s.Srv.Pool)
-
-	s.ormCtx = &OrmContext{
-		Sc: NewDbCache(db.StrCacheToId, db.StrCacheAdd),
-		Cc: NewDbCache(db.CardSpecToId, db.CardSpecAdd),
+	identity, err := NewIdentityHeaders(cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	s.identity = identity
+	if s.blobs, err = OpenBlobStore(cfg.Upload); err != nil {
+		return err
+	}
+	s.ormCtx = NewOrmContext(orm.New(s.Srv.Pool))
+	go ListenCacheInvalidate(context.Background(), s.Srv.Pool, s.ormCtx)
+	s.metrics = NewMetrics(s.Srv.Pool, s.ormCtx)
+	if cfg.Upload.Async.Enabled {
+		if err := CheckIngestPoolSize(s.Srv.Pool, cfg.Upload.Async); err != nil {
+			return err
+		}
+		s.queue = NewIngestQueue(s.Srv.Pool, cfg.Upload.Async, func(ctx context.Context, tx pgx.Tx, run *RunSchemaJson, body []byte, uploader string) (*PendingBlob, error) {
+			return PersistRunTx(ctx, tx, s.ormCtx.Copy(), s.persistOptions(), run, body, uploader)
+		}, s.metrics)
+		go s.queue.Run(context.Background())
 	}
 
 	// Set the gin run mode
@@ -72,18 +94,26 @@ func (s *MainController) Init(r *gin.Engine) error {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// Only believe X-Forwarded-For from our own proxies, the rate limits depend on it
+	if err := r.SetTrustedProxies(cfg.Proxy.TrustedCidrs); err != nil {
+		return err
+	}
 	r.Use(sessions.Sessions("main", s.Srv.SeStore))
 	r.LoadHTMLGlob("pkg/templates/*.html")
 
-	// Make directory to store runs in
-	if cfg.Upload.SaveRawToDisk {
-		os.MkdirAll(cfg.Upload.RunsDir, fs.FileMode(0755))
-	}
+	go s.runReconcile(context.Background())
+	go s.runCompaction(context.Background())
 
 	// Register main routes
 	g := r.Group(strings.TrimSuffix(cfg.BasePath, "/"))
 	g.Use(s.CtxInject)
 
+	// Built-in login, for deployments without oauth2-proxy
+	if cfg.OAuth.Route != "" && len(cfg.OAuth.Providers) > 0 {
+		callbackUrl := strings.TrimSuffix(cfg.OAuth.ExternalUrl, "/") + path.Join(g.BasePath(), cfg.OAuth.Route, "callback")
+		NewOAuthLogin(cfg.OAuth, callbackUrl, g.BasePath()).Init(g.Group(cfg.OAuth.Route))
+	}
+
 	// Create proxy for stats server
 	if cfg.Stats.Upstream != "" {
 		targetUrl, err := url.Parse(cfg.Stats.Upstream)
@@ -91,24 +121,68 @@ func (s *MainController) Init(r *gin.Engine) error {
 			return err
 		}
 		proxy := httputil.NewSingleHostReverseProxy(targetUrl)
+		proxy.ErrorHandler = s.metrics.ProxyErrorHandler
 		statsPrefix := g.BasePath() + cfg.Stats.Route
 		g.Any(cfg.Stats.Route, HandlerChain(
 			tern(cfg.Stats.Auth, s.authScopes([]string{"stats:view"}), nil),
 			StripRequestPrefix(statsPrefix),
+			ForwardIdentity,
 			gin.WrapH(proxy),
 		)...)
 	}
 
+	// Stats JSON API
+	if cfg.Stats.ApiRoute != "" {
+		statsApi := g.Group(cfg.Stats.ApiRoute)
+		if cfg.Stats.Auth {
+			statsApi.Use(s.authScopes([]string{"stats:view"}))
+		}
+		s.initStatsApi(statsApi)
+	}
+
+	// Single uploads are limited per request, batches per run
+	var rateLimit gin.HandlerFunc
+	if rl := NewRateLimiter(cfg.Upload.RateLimit); rl != nil {
+		rateLimit = rl.Handler
+	}
+	if cfg.Upload.BatchRoute != "" || cfg.Upload.FileRoute != "" {
+		if err := cfg.Upload.BatchRateLimit.CheckBurst(cfg.Upload.BatchMax); err != nil {
+			return fmt.Errorf("upload.batch_rate_limit: %w", err)
+		}
+		s.batchLimit = NewRateLimiter(cfg.Upload.BatchRateLimit)
+	}
+
 	// Create upload handler
+	m := s.metrics
+	persist := s.persistOptions()
 	g.POST(cfg.Upload.Route, HandlerChain(
-		s.postUploadParse,
-		tern(cfg.Upload.SaveRawToDb || cfg.Upload.SaveRawToDisk, s.archiveRawData, nil),
-		tern(cfg.Upload.StoreToDb, s.storeToDb, nil),
-		func(c *gin.Context) {
+		m.CountUpload,
+		rateLimit,
+		m.Timed("parse", s.postUploadParse),
+		m.Timed("validate", tern(cfg.Upload.Validate, s.validateRun, nil)),
+		tern(cfg.Upload.StoreToDb, s.rejectDuplicate, nil),
+		m.Timed("store", tern(persist.Any() && s.queue == nil, s.storeToDb, nil)),
+		m.Timed("enqueue", tern(persist.Any() && s.queue != nil, s.enqueueRun, nil)),
+		tern(persist.Any() && s.queue != nil, nil, func(c *gin.Context) {
 			c.JSON(200, gin.H{"message": "Thank you!"})
-		},
+		}),
 	)...)
 
+	// Status of queued uploads
+	if s.queue != nil && cfg.Upload.Async.StatusRoute != "" {
+		g.GET(path.Join(cfg.Upload.Async.StatusRoute, ":token"), s.getIngestStatus)
+	}
+
+	// Create batch upload handler
+	if cfg.Upload.BatchRoute != "" {
+		g.POST(cfg.Upload.BatchRoute, s.postUploadBatch)
+	}
+
+	// Upload form for players without the mod
+	if cfg.Upload.FileRoute != "" {
+		g.POST(cfg.Upload.FileRoute, s.postUploadFile)
+	}
+
 	// Add getrun route
 	if cfg.GetRun.Route != "" {
 		g.GET(cfg.GetRun.Route, HandlerChain(
@@ -116,23 +190,72 @@ func (s *MainController) Init(r *gin.Engine) error {
 			s.GetRunJson,
 		)...)
 	}
+	if cfg.GetRun.ListRoute != "" {
+		g.GET(cfg.GetRun.ListRoute, HandlerChain(
+			tern(cfg.GetRun.Auth, s.authScopes([]string{"getrun"}), nil),
+			s.ListRuns,
+		)...)
+	}
 
 	// Health check route
 	if cfg.HealthRoute != "" {
 		g.GET(cfg.HealthRoute, s.healthCheck)
 	}
 
-	if cfg.DebugMode {
+	// Metrics, unless they're served on the admin listener
+	if cfg.Metrics.Route != "" && !cfg.Metrics.AdminListen {
+		g.GET(cfg.Metrics.Route, s.metrics.Handler())
+	}
+
+	// Admin routes
+	if cfg.Admin.Route != "" {
+		s.initAdminRoutes(g.Group(cfg.Admin.Route, s.authScopes([]string{"admin"})))
+	}
+
+	if cfg.DebugMode || cfg.Upload.FileRoute != "" {
 		g.GET("/", s.GetIndex)
 	}
 	return nil
 }
 
+// Register routes served on the admin listener. Must be called after Init.
+// Admin routes are mounted at the root and require the admin token, see RequireAdminToken.
+// If there's no admin token, only metrics are served.
+func (s *MainController) InitAdmin(r *gin.Engine) error {
+	cfg := s.Srv.Config
+	token := cfg.AdminToken
+	if token == "" {
+		token = os.Getenv("ADMIN_TOKEN")
+	}
+	if token != "" {
+		s.initAdminRoutes(r.Group("/", RequireAdminToken(token)))
+	} else {
+		log.Println("admin_listen: admin_token isn't set, only serving metrics")
+	}
+	if cfg.Metrics.Route != "" && cfg.Metrics.AdminListen {
+		r.GET(cfg.Metrics.Route, s.metrics.Handler())
+	}
+	return nil
+}
+
 func (s *MainController) GetIndex(c *gin.Context) {
-	email := c.GetString(CtxEmail)
-	c.HTML(200, "index.html", gin.H{
-		"Email": email,
-	})
+	cfg := s.Srv.Config
+	data := gin.H{
+		"Email":     c.GetString(CtxEmail),
+		"UploadUrl": lo.Ternary(cfg.Upload.FileRoute != "", s.routeUrl(cfg.Upload.FileRoute), ""),
+	}
+	if cfg.OAuth.Route != "" && len(cfg.OAuth.Providers) > 0 {
+		providers := lo.Keys(cfg.OAuth.Providers)
+		sort.Strings(providers)
+		data["Providers"] = providers
+		data["OAuthUrl"] = s.routeUrl(cfg.OAuth.Route)
+	}
+	c.HTML(200, "index.html", data)
+}
+
+// Returns the URL path of a route, including the base path
+func (s *MainController) routeUrl(route string) string {
+	return path.Join("/", s.Srv.Config.BasePath, route)
 }
 
 func (s *MainController) healthCheck(c *gin.Context) {
@@ -147,94 +270,120 @@ func (s *MainController) healthCheck(c *gin.Context) {
 // Parse body into RunSchemaJson
 func (s *MainController) postUploadParse(c *gin.Context) {
 	// Read the body since we parse it multiple times
-	body, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		c.AbortWithError(400, err)
+	body, ok := readBodyLimited(c, s.Srv.Config.Upload.MaxBodySize)
+	if !ok {
 		return
 	}
-	c.Request.Body.Close()
 	c.Set(ctxBodyBytes, body)
 
 	var runData RunSchemaJson
-	if err := binding.JSON.BindBody(body, &runData); err != nil {
-		AbortMsg(c, 400, err)
+	if err := ParseRun(body, &runData); err != nil {
+		abortInvalid(c, err)
+		return
+	}
+	if err := CheckArrayLengths(&runData, s.Srv.Config.Upload.MaxArrayLength); err != nil {
+		abortInvalid(c, err)
 		return
 	}
 	c.Set(ctxRunData, runData)
 	c.Set(ctxPlayId, runData.PlayId.String())
 }
 
-func (s *MainController) archiveRawData(c *gin.Context) {
+// Validate the parsed run, responding with every violation found
+func (s *MainController) validateRun(c *gin.Context) {
 	body := c.MustGet(ctxBodyBytes).([]byte)
-	playId := c.MustGet(ctxPlayId).(string)
-	params := orm.ArchiveAddParams{
-		Bdata:  pgtype.JSON{Bytes: body, Status: pgtype.Present},
-		PlayID: playId,
-	}
-	cfg := s.Srv.Config
-	if cfg.Upload.SaveRawToDb {
-		if err := s.saveRawToDb(c, params); err != nil {
-			c.Error(err)
-		}
-	}
-	if cfg.Upload.SaveRawToDisk {
-		if err := s.saveRawToFile(c, params); err != nil {
-			c.Error(err)
-		}
-	}
-}
-
-// Save the raw contents of the json body into the database
-func (s *MainController) saveRawToDb(c *gin.Context, req orm.ArchiveAddParams) error {
-	ctx := context.Background()
-	if err := orm.New(s.Srv.Pool).ArchiveAdd(ctx, req); err != nil {
-		return err
+	runData := c.MustGet(ctxRunData).(RunSchemaJson)
+	if err := ValidateRun(body, &runData); err != nil {
+		abortInvalid(c, err)
 	}
-	return nil
 }
 
-// Save the raw contents of the json body to the disk
-func (s *MainController) saveRawToFile(c *gin.Context, req orm.ArchiveAddParams) error {
-	fpath := path.Join(s.Srv.Config.Upload.RunsDir, req.PlayID+".run")
-	if wr, err := CreateNewFile(fpath); err == nil {
-		defer wr.Close()
-		if _, err := wr.Write(req.Bdata.Bytes); err != nil {
-			return err
-		}
-	} else {
-		return err
+// Reject runs that have already been uploaded before doing any other work
+func (s *MainController) rejectDuplicate(c *gin.Context) {
+	playId := c.MustGet(ctxPlayId).(string)
+	exists, err := orm.New(s.Srv.Pool).DoesRunExist(c.Request.Context(), playId)
+	if err != nil {
+		c.AbortWithError(500, err)
+	} else if exists {
+		AbortMsg(c, 400, fmt.Errorf("%w - play_id = %s", ErrRunAlreadyUploaded, playId))
 	}
-	return nil
 }
 
+// Write the upload to the database and/or disk in one transaction, according to the upload config
 func (s *MainController) storeToDb(c *gin.Context) {
 	ctx := c.Request.Context()
 	runData := c.MustGet(ctxRunData).(RunSchemaJson)
-	oc := s.ormCtx.Copy()
-	// Store in DB
-	err := s.Srv.Pool.BeginFunc(ctx, func(tx pgx.Tx) error {
-		_, err := runData.AddToDb(ctx, oc, orm.New(tx))
-		return err
-	})
-	if err != nil {
+	body := c.MustGet(ctxBodyBytes).([]byte)
+	if err := s.persistRun(ctx, s.ormCtx.Copy(), &runData, body, c.GetString(CtxEmail)); err != nil {
 		// Duplicate play id is a bad request
-		if strings.Contains(err.Error(), "\"runsdata_play_id_key\"") {
-			AbortMsg(c, 400, fmt.Errorf("%w - play_id = %s", ErrRunAlreadyUploaded, runData.PlayId))
+		if errors.Is(err, ErrRunAlreadyUploaded) {
+			AbortMsg(c, 400, err)
 		} else {
+			s.recordFailedUpload(c, runData.PlayId.String(), body, FailedStageStore, err)
 			c.AbortWithError(500, err)
 		}
 	}
 }
 
+// Seconds clients should wait before retrying when the ingest queue is full
+const queueFullRetryAfter = "30"
+
+// Add the run to the ingest queue, responding with 202 and the job id
+func (s *MainController) enqueueRun(c *gin.Context) {
+	body := c.MustGet(ctxBodyBytes).([]byte)
+	playId := c.MustGet(ctxPlayId).(string)
+	token, err := s.queue.Enqueue(c.Request.Context(), playId, body, c.GetString(CtxEmail))
+	if errors.Is(err, ErrQueueFull) {
+		c.Header("Retry-After", queueFullRetryAfter)
+		AbortMsg(c, 503, err)
+		return
+	} else if errors.Is(err, ErrRunAlreadyUploaded) {
+		AbortMsg(c, 400, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(202, gin.H{"message": "Thank you!", "job_id": token})
+}
+
+func (s *MainController) getIngestStatus(c *gin.Context) {
+	job, err := s.queue.Status(c.Request.Context(), c.Param("token"))
+	if errors.Is(err, ErrJobNotFound) {
+		AbortMsg(c, 404, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, job)
+}
+
+// Returns where uploads are written, based on the config
+func (s *MainController) persistOptions() PersistOptions {
+	return PersistOptionsFromConfig(s.Srv.Config.Upload, s.blobs)
+}
+
+func (s *MainController) persistRun(ctx context.Context, oc *OrmContext, runData *RunSchemaJson, body []byte, uploader string) error {
+	return PersistRun(ctx, s.Srv.Pool, oc, s.persistOptions(), runData, body, uploader)
+}
+
 func (s *MainController) GetRunJson(c *gin.Context) {
 	ctx := c.Request.Context()
 	db := orm.New(s.Srv.Pool)
 
 	var params struct {
 		PlayId string `form:"play_id"`
+		// Return the original upload instead of the parsed run
+		Raw bool `form:"raw"`
 	}
 	if err := c.BindQuery(&params); err != nil {
 		AbortMsg(c, 400, err)
+		return
+	}
+	if params.Raw {
+		s.getRawRun(c, db, params.PlayId)
+		return
 	}
 	data, err := RunToJson(ctx, db, params.PlayId)
 	if err != nil {
@@ -244,34 +393,96 @@ func (s *MainController) GetRunJson(c *gin.Context) {
 	c.JSON(200, data)
 }
 
+// Respond with the archived upload of a run, which may be stored compressed
+func (s *MainController) getRawRun(c *gin.Context, db *orm.Queries, playId string) {
+	raw, err := db.ArchiveGet(c.Request.Context(), playId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithError(404, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	body, err := DecompressRaw(raw)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Data(200, "application/json", body)
+}
+
 // Middleware that sets the CtxEmail value for the context, regardless of if
 // the user is authenticated or not. If the user is not logged in, sets to the empty string.
+// A bearer token takes precedence over the auth proxy's email header, which takes precedence
+// over the session from the built-in login. An invalid token is rejected.
+// Identity headers are removed from the request, so they can't reach upstream servers unverified.
 func (s *MainController) CtxInject(c *gin.Context) {
-	email := c.GetHeader("X-Email")
+	email := s.identity.Email(c.Request)
+	s.identity.Strip(c.Request.Header)
+	if email == "" {
+		email = SessGetString(sessions.Default(c), SessEmail)
+	}
+	if token := BearerToken(c.Request); token != "" {
+		row, err := orm.New(s.Srv.Pool).ApiTokenLookup(c.Request.Context(), HashApiToken(token))
+		if errors.Is(err, pgx.ErrNoRows) {
+			AbortMsg(c, 401, ErrInvalidToken)
+			return
+		} else if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		email = row.Email
+		if row.Scopes != nil {
+			c.Set(CtxTokenScopes, row.Scopes)
+		}
+	}
 	c.Set(CtxEmail, email)
 	c.Set(CtxDbPool, s.Srv.Pool)
 }
 
 // Returns middleware that checks if the user has the required scopes.
-// The user must have ALL scopes listed in the array to be allowed access.
+// The user must have ALL scopes listed in the array to be allowed access,
+// either directly or through a parent scope.
 // If the user is not authenticated, they will be denied access.
+// Requests made with a restricted API token are limited to the scopes on the token.
 //
 // Uses email from CtxEmail
 func (s *MainController) authScopes(scopes []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		const query = `SELECT auth.user_has_scopes($1,$2)`
-		ctx := c.Request.Context()
 		// Attempt to get the user's email address
-		email := c.GetString(CtxEmail)
-		if email == "" {
+		if c.GetString(CtxEmail) == "" {
 			AbortMsg(c, 403, ErrUnauthorized)
 			return
 		}
-		ok := false
-		err := s.Srv.Pool.QueryRow(ctx, query, email, scopes).Scan(&ok)
-		if err != nil || !ok {
+		effective, err := s.effectiveScopes(c)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		if !lo.Every(effective, scopes) {
 			AbortMsg(c, 403, ErrUnauthorized)
 			return
 		}
 	}
 }
+
+// Returns the effective scopes of the current user, limited by the API token if one was used.
+// The result is cached in the context, so checking scopes multiple times only queries once.
+func (s *MainController) effectiveScopes(c *gin.Context) ([]string, error) {
+	if v, ok := c.Get(CtxScopes); ok {
+		return v.([]string), nil
+	}
+	var tokenScopes []string
+	if v, ok := c.Get(CtxTokenScopes); ok {
+		tokenScopes = v.([]string)
+	}
+	scopes, err := orm.New(s.Srv.Pool).UserEffectiveScopes(c.Request.Context(), orm.UserEffectiveScopesParams{
+		Email:       c.GetString(CtxEmail),
+		TokenScopes: tokenScopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Set(CtxScopes, scopes)
+	return scopes, nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 
 	"github.com/samber/lo"
 )
@@ -29,6 +30,18 @@ type DbCache[T comparable] interface {
 	GetAll(keys []T) []int32
 	RevGet(id int32) T
 	RevGetAll(id []int32) []T
+	// Forget every cached value, so they're looked up again on the next Load
+	Clear()
+	// Returns usage statistics for the cache
+	Stats() DbCacheStats
+}
+
+// Usage statistics for a DbCache. Hits and misses are counted per value passed to Load.
+type DbCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Number of cached values
+	Size int
 }
 
 type syncDbCache[T comparable] struct {
@@ -37,6 +50,8 @@ type syncDbCache[T comparable] struct {
 	lock    sync.RWMutex
 	storeFn DbStoreFn[T]
 	loadFn  DbLoadFn[T]
+	hits    atomic.Uint64
+	misses  atomic.Uint64
 }
 
 func NewDbCache[T comparable](loadFn DbLoadFn[T], storeFn DbStoreFn[T]) DbCache[T] {
@@ -55,15 +70,24 @@ func (s *syncDbCache[T]) Load(ctx context.Context, values ...[]T) (err error) {
 	defer s.lock.Unlock()
 
 	needed := make(map[T]int32)
+	hits := 0
 	// Gather all needed strings
 	for _, u := range values {
 		for _, v := range u {
 			if _, ok := s.fwd[v]; !ok {
 				needed[v] = 0
+			} else {
+				hits++
 			}
 		}
 	}
+	s.hits.Add(uint64(hits))
+	s.misses.Add(uint64(len(needed)))
 	keys := lo.Keys(needed)
+	// Everything is already cached
+	if len(keys) == 0 {
+		return nil
+	}
 	var dbIds []int32
 	// Query from DB
 	if s.storeFn != nil {
@@ -123,3 +147,16 @@ func (s *syncDbCache[T]) RevGetAll(keys []int32) []T {
 	}
 	return out
 }
+
+func (s *syncDbCache[T]) Clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fwd = make(map[T]int32)
+	s.rev = make(map[int32]T)
+}
+
+func (s *syncDbCache[T]) Stats() DbCacheStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return DbCacheStats{Hits: s.hits.Load(), Misses: s.misses.Load(), Size: len(s.fwd)}
+}
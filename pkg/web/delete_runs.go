@@ -0,0 +1,96 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Error when a play_id is not a valid UUID
+var ErrInvalidPlayId = errors.New("invalid play_id")
+
+// Counts of what was removed by DeleteRuns
+type DeleteRunsResult struct {
+	// Number of parsed runs deleted
+	Runs int64 `json:"runs"`
+	// Number of raw archive rows deleted
+	Archives int64 `json:"archives"`
+	// Number of raw runs deleted from the blob store. With the "segment" backend the data
+	// stays on disk until the segments are next compacted.
+	Files int `json:"files"`
+	// Number of jobs removed from the ingest queue
+	Queued int64 `json:"queued"`
+	// Number of uploads removed from the dead-letter table
+	Failed int64 `json:"failed"`
+	// Number of runs removed from the outbox before they were written to the blob store
+	Outbox int64 `json:"outbox"`
+}
+
+// Deletes runs along with all of their parsed data, raw archive rows, ingest queue jobs,
+// failed uploads and outbox entries in a single transaction. Afterwards the raw runs are removed from blobs,
+// unless blobs is nil.
+func DeleteRuns(ctx context.Context, pool *pgxpool.Pool, blobs blob.BlobStore, playIds []string) (res DeleteRunsResult, err error) {
+	if playIds, err = NormalizePlayIds(playIds); err != nil {
+		return
+	}
+	if len(playIds) == 0 {
+		return
+	}
+	err = pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		var err error
+		// First, since these wait for jobs, retries and blob writes in progress, which may store the runs
+		if res.Queued, err = db.IngestDeleteByPlayId(ctx, playIds); err != nil {
+			return err
+		}
+		if res.Failed, err = db.FailedUploadDeleteByPlayId(ctx, playIds); err != nil {
+			return err
+		}
+		if res.Outbox, err = db.OutboxDeleteByPlayId(ctx, playIds); err != nil {
+			return err
+		}
+		if res.Runs, err = db.DeleteRunsParsed(ctx, playIds); err != nil {
+			return err
+		}
+		res.Archives, err = db.DeleteRunsArchive(ctx, playIds)
+		return err
+	})
+	if err != nil || blobs == nil {
+		return
+	}
+	for _, playId := range playIds {
+		ok, err2 := blobs.Delete(ctx, playId)
+		if ok {
+			res.Files++
+		}
+		if err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return
+}
+
+// Returns the play_ids of all runs uploaded by the user with the given email
+func PlayIdsByUploader(ctx context.Context, db *orm.Queries, uploader string) ([]string, error) {
+	return db.PlayIdsByUploader(ctx, nullString(uploader))
+}
+
+// Checks that all play_ids are valid UUIDs, and converts them to their canonical form.
+// This also makes them safe to use as file names.
+func NormalizePlayIds(playIds []string) ([]string, error) {
+	out := make([]string, len(playIds))
+	for i, v := range playIds {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w - %s", ErrInvalidPlayId, v)
+		}
+		out[i] = id.String()
+	}
+	return out, nil
+}
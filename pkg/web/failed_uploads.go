@@ -0,0 +1,216 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/samber/lo"
+)
+
+// Where an upload failed, stored in FailedUploads.stage
+const (
+	FailedStageStore = "store"
+	FailedStageBatch = "batch"
+	FailedStageQueue = "queue"
+)
+
+// Default number of failed uploads returned by the admin endpoint
+const defaultFailedUploadsLimit = 100
+
+// Error when a failed upload doesn't exist
+var ErrFailedUploadNotFound = errors.New("failed upload not found")
+
+type FailedUploadJson struct {
+	ID       int64     `json:"id"`
+	PlayId   string    `json:"play_id"`
+	Uploader string    `json:"uploader,omitempty"`
+	Stage    string    `json:"stage"`
+	Error    string    `json:"error"`
+	Attempts int32     `json:"attempts"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+type RetryFailedResult struct {
+	// Runs which were added to the database
+	Stored int `json:"stored"`
+	// Runs which had already been added
+	Duplicates int `json:"duplicates"`
+	// Runs which failed again
+	Failed int `json:"failed"`
+}
+
+type retryFailedRequest struct {
+	// Failed uploads to retry, or empty for all of them
+	Ids []int64 `json:"ids"`
+}
+
+// Save an upload which couldn't be added to the database. If the run has failed before,
+// its attempts are increased by attempts.
+func RecordFailedUpload(ctx context.Context, db *orm.Queries, playId string, body []byte, uploader string, stage string, attempts int32, cause error) error {
+	return db.FailedUploadAdd(ctx, orm.FailedUploadAddParams{
+		PlayID:   playId,
+		Body:     pgtype.JSON{Bytes: body, Status: pgtype.Present},
+		Uploader: nullString(uploader),
+		Stage:    stage,
+		Error:    cause.Error(),
+		Attempts: attempts,
+	})
+}
+
+func ListFailedUploads(ctx context.Context, db *orm.Queries, limit int32) ([]FailedUploadJson, error) {
+	rows, err := db.FailedUploadList(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Map(rows, func(r orm.FailedUploadListRow, _ int) FailedUploadJson {
+		return FailedUploadJson{
+			ID:       r.ID,
+			PlayId:   r.PlayID,
+			Uploader: r.Uploader.String,
+			Stage:    r.Stage,
+			Error:    r.Error,
+			Attempts: r.Attempts,
+			Created:  r.Created,
+			Updated:  r.Updated,
+		}
+	}), nil
+}
+
+// Try to write failed uploads again. Uploads which are stored, or turn out to be
+// duplicates, are removed. If ids is empty all failed uploads are retried.
+func RetryFailedUploads(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts PersistOptions, ids []int64) (RetryFailedResult, error) {
+	var res RetryFailedResult
+	params := orm.FailedUploadsForRetryParams{Ids: lo.Ternary(len(ids) == 0, nil, ids), Limit: reconcilePageSize}
+	for {
+		rows, err := orm.New(pool).FailedUploadsForRetry(ctx, params)
+		if err != nil {
+			return res, err
+		}
+		for _, row := range rows {
+			params.AfterID = row.ID
+			if err := retryFailedUpload(ctx, pool, oc, opts, row, &res); err != nil {
+				return res, err
+			}
+		}
+		if len(rows) < int(params.Limit) {
+			return res, nil
+		}
+	}
+}
+
+// Retry a single failed upload, keeping it locked until it's removed or its attempt is
+// recorded. If DeleteRuns removed it first, it's skipped. The run is stored in the same
+// transaction, so only one connection is used.
+func retryFailedUpload(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts PersistOptions, row orm.FailedUploadsForRetryRow, res *RetryFailedResult) error {
+	var pending *PendingBlob
+	err := pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if _, err := db.FailedUploadLock(ctx, row.ID); errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var run RunSchemaJson
+		err := json.Unmarshal(row.Body.Bytes, &run)
+		if err == nil {
+			pending, err = PersistRunTx(ctx, tx, oc.Copy(), opts, &run, row.Body.Bytes, row.Uploader.String)
+		}
+		if err != nil && !errors.Is(err, ErrRunAlreadyUploaded) {
+			res.Failed++
+			return db.FailedUploadRecordAttempt(ctx, orm.FailedUploadRecordAttemptParams{ID: row.ID, Error: err.Error()})
+		}
+		if err == nil {
+			res.Stored++
+		} else {
+			res.Duplicates++
+		}
+		_, err = db.FailedUploadDelete(ctx, row.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pending.Write(ctx, pool)
+	return nil
+}
+
+// Save an upload that failed during a request. Uses a new context so the upload is
+// saved even if the request was cancelled, and only logs errors so the original error
+// is what gets reported.
+func (s *MainController) recordFailedUpload(c *gin.Context, playId string, body []byte, stage string, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := RecordFailedUpload(ctx, orm.New(s.Srv.Pool), playId, body, c.GetString(CtxEmail), stage, 1, cause)
+	if err != nil {
+		log.Printf("failed to record failed upload %s: %v", playId, err)
+	}
+}
+
+// Register dead-letter routes on the group
+func (s *MainController) initFailedUploadRoutes(g *gin.RouterGroup) {
+	g.GET("/failed-uploads", s.listFailedUploads)
+	g.POST("/failed-uploads/retry", s.retryFailedUploads)
+	g.DELETE("/failed-uploads/:id", s.deleteFailedUpload)
+}
+
+// List failed uploads, the "limit" query parameter defaults to 100
+func (s *MainController) listFailedUploads(c *gin.Context) {
+	limit := int64(defaultFailedUploadsLimit)
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.ParseInt(v, 10, 32); err != nil {
+			AbortMsg(c, 400, err)
+			return
+		}
+	}
+	uploads, err := ListFailedUploads(c.Request.Context(), orm.New(s.Srv.Pool), int32(limit))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, gin.H{"failed_uploads": uploads})
+}
+
+func (s *MainController) retryFailedUploads(c *gin.Context) {
+	// An empty body retries everything
+	var req retryFailedRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		AbortMsg(c, 400, err)
+		return
+	}
+	opts := s.persistOptions()
+	res, err := RetryFailedUploads(c.Request.Context(), s.Srv.Pool, s.ormCtx, opts, req.Ids)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, res)
+}
+
+func (s *MainController) deleteFailedUpload(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	n, err := orm.New(s.Srv.Pool).FailedUploadDelete(c.Request.Context(), id)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if n == 0 {
+		AbortMsg(c, 404, ErrFailedUploadNotFound)
+		return
+	}
+	c.JSON(200, gin.H{"message": "deleted"})
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the failed upload of the run, or nil if there isn't one
+func findFailedUpload(t *testing.T, db *orm.Queries, playId string) *FailedUploadJson {
+	uploads, err := ListFailedUploads(context.Background(), db, 10000)
+	require.NoError(t, err)
+	if f, ok := lo.Find(uploads, func(f FailedUploadJson) bool { return f.PlayId == playId }); ok {
+		return &f
+	}
+	return nil
+}
+
+func TestIngestQueueDeadLetter(t *testing.T) {
+	pool := testPool(t, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db := orm.New(pool)
+
+	failing, failingBody := testRun(t, pool)
+	dup, dupBody := testRun(t, pool)
+	cfg := NewConfig().Upload.Async
+	cfg.MaxAttempts = 1
+	q := NewIngestQueue(pool, cfg, func(ctx context.Context, tx pgx.Tx, run *RunSchemaJson, body []byte, uploader string) (*PendingBlob, error) {
+		if run.PlayId == dup.PlayId {
+			return nil, fmt.Errorf("%w - play_id = %s", ErrRunAlreadyUploaded, run.PlayId)
+		}
+		return nil, errors.New("database is down")
+	}, NewMetrics(pool, NewOrmContext(db)))
+	_, err := q.Enqueue(ctx, failing.PlayId.String(), failingBody, "a@b.c")
+	require.NoError(t, err)
+	_, err = q.Enqueue(ctx, dup.PlayId.String(), dupBody, "")
+	require.NoError(t, err)
+	for n := 1; n > 0; {
+		n, err = q.processBatch(ctx)
+		require.NoError(t, err)
+	}
+
+	// Failed runs are kept for retrying, duplicates aren't
+	f := findFailedUpload(t, db, failing.PlayId.String())
+	require.NotNil(t, f)
+	assert.Equal(t, FailedStageQueue, f.Stage)
+	assert.Equal(t, "database is down", f.Error)
+	assert.Equal(t, "a@b.c", f.Uploader)
+	assert.Nil(t, findFailedUpload(t, db, dup.PlayId.String()))
+}
+
+func TestRetryFailedUploads(t *testing.T) {
+	pool := testPool(t, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db := orm.New(pool)
+	oc := NewOrmContext(db)
+	opts := PersistOptions{Store: true}
+
+	stored, storedBody := testRun(t, pool)
+	dup, dupBody := testRun(t, pool)
+	require.NoError(t, PersistRun(ctx, pool, oc.Copy(), opts, dup, dupBody, ""))
+	invalidId := uuid.NewString()
+	invalidBody := []byte(fmt.Sprintf(`{"play_id": %q, "gold": "lots"}`, invalidId))
+	t.Cleanup(func() {
+		DeleteRuns(context.Background(), pool, nil, []string{invalidId})
+	})
+
+	cause := errors.New("failed")
+	var ids []int64
+	for _, r := range []struct {
+		playId string
+		body   []byte
+	}{{stored.PlayId.String(), storedBody}, {dup.PlayId.String(), dupBody}, {invalidId, invalidBody}} {
+		require.NoError(t, RecordFailedUpload(ctx, db, r.playId, r.body, "", FailedStageStore, 1, cause))
+		ids = append(ids, findFailedUpload(t, db, r.playId).ID)
+	}
+
+	res, err := RetryFailedUploads(ctx, pool, oc, opts, ids)
+	require.NoError(t, err)
+	assert.Equal(t, RetryFailedResult{Stored: 1, Duplicates: 1, Failed: 1}, res)
+	exists, err := db.DoesRunExist(ctx, stored.PlayId.String())
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Nil(t, findFailedUpload(t, db, stored.PlayId.String()))
+	assert.Nil(t, findFailedUpload(t, db, dup.PlayId.String()))
+
+	// The invalid run stays, with its new attempt recorded
+	f := findFailedUpload(t, db, invalidId)
+	require.NotNil(t, f)
+	assert.Equal(t, int32(2), f.Attempts)
+	assert.NotEqual(t, cause.Error(), f.Error)
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/samber/lo"
+)
+
+// Postgres channel used to tell servers to clear their string and card caches.
+// Must match the NotifyCacheInvalidate query.
+const CacheInvalidateChannel = "orm_cache_invalidate"
+
+// Kinds of entries returned by ListNewEntries
+const (
+	EntryString = "string"
+	EntryCard   = "card"
+)
+
+// A recently added string or card spec and how many runs use it
+type NewEntryUsage struct {
+	// Either EntryString or EntryCard
+	Kind  string    `json:"kind"`
+	ID    int32     `json:"id"`
+	Value string    `json:"value"`
+	Added time.Time `json:"added"`
+	// Number of runs that reference the entry
+	Runs int64 `json:"runs"`
+	// True if few enough runs use the entry that it may be spam
+	Outlier bool `json:"outlier"`
+}
+
+// Lists strings and card specs added since the given time along with their usage counts.
+// Entries used by outlierRuns runs or fewer are flagged as outliers.
+func ListNewEntries(ctx context.Context, db *orm.Queries, since time.Time, outlierRuns int64) ([]NewEntryUsage, error) {
+	strs, err := db.StrCacheNewUsage(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := db.CardSpecsNewUsage(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]NewEntryUsage, 0, len(strs)+len(cards))
+	for _, v := range strs {
+		out = append(out, NewEntryUsage{
+			Kind: EntryString, ID: v.ID, Value: v.Str, Added: v.Added, Runs: v.Runs,
+			Outlier: v.Runs <= outlierRuns,
+		})
+	}
+	for _, v := range cards {
+		value := v.Card
+		if v.Upgrades > 0 {
+			value = fmt.Sprintf("%s+%d", v.Card, v.Upgrades)
+		}
+		out = append(out, NewEntryUsage{
+			Kind: EntryCard, ID: v.ID, Value: value, Added: v.Added, Runs: v.Runs,
+			Outlier: v.Runs <= outlierRuns,
+		})
+	}
+	return out, nil
+}
+
+type GcStringsOptions struct {
+	// Delete strings and card specs that no run references
+	DeleteUnused bool `json:"delete_unused"`
+	// Only delete entries added at or after this time
+	Since time.Time `json:"since"`
+	// Remove StrCacheNew and CardSpecsNew rows added before this time, zero to skip
+	PruneBefore time.Time `json:"prune_before"`
+}
+
+type GcStringsResult struct {
+	// Number of strings deleted
+	Strings int32 `json:"strings"`
+	// Number of card specs deleted
+	Cards int32 `json:"cards"`
+	// Number of StrCacheNew rows pruned
+	PrunedStrings int64 `json:"pruned_strings"`
+	// Number of CardSpecsNew rows pruned
+	PrunedCards int64 `json:"pruned_cards"`
+}
+
+// Optionally deletes recently added strings and card specs that no run references, and
+// prunes the *New tables, then notifies every server to clear its caches. Deleting waits
+// for uploads in progress, and blocks new ones until it commits, see OrmContext.LockForGc.
+func GcStrings(ctx context.Context, pool *pgxpool.Pool, opts GcStringsOptions) (res GcStringsResult, err error) {
+	err = pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if opts.DeleteUnused {
+			// Wait for uploads which may use the entries we're about to delete
+			if err := db.GcLock(ctx); err != nil {
+				return err
+			}
+			entries, err := ListNewEntries(ctx, db, opts.Since, 0)
+			if err != nil {
+				return err
+			}
+			unused := func(kind string) []int32 {
+				return lo.FilterMap(entries, func(e NewEntryUsage, _ int) (int32, bool) {
+					return e.ID, e.Kind == kind && e.Runs == 0
+				})
+			}
+			if res.Strings, err = db.StrCacheDeleteUnused(ctx, unused(EntryString)); err != nil {
+				return err
+			}
+			if res.Cards, err = db.CardSpecsDeleteUnused(ctx, unused(EntryCard)); err != nil {
+				return err
+			}
+			// Servers which haven't received the notification yet clear their caches on their next upload
+			if res.Strings > 0 || res.Cards > 0 {
+				if err := db.GcNextEpoch(ctx); err != nil {
+					return err
+				}
+			}
+		}
+		var err error
+		if !opts.PruneBefore.IsZero() {
+			if res.PrunedStrings, err = db.PruneStrCacheNew(ctx, opts.PruneBefore); err != nil {
+				return err
+			}
+			if res.PrunedCards, err = db.PruneCardSpecsNew(ctx, opts.PruneBefore); err != nil {
+				return err
+			}
+		}
+		// Delivered when the transaction commits
+		return db.NotifyCacheInvalidate(ctx)
+	})
+	return
+}
+
+// Listens for notifications on CacheInvalidateChannel and clears oc's caches when one
+// arrives. Runs until ctx is cancelled, reconnecting if the connection is lost.
+func ListenCacheInvalidate(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext) {
+	for ctx.Err() == nil {
+		if err := listenCacheInvalidate(ctx, pool, oc); err != nil && ctx.Err() == nil {
+			log.Printf("cache invalidation listener: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+func listenCacheInvalidate(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext) error {
+	pconn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// Take the connection out of the pool so no one else receives the notifications
+	conn := pconn.Hijack()
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+CacheInvalidateChannel); err != nil {
+		return err
+	}
+	// Anything may have changed while we weren't listening
+	oc.Invalidate()
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		oc.Invalidate()
+	}
+}
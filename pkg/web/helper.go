@@ -2,6 +2,7 @@ package web
 
 import (
 	"errors"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -15,6 +16,42 @@ func AbortMsg(c *gin.Context, code int, err error) {
 	c.AbortWithStatusJSON(code, c.Error(err).JSON())
 }
 
+// Aborts with 400, listing every violation if err is a *ValidationError
+func abortInvalid(c *gin.Context, err error) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		c.Error(err)
+		c.AbortWithStatusJSON(400, gin.H{"error": "invalid run", "violations": verr.Violations})
+	} else {
+		AbortMsg(c, 400, err)
+	}
+}
+
+// Reads the whole request body, decompressing it according to Content-Encoding.
+// Aborts with 413 if either the body or the decompressed body is larger than limit bytes
+// (0 for no limit), 415 for an unsupported encoding, or 400 for any other error.
+// Returns false if the request was aborted.
+func readBodyLimited(c *gin.Context, limit int64) ([]byte, bool) {
+	rd := c.Request.Body
+	if limit > 0 {
+		rd = http.MaxBytesReader(c.Writer, rd, limit)
+	}
+	defer rd.Close()
+	body, err := DecodeBody(rd, c.GetHeader("Content-Encoding"), limit)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) || errors.Is(err, ErrDecompressedTooLarge) {
+		AbortMsg(c, 413, err)
+		return nil, false
+	} else if errors.Is(err, ErrUnsupportedEncoding) {
+		AbortMsg(c, 415, err)
+		return nil, false
+	} else if err != nil {
+		c.AbortWithError(400, err)
+		return nil, false
+	}
+	return body, true
+}
+
 // Returns the value of the session key, or an empty string if
 // the value doesn't exist, or is not a string.
 func SessGetString(s sessions.Session, key string) string {
@@ -111,3 +148,8 @@ func SetAdd[T comparable](st map[T]bool, values ...T) {
 		st[v] = true
 	}
 }
+
+// Returns true if err was caused by inserting a run whose play_id already exists.
+func IsDuplicateRunErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "\"runsdata_play_id_key\"")
+}
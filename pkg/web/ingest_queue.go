@@ -0,0 +1,328 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Status of a job in the ingest queue, matches IngestQueue.status
+type IngestStatus int16
+
+const (
+	IngestQueued  IngestStatus = 0
+	IngestRunning IngestStatus = 1
+	IngestDone    IngestStatus = 2
+	IngestFailed  IngestStatus = 3
+)
+
+func (s IngestStatus) String() string {
+	switch s {
+	case IngestQueued:
+		return "queued"
+	case IngestRunning:
+		return "running"
+	case IngestDone:
+		return "done"
+	case IngestFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int16(s))
+	}
+}
+
+func (s IngestStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Error when too many uploads are waiting to be processed
+var ErrQueueFull = errors.New("upload queue is full, try again later")
+
+// Error when a job id doesn't exist
+var ErrJobNotFound = errors.New("job not found")
+
+// Error when a job was abandoned by a worker on every attempt, probably because it crashes the server
+var ErrJobAbandoned = errors.New("job was abandoned too many times")
+
+// Longest delay between retries of a job
+const maxRetryDelay = time.Hour
+
+// How often stale jobs are queued again and old jobs are removed
+const ingestMaintainInterval = time.Minute
+
+// Function which writes a parsed run and its raw body inside tx, see PersistRunTx
+type StoreRunFunc func(ctx context.Context, tx pgx.Tx, run *RunSchemaJson, body []byte, uploader string) (*PendingBlob, error)
+
+// Connections left for requests and cache loads while every worker holds one
+const ingestPoolHeadroom = 2
+
+// Queue of uploads stored in the database, and the workers which process them
+type IngestQueue struct {
+	pool    *pgxpool.Pool
+	cfg     ConfigAsync
+	store   StoreRunFunc
+	metrics *Metrics
+	// Wakes an idle worker when a job is added
+	wake chan struct{}
+}
+
+type IngestJobJson struct {
+	// Token returned when the job was queued
+	Token    string       `json:"token"`
+	PlayId   string       `json:"play_id"`
+	Status   IngestStatus `json:"status"`
+	Attempts int32        `json:"attempts"`
+	Error    string       `json:"error,omitempty"`
+	Created  time.Time    `json:"created"`
+	Updated  time.Time    `json:"updated"`
+}
+
+func NewIngestQueue(pool *pgxpool.Pool, cfg ConfigAsync, store StoreRunFunc, metrics *Metrics) *IngestQueue {
+	return &IngestQueue{
+		pool:    pool,
+		cfg:     cfg,
+		store:   store,
+		metrics: metrics,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Add a raw upload to the queue, returning a random token to check its status with.
+// Returns ErrQueueFull if too many jobs are waiting, or ErrRunAlreadyUploaded if the
+// run is already queued.
+func (q *IngestQueue) Enqueue(ctx context.Context, playId string, body []byte, uploader string) (string, error) {
+	db := orm.New(q.pool)
+	if q.cfg.MaxPending > 0 {
+		pending, err := db.IngestPendingCount(ctx)
+		if err != nil {
+			return "", err
+		}
+		if pending >= int64(q.cfg.MaxPending) {
+			return "", ErrQueueFull
+		}
+	}
+	token := uuid.NewString()
+	_, err := db.IngestEnqueue(ctx, orm.IngestEnqueueParams{
+		PlayID:   playId,
+		Token:    token,
+		Body:     pgtype.JSON{Bytes: body, Status: pgtype.Present},
+		Uploader: nullString(uploader),
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+		return "", fmt.Errorf("%w - play_id = %s", ErrRunAlreadyUploaded, playId)
+	} else if err != nil {
+		return "", err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return token, nil
+}
+
+// Returns the status of the job with the token returned by Enqueue, or ErrJobNotFound
+func (q *IngestQueue) Status(ctx context.Context, token string) (IngestJobJson, error) {
+	row, err := orm.New(q.pool).IngestStatus(ctx, token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return IngestJobJson{}, ErrJobNotFound
+	} else if err != nil {
+		return IngestJobJson{}, err
+	}
+	return IngestJobJson{
+		Token:    row.Token,
+		PlayId:   row.PlayID,
+		Status:   IngestStatus(row.Status),
+		Attempts: row.Attempts,
+		Error:    row.LastError.String,
+		Created:  row.Created,
+		Updated:  row.Updated,
+	}, nil
+}
+
+// Checks that the pool has a connection for each worker, plus ingestPoolHeadroom
+func CheckIngestPoolSize(pool *pgxpool.Pool, cfg ConfigAsync) error {
+	need := cfg.Workers + ingestPoolHeadroom
+	if have := int(pool.Config().MaxConns); have < need {
+		return fmt.Errorf("%d async workers need at least %d database connections, but the pool has %d, set pool_max_conns in %s",
+			cfg.Workers, need, have, EnvPostgresConn)
+	}
+	return nil
+}
+
+// Runs the workers until ctx is cancelled. Jobs being processed when ctx is cancelled
+// are queued again once they're considered stale.
+func (q *IngestQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.worker(ctx)
+		}()
+	}
+	q.maintain(ctx)
+	wg.Wait()
+}
+
+func (q *IngestQueue) worker(ctx context.Context) {
+	poll := time.Duration(q.cfg.PollInterval) * time.Second
+	for ctx.Err() == nil {
+		n, err := q.processBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ingest queue: %v", err)
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Claim and process up to BatchSize jobs, returning the number claimed
+func (q *IngestQueue) processBatch(ctx context.Context) (int, error) {
+	jobs, err := orm.New(q.pool).IngestClaim(ctx, int32(q.cfg.BatchSize))
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		if err := q.process(ctx, job); err != nil {
+			return len(jobs), err
+		}
+	}
+	return len(jobs), nil
+}
+
+// Store a single job and record its result. Only returns an error if the result couldn't be recorded.
+//
+// The job is locked until its result is recorded, so DeleteRuns waits for it rather than
+// the run being stored after it's deleted. If DeleteRuns removed the job first, it's skipped.
+// The run is stored in the same transaction, so each worker only uses one connection.
+func (q *IngestQueue) process(ctx context.Context, job orm.IngestClaimRow) error {
+	var pending *PendingBlob
+	err := q.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := orm.New(tx).IngestLock(ctx, job.ID); errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var err error
+		pending, err = q.processLocked(ctx, tx, job)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pending.Write(ctx, q.pool)
+	return nil
+}
+
+func (q *IngestQueue) processLocked(ctx context.Context, tx pgx.Tx, job orm.IngestClaimRow) (*PendingBlob, error) {
+	db := orm.New(tx)
+	var run RunSchemaJson
+	if err := json.Unmarshal(job.Body.Bytes, &run); err != nil {
+		q.metrics.RecordUpload(UploadInvalid)
+		return nil, q.fail(ctx, db, job, err)
+	}
+	pending, err := q.store(ctx, tx, &run, job.Body.Bytes, job.Uploader.String)
+	switch {
+	case err == nil:
+		q.metrics.RecordUpload(UploadStored)
+		return pending, db.IngestDone(ctx, job.ID)
+	case errors.Is(err, ErrRunAlreadyUploaded):
+		q.metrics.RecordUpload(UploadDuplicate)
+		return nil, q.fail(ctx, db, job, err)
+	case ctx.Err() != nil:
+		// Shutting down, the job will be queued again once it's stale
+		return nil, nil
+	case int(job.Attempts) < q.cfg.MaxAttempts:
+		return nil, db.IngestRetry(ctx, orm.IngestRetryParams{
+			LastError: nullString(err.Error()),
+			DelaySecs: retryDelay(q.cfg.RetryDelay, job.Attempts).Seconds(),
+			ID:        job.ID,
+		})
+	default:
+		q.metrics.RecordUpload(UploadDbError)
+		return nil, q.fail(ctx, db, job, err)
+	}
+}
+
+// Mark the job as permanently failed, dropping its body. Unless the run was a duplicate,
+// the body is kept in FailedUploads so it can be retried.
+func (q *IngestQueue) fail(ctx context.Context, db *orm.Queries, job orm.IngestClaimRow, err error) error {
+	log.Printf("ingest queue: job %d (play_id = %s) failed: %v", job.ID, job.PlayID, err)
+	if !errors.Is(err, ErrRunAlreadyUploaded) {
+		// If this fails the job is left running, so it's tried again once it's stale
+		err2 := RecordFailedUpload(ctx, db, job.PlayID, job.Body.Bytes, job.Uploader.String, FailedStageQueue, job.Attempts, err)
+		if err2 != nil {
+			return fmt.Errorf("recording failed upload %s: %w", job.PlayID, err2)
+		}
+	}
+	return db.IngestFail(ctx, orm.IngestFailParams{ID: job.ID, LastError: nullString(err.Error())})
+}
+
+// Periodically queue abandoned jobs again, fail those which have been abandoned too many
+// times, and remove old finished jobs
+func (q *IngestQueue) maintain(ctx context.Context) {
+	ticker := time.NewTicker(ingestMaintainInterval)
+	defer ticker.Stop()
+	for {
+		db := orm.New(q.pool)
+		stale := orm.IngestRequeueStaleParams{MaxAttempts: int32(q.cfg.MaxAttempts), AgeSecs: float64(q.cfg.StaleAfter)}
+		if n, err := db.IngestRequeueStale(ctx, stale); err != nil && ctx.Err() == nil {
+			log.Printf("ingest queue: %v", err)
+		} else if n > 0 {
+			log.Printf("ingest queue: requeued %d stale jobs", n)
+		}
+		failed, err := db.IngestFailStale(ctx, orm.IngestFailStaleParams{
+			MaxAttempts: stale.MaxAttempts,
+			AgeSecs:     stale.AgeSecs,
+			LastError:   nullString(ErrJobAbandoned.Error()),
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ingest queue: %v", err)
+		}
+		for _, job := range failed {
+			log.Printf("ingest queue: job %d (play_id = %s) failed: %v", job.ID, job.PlayID, ErrJobAbandoned)
+			err := RecordFailedUpload(ctx, db, job.PlayID, job.Body.Bytes, job.Uploader.String, FailedStageQueue, job.Attempts, ErrJobAbandoned)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("ingest queue: failed to record failed upload %s: %v", job.PlayID, err)
+			}
+		}
+		if _, err := db.IngestPruneFinished(ctx, float64(q.cfg.KeepDone)*3600); err != nil && ctx.Err() == nil {
+			log.Printf("ingest queue: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delay before the next attempt, doubling after each attempt up to maxRetryDelay
+func retryDelay(baseSecs int, attempts int32) time.Duration {
+	d := time.Duration(baseSecs) * time.Second
+	for i := int32(1); i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
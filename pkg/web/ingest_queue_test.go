@@ -0,0 +1,118 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Connects to the database in POSTGRES_CONN, which must have the schema in sql/ applied,
+// with at most maxConns connections. Skips the test if POSTGRES_CONN isn't set.
+func testPool(t *testing.T, maxConns int32) *pgxpool.Pool {
+	godotenv.Load("../../.env")
+	conn := os.Getenv(EnvPostgresConn)
+	if conn == "" {
+		t.Skip(EnvPostgresConn + " is not set")
+	}
+	pool, err := ConnectPool(context.Background(), conn, func(c *pgxpool.Config) {
+		c.MaxConns = maxConns
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// Returns a valid run with a new play_id, and its body. The run is deleted when the test ends.
+func testRun(t *testing.T, pool *pgxpool.Pool) (*RunSchemaJson, []byte) {
+	m := validRunMap()
+	m["play_id"] = uuid.NewString()
+	body, err := json.Marshal(m)
+	require.NoError(t, err)
+	var run RunSchemaJson
+	require.NoError(t, ParseRun(body, &run))
+	t.Cleanup(func() {
+		DeleteRuns(context.Background(), pool, nil, []string{run.PlayId.String()})
+	})
+	return &run, body
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 10*time.Second, retryDelay(10, 1))
+	assert.Equal(t, 20*time.Second, retryDelay(10, 2))
+	assert.Equal(t, 80*time.Second, retryDelay(10, 4))
+	assert.Equal(t, maxRetryDelay, retryDelay(10, 100))
+	assert.Equal(t, time.Duration(0), retryDelay(0, 3))
+}
+
+func TestIngestStatusJson(t *testing.T) {
+	b, err := IngestJobJson{Status: IngestFailed}.Status.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", string(b))
+	assert.Equal(t, "unknown(9)", IngestStatus(9).String())
+}
+
+func TestCheckIngestPoolSize(t *testing.T) {
+	cfg, err := pgxpool.ParseConfig("postgres://localhost/test?pool_max_conns=5")
+	require.NoError(t, err)
+	cfg.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), cfg)
+	require.NoError(t, err)
+	defer pool.Close()
+	assert.NoError(t, CheckIngestPoolSize(pool, ConfigAsync{Workers: 3}))
+	assert.ErrorContains(t, CheckIngestPoolSize(pool, ConfigAsync{Workers: 4}), "at least 6")
+}
+
+// Every worker processing a job at once mustn't need more connections than there are workers
+func TestIngestQueueConnPerWorker(t *testing.T) {
+	const workers = 4
+	pool := testPool(t, workers)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	oc := NewOrmContext(orm.New(pool))
+	opts := PersistOptions{Store: true, ArchiveDb: true}
+
+	// Store a run first so every string is cached, since cache misses use their own connection
+	run, body := testRun(t, pool)
+	require.NoError(t, PersistRun(ctx, pool, oc.Copy(), opts, run, body, ""))
+
+	cfg := NewConfig().Upload.Async
+	cfg.Workers = workers
+	cfg.BatchSize = 1
+	q := NewIngestQueue(pool, cfg, func(ctx context.Context, tx pgx.Tx, run *RunSchemaJson, body []byte, uploader string) (*PendingBlob, error) {
+		return PersistRunTx(ctx, tx, oc.Copy(), opts, run, body, uploader)
+	}, NewMetrics(pool, oc))
+	tokens := make([]string, workers)
+	for i := range tokens {
+		run, body := testRun(t, pool)
+		token, err := q.Enqueue(ctx, run.PlayId.String(), body, "")
+		require.NoError(t, err)
+		tokens[i] = token
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := q.processBatch(ctx)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	for _, token := range tokens {
+		job, err := q.Status(ctx, token)
+		require.NoError(t, err)
+		assert.Equal(t, IngestDone, job.Status, job.Error)
+	}
+}
@@ -234,8 +234,34 @@ func (s RunSchemaJson) getMinimalStrings() []string {
 	return []string{s.BuildVersion, s.CharacterChosen, s.KilledBy, s.NeowBonus, s.NeowCost}
 }
 
-// Add this Run to the database. Returns the rowid of the run.
+// Add every string and card referenced by this run to oc.StringSet and oc.CardSet,
+// so they can be loaded into the caches in bulk with OrmContext.LoadSets.
+func (r *RunSchemaJson) Preload(oc *OrmContext) {
+	SetAdd(oc.StringSet, r.getMinimalStrings()...)
+	SetAdd(oc.StringSet, r.DailyMods...)
+	SetAdd(oc.StringSet, r.Relics...)
+	PreloadArray(oc, r.BossRelics)
+	PreloadArray(oc, r.CampfireChoices)
+	PreloadArray(oc, r.parseCardChoices(oc))
+	PreloadArray(oc, r.DamageTaken)
+	PreloadArray(oc, r.EventChoices)
+	PreloadArray(oc, r.PotionsObtained)
+	PreloadArray(oc, r.RelicsObtained)
+	SetAdd(oc.CardSet, StringsToCards(r.ItemsPurchased)...)
+	SetAdd(oc.CardSet, StringsToCards(r.ItemsPurged)...)
+	SetAdd(oc.CardSet, StringsToCards(r.MasterDeck)...)
+}
+
+func (r *RunSchemaJson) parseCardChoices(oc *OrmContext) []CardChoiceParsed {
+	return MapToOrm[CardChoiceParsed](oc, CastSlice[ConvToOrm](r.CardChoices))
+}
+
+// Add this Run to the database. Returns the rowid of the run. db must be a transaction,
+// see OrmContext.LockForGc.
 func (r *RunSchemaJson) AddToDb(ctx context.Context, oc *OrmContext, db *orm.Queries) (runId int32, err error) {
+	if err = oc.LockForGc(ctx, db); err != nil {
+		return
+	}
 	// Pre-load a few strings so we can add the run with valid references
 	// Note that this MAY cause us to add strings we don't use if the play_id is a duplicate.
 	if err = oc.Sc.Load(ctx, r.getMinimalStrings()); err != nil {
@@ -248,30 +274,18 @@ func (r *RunSchemaJson) AddToDb(ctx context.Context, oc *OrmContext, db *orm.Que
 	}
 	oc.Runid = runId
 
-	// Gather preload data
-	PreloadArray(oc, r.BossRelics)
-	PreloadArray(oc, r.CampfireChoices)
-	parsedCards := MapToOrm[CardChoiceParsed](oc, CastSlice[ConvToOrm](r.CardChoices))
-	PreloadArray(oc, parsedCards)
-	PreloadArray(oc, r.DamageTaken)
-	PreloadArray(oc, r.EventChoices)
-	PreloadArray(oc, r.PotionsObtained)
-	PreloadArray(oc, r.RelicsObtained)
+	// Gather and cache all strings and CardSpecs
+	r.Preload(oc)
+	if err = oc.LoadSets(ctx); err != nil {
+		return
+	}
+	parsedCards := r.parseCardChoices(oc)
 	// Parse items purchased + purged
 	specsPurchased := StringsToCards(r.ItemsPurchased)
 	specsPurged := StringsToCards(r.ItemsPurged)
 	// Parse deck
 	specsDeck := StringsToCards(r.MasterDeck)
 
-	// Cache strings
-	if err = oc.Sc.Load(ctx, r.DailyMods, r.Relics, lo.Keys(oc.StringSet)); err != nil {
-		return
-	}
-	// Cache CardSpecs
-	if err = oc.Cc.Load(ctx, specsPurchased, specsPurged, specsDeck, lo.Keys(oc.CardSet)); err != nil {
-		return
-	}
-
 	// Add items purchased
 	itemsPurchased := make([]orm.AddItemsPurchasedParams, len(specsPurchased))
 	for i, v := range r.ItemPurchaseFloors {
@@ -408,7 +422,7 @@ var pathToMapFwd = map[string]string{
 var pathToMapRev = lo.Invert(pathToMapFwd)
 
 func pathToStringFwd(ar []string) string {
-	out := make([]string, len(ar))
+	out := make([]string, 0, len(ar))
 	for _, toS := range ar {
 		var ch string
 		if len(toS) == 1 {
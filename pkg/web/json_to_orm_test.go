@@ -0,0 +1,38 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The round-trip verifier compares RunToJson against the uploaded JSON, so the stored
+// paths must decode to exactly what was uploaded.
+func TestPathToString(t *testing.T) {
+	cases := []struct {
+		path string
+		enc  string
+	}{
+		{`["M","?","BOSS","E","NEOW","$"]`, "M?BE,NEOW,$"},
+		// Unknown nodes next to each other and at either end
+		{`["NEOW","SHOP","M","T"]`, ",NEOW,,SHOP,MT"},
+		{`["M","NEOW"]`, "M,NEOW,"},
+		// Floors without a room are null in path_per_floor
+		{`["M",null,"BOSS",null]`, "M\x1BB\x1B"},
+		// An empty path is [] rather than null
+		{`[]`, ""},
+	}
+	for _, c := range cases {
+		var path []FloorPath
+		require.NoError(t, json.Unmarshal([]byte(c.path), &path))
+		enc := pathToStringFwd(lo.Map(path, func(v FloorPath, _ int) string { return DeNull(v) }))
+		assert.Equal(t, c.enc, enc)
+		dec := lo.Map(pathToStringRev(enc), func(v string, _ int) FloorPath { return ReNull(v) })
+		out, err := json.Marshal(dec)
+		require.NoError(t, err)
+		assert.JSONEq(t, c.path, string(out), c.path)
+	}
+}
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+const (
+	// Default number of runs returned per page
+	listRunsDefaultLimit = 50
+	// Maximum number of runs returned per page
+	listRunsMaxLimit = 500
+)
+
+// Error when the cursor token can't be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query parameters for the run listing route
+type ListRunsQuery struct {
+	Character    string `form:"character"`
+	MinAscension *int32 `form:"min_ascension"`
+	MaxAscension *int32 `form:"max_ascension"`
+	Victory      *bool  `form:"victory"`
+	BuildVersion string `form:"build_version"`
+	MinFloor     *int32 `form:"min_floor"`
+	MaxFloor     *int32 `form:"max_floor"`
+	// Start date (inclusive) in RFC3339 or YYYY-MM-DD format
+	Since string `form:"since"`
+	// End date (exclusive) in RFC3339 or YYYY-MM-DD format
+	Until string `form:"until"`
+	// Comma-separated list of flags, runs must have all of them
+	Flags string `form:"flags"`
+	// Cursor token from a previous page
+	Cursor string `form:"cursor"`
+	// Page size
+	Limit int32 `form:"limit"`
+}
+
+// Summary of a run, as returned by the run listing route
+type RunSummary struct {
+	PlayId         string     `json:"play_id"`
+	Character      string     `json:"character"`
+	AscensionLevel int32      `json:"ascension_level"`
+	Victory        bool       `json:"victory"`
+	BuildVersion   string     `json:"build_version"`
+	FloorReached   int32      `json:"floor_reached"`
+	Score          int32      `json:"score"`
+	Playtime       int32      `json:"playtime"`
+	Timestamp      *time.Time `json:"timestamp"`
+	Added          time.Time  `json:"added"`
+	Flags          []string   `json:"flags"`
+}
+
+// List runs matching the query parameters, newest first. If there are more results,
+// the response includes a "next" cursor token which can be passed as "cursor"
+// to get the next page.
+func (s *MainController) ListRuns(c *gin.Context) {
+	ctx := c.Request.Context()
+	db := orm.New(s.Srv.Pool)
+
+	var query ListRunsQuery
+	if err := c.BindQuery(&query); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	params, err := query.ToParams()
+	if err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	limit := params.RowLimit
+	// Fetch one extra row to know if there's another page
+	params.RowLimit++
+	rows, err := db.ListRuns(ctx, params)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	res := gin.H{}
+	if len(rows) > int(limit) {
+		rows = rows[:limit]
+		res["next"] = EncodeCursor(rows[len(rows)-1].ID)
+	}
+	res["runs"] = lo.Map(rows, func(r orm.ListRunsRow, _ int) RunSummary {
+		return RunSummary{
+			PlayId:         r.PlayID,
+			Character:      r.Character,
+			AscensionLevel: r.AscensionLevel,
+			Victory:        r.Victory,
+			BuildVersion:   r.BuildVersion,
+			FloorReached:   r.FloorReached,
+			Score:          r.Score,
+			Playtime:       r.Playtime,
+			Timestamp:      lo.Ternary[*time.Time](r.Timestamp.Valid, &r.Timestamp.Time, nil),
+			Added:          r.Added,
+			Flags:          r.Flags,
+		}
+	})
+	c.JSON(200, res)
+}
+
+// Convert the query into database parameters
+func (q *ListRunsQuery) ToParams() (p orm.ListRunsParams, err error) {
+	p.AfterID = math.MaxInt32
+	if q.Cursor != "" {
+		if p.AfterID, err = DecodeCursor(q.Cursor); err != nil {
+			return
+		}
+	}
+	p.RowLimit = q.Limit
+	if p.RowLimit <= 0 {
+		p.RowLimit = listRunsDefaultLimit
+	} else if p.RowLimit > listRunsMaxLimit {
+		p.RowLimit = listRunsMaxLimit
+	}
+	p.Character = nullString(q.Character)
+	p.BuildVersion = nullString(q.BuildVersion)
+	p.MinAscension = nullInt32(q.MinAscension)
+	p.MaxAscension = nullInt32(q.MaxAscension)
+	p.MinFloor = nullInt32(q.MinFloor)
+	p.MaxFloor = nullInt32(q.MaxFloor)
+	if q.Victory != nil {
+		p.Victory = sql.NullBool{Bool: *q.Victory, Valid: true}
+	}
+	if p.Since, err = parseDateParam(q.Since); err != nil {
+		return
+	}
+	if p.Until, err = parseDateParam(q.Until); err != nil {
+		return
+	}
+	if q.Flags != "" {
+		p.Flags = strings.Split(q.Flags, ",")
+	}
+	return
+}
+
+// Encode a run ID as an opaque cursor token
+func EncodeCursor(id int32) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(int64(id), 10)))
+}
+
+// Decode a cursor token created by EncodeCursor
+func DecodeCursor(cursor string) (int32, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(string(b), 10, 32)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return int32(id), nil
+}
+
+// Parse a date in either RFC3339 or YYYY-MM-DD format, returning NULL if s is empty.
+func parseDateParam(s string) (sql.NullTime, error) {
+	if s == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", s); err != nil {
+			return sql.NullTime{}, err
+		}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt32(v *int32) sql.NullInt32 {
+	if v == nil {
+		return sql.NullInt32{}
+	}
+	return sql.NullInt32{Int32: *v, Valid: true}
+}
@@ -0,0 +1,221 @@
+package web
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "stsms"
+
+// Outcome of a single uploaded run, used as a metric label
+type UploadOutcome string
+
+const (
+	UploadStored      UploadOutcome = "stored"
+	UploadDuplicate   UploadOutcome = "duplicate"
+	UploadInvalid     UploadOutcome = "invalid"
+	UploadRateLimited UploadOutcome = "rate_limited"
+	UploadDbError     UploadOutcome = "db_error"
+	// Queued runs are counted again with their final outcome once processed
+	UploadQueued UploadOutcome = "queued"
+)
+
+// Maps each batch status to its upload outcome
+var batchOutcomes = map[BatchStatus]UploadOutcome{
+	BatchStored:    UploadStored,
+	BatchDuplicate: UploadDuplicate,
+	BatchInvalid:   UploadInvalid,
+	BatchError:     UploadDbError,
+}
+
+// Prometheus metrics for the server
+type Metrics struct {
+	Registry    *prometheus.Registry
+	uploads     *prometheus.CounterVec
+	stages      *prometheus.HistogramVec
+	proxyErrors prometheus.Counter
+}
+
+// Create and register all server metrics. pool and oc are read each time metrics are collected.
+func NewMetrics(pool *pgxpool.Pool, oc *OrmContext) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploads_total",
+			Help:      "Number of uploaded runs by outcome.",
+		}, []string{"outcome"}),
+		stages: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_stage_seconds",
+			Help:      "Time spent in each stage of handling an upload.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"stage"}),
+		proxyErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stats_proxy_errors_total",
+			Help:      "Number of requests the stats reverse proxy failed to forward.",
+		}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.uploads,
+		m.stages,
+		m.proxyErrors,
+		&cacheCollector{oc: oc},
+		&poolCollector{pool: pool},
+	)
+	return m
+}
+
+// Gin handler that serves the metrics in Prometheus text format
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+}
+
+func (m *Metrics) RecordUpload(outcome UploadOutcome) {
+	m.uploads.WithLabelValues(string(outcome)).Inc()
+}
+
+// Records how long the stage took, starting from start
+func (m *Metrics) RecordStage(stage string, start time.Time) {
+	m.stages.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// Wraps h so its run time is recorded as stage. Returns nil if h is nil, for use with HandlerChain.
+func (m *Metrics) Timed(stage string, h gin.HandlerFunc) gin.HandlerFunc {
+	if h == nil {
+		return nil
+	}
+	return func(c *gin.Context) {
+		defer m.RecordStage(stage, time.Now())
+		h(c)
+	}
+}
+
+// Handler for the single upload route that records its outcome once the rest of the chain is done
+func (m *Metrics) CountUpload(c *gin.Context) {
+	c.Next()
+	status := c.Writer.Status()
+	switch {
+	case status == http.StatusAccepted:
+		m.RecordUpload(UploadQueued)
+	case status < 300:
+		m.RecordUpload(UploadStored)
+	case status == http.StatusTooManyRequests, status == http.StatusServiceUnavailable:
+		m.RecordUpload(UploadRateLimited)
+	case hasError(c.Errors, ErrRunAlreadyUploaded):
+		m.RecordUpload(UploadDuplicate)
+	case status < 500:
+		m.RecordUpload(UploadInvalid)
+	default:
+		m.RecordUpload(UploadDbError)
+	}
+}
+
+// Error handler for the stats reverse proxy
+func (m *Metrics) ProxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	m.proxyErrors.Inc()
+	log.Printf("stats proxy: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// Returns true if any error in errs wraps target
+func hasError(errs []*gin.Error, target error) bool {
+	for _, e := range errs {
+		if errors.Is(e.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc(metricsNamespace+"_cache_hits_total",
+		"Number of values found in the cache.", []string{"cache"}, nil)
+	cacheMissesDesc = prometheus.NewDesc(metricsNamespace+"_cache_misses_total",
+		"Number of values that had to be loaded from the database.", []string{"cache"}, nil)
+	cacheSizeDesc = prometheus.NewDesc(metricsNamespace+"_cache_entries",
+		"Number of values in the cache.", []string{"cache"}, nil)
+)
+
+// Reports DbCache statistics for the string and card caches
+type cacheCollector struct {
+	oc *OrmContext
+}
+
+func (cc *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheSizeDesc
+}
+
+func (cc *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, stats := range map[string]DbCacheStats{"string": cc.oc.Sc.Stats(), "card": cc.oc.Cc.Stats()} {
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Size), name)
+	}
+}
+
+var (
+	poolAcquiredDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_acquired_conns",
+		"Number of connections currently in use.", nil, nil)
+	poolIdleDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_idle_conns",
+		"Number of idle connections.", nil, nil)
+	poolTotalDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_total_conns",
+		"Number of open connections.", nil, nil)
+	poolMaxDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_max_conns",
+		"Maximum number of connections.", nil, nil)
+	poolAcquireCountDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_acquires_total",
+		"Number of successful connection acquires.", nil, nil)
+	poolAcquireDurationDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_acquire_seconds_total",
+		"Total time spent acquiring connections.", nil, nil)
+	poolEmptyAcquireDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_empty_acquires_total",
+		"Number of acquires that had to wait for a connection.", nil, nil)
+	poolCanceledAcquireDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_canceled_acquires_total",
+		"Number of acquires canceled by their context.", nil, nil)
+)
+
+// Reports pgxpool statistics
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredDesc
+	ch <- poolIdleDesc
+	ch <- poolTotalDesc
+	ch <- poolMaxDesc
+	ch <- poolAcquireCountDesc
+	ch <- poolAcquireDurationDesc
+	ch <- poolEmptyAcquireDesc
+	ch <- poolCanceledAcquireDesc
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	st := pc.pool.Stat()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge(poolAcquiredDesc, float64(st.AcquiredConns()))
+	gauge(poolIdleDesc, float64(st.IdleConns()))
+	gauge(poolTotalDesc, float64(st.TotalConns()))
+	gauge(poolMaxDesc, float64(st.MaxConns()))
+	counter(poolAcquireCountDesc, float64(st.AcquireCount()))
+	counter(poolAcquireDurationDesc, st.AcquireDuration().Seconds())
+	counter(poolEmptyAcquireDesc, float64(st.EmptyAcquireCount()))
+	counter(poolCanceledAcquireDesc, float64(st.CanceledAcquireCount()))
+}
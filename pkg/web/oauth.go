@@ -0,0 +1,297 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// Session keys used by the login flow
+const (
+	// Email of the logged in user
+	SessEmail = "email"
+	// Random state for the login in progress
+	sessOAuthState = "oauth_state"
+	// Provider for the login in progress
+	sessOAuthProvider = "oauth_provider"
+	// Where to go after the login completes
+	sessOAuthRedirect = "oauth_redirect"
+)
+
+// Error when the login provider isn't configured
+var ErrUnknownProvider = errors.New("unknown login provider")
+
+// Error when the callback state doesn't match the session
+var ErrOAuthState = errors.New("invalid oauth state")
+
+// Error when the provider doesn't return a verified email
+var ErrNoEmail = errors.New("no verified email returned by provider")
+
+// Handles login through OAuth2 and OIDC providers, storing the user's email in the session.
+type OAuthLogin struct {
+	providers map[string]*oauthProvider
+	// Full URL of the callback route
+	callbackUrl string
+	// Where to redirect after login/logout when no other location is given
+	home string
+}
+
+type oauthProvider struct {
+	cfg ConfigOAuthProvider
+	// Guards discovery, so a failed discovery is retried on the next login
+	mu          sync.Mutex
+	oc          *oauth2.Config
+	userInfoUrl string
+}
+
+// Subset of the OIDC discovery document we care about
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// Creates the login handler. callbackUrl is the full URL of the callback route,
+// and home is where users are sent after logging in or out.
+func NewOAuthLogin(cfg ConfigOAuth, callbackUrl string, home string) *OAuthLogin {
+	o := &OAuthLogin{
+		providers:   make(map[string]*oauthProvider),
+		callbackUrl: callbackUrl,
+		home:        home,
+	}
+	for name, pcfg := range cfg.Providers {
+		if pcfg.ClientSecret == "" {
+			pcfg.ClientSecret = os.Getenv("OAUTH_" + strings.ToUpper(name) + "_SECRET")
+		}
+		if name == "github" && pcfg.Issuer == "" && pcfg.AuthUrl == "" {
+			pcfg.AuthUrl = github.Endpoint.AuthURL
+			pcfg.TokenUrl = github.Endpoint.TokenURL
+			pcfg.UserInfoUrl = "https://api.github.com/user/emails"
+			if pcfg.Scopes == nil {
+				pcfg.Scopes = []string{"user:email"}
+			}
+		}
+		o.providers[name] = &oauthProvider{cfg: pcfg}
+	}
+	return o
+}
+
+// Register the login, logout and callback routes on the group
+func (o *OAuthLogin) Init(g *gin.RouterGroup) {
+	g.GET("/login", o.login)
+	g.GET("/logout", o.logout)
+	g.GET("/callback", o.callback)
+}
+
+// Redirect to the provider's login page
+func (o *OAuthLogin) login(c *gin.Context) {
+	p, ok := o.providers[c.Query("provider")]
+	if !ok {
+		AbortMsg(c, 404, ErrUnknownProvider)
+		return
+	}
+	oc, _, err := p.config(c.Request.Context(), o.callbackUrl)
+	if err != nil {
+		c.AbortWithError(502, err)
+		return
+	}
+	state, err := randomState()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	sess := sessions.Default(c)
+	sess.Set(sessOAuthState, state)
+	sess.Set(sessOAuthProvider, c.Query("provider"))
+	sess.Set(sessOAuthRedirect, o.safeRedirect(c.Query("redirect")))
+	if err := sess.Save(); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Redirect(302, oc.AuthCodeURL(state))
+}
+
+// Exchange the code for a token, look up the user's email and store it in the session
+func (o *OAuthLogin) callback(c *gin.Context) {
+	ctx := c.Request.Context()
+	sess := sessions.Default(c)
+	state := SessGetString(sess, sessOAuthState)
+	if state == "" || c.Query("state") != state {
+		AbortMsg(c, 400, ErrOAuthState)
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		AbortMsg(c, 401, fmt.Errorf("login failed - %s", e))
+		return
+	}
+	p, ok := o.providers[SessGetString(sess, sessOAuthProvider)]
+	if !ok {
+		AbortMsg(c, 400, ErrUnknownProvider)
+		return
+	}
+	oc, userInfoUrl, err := p.config(ctx, o.callbackUrl)
+	if err != nil {
+		c.AbortWithError(502, err)
+		return
+	}
+	tok, err := oc.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		AbortMsg(c, 401, err)
+		return
+	}
+	email, err := fetchEmail(ctx, oc.Client(ctx, tok), userInfoUrl)
+	if err != nil {
+		AbortMsg(c, 401, err)
+		return
+	}
+	redirect := SessGetString(sess, sessOAuthRedirect)
+	sess.Delete(sessOAuthState)
+	sess.Delete(sessOAuthProvider)
+	sess.Delete(sessOAuthRedirect)
+	sess.Set(SessEmail, email)
+	if err := sess.Save(); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Redirect(302, o.safeRedirect(redirect))
+}
+
+func (o *OAuthLogin) logout(c *gin.Context) {
+	sess := sessions.Default(c)
+	sess.Clear()
+	if err := sess.Save(); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Redirect(302, o.safeRedirect(c.Query("redirect")))
+}
+
+// Only allow redirects to local paths, so the login flow can't be used as an open redirect
+func (o *OAuthLogin) safeRedirect(to string) string {
+	if strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") && !strings.Contains(to, "\\") {
+		return to
+	}
+	return o.home
+}
+
+// Returns the oauth2 config and userinfo URL, running OIDC discovery the first time if needed
+func (p *oauthProvider) config(ctx context.Context, callbackUrl string) (*oauth2.Config, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oc != nil {
+		return p.oc, p.userInfoUrl, nil
+	}
+	cfg := p.cfg
+	scopes := cfg.Scopes
+	if cfg.Issuer != "" {
+		disc, err := discoverOidc(ctx, cfg.Issuer)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.AuthUrl = disc.AuthorizationEndpoint
+		cfg.TokenUrl = disc.TokenEndpoint
+		cfg.UserInfoUrl = disc.UserinfoEndpoint
+		if scopes == nil {
+			scopes = []string{"openid", "email"}
+		}
+	}
+	p.oc = &oauth2.Config{
+		ClientID:     cfg.ClientId,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     oauth2.Endpoint{AuthURL: cfg.AuthUrl, TokenURL: cfg.TokenUrl},
+		RedirectURL:  callbackUrl,
+		Scopes:       scopes,
+	}
+	p.userInfoUrl = cfg.UserInfoUrl
+	return p.oc, p.userInfoUrl, nil
+}
+
+// Fetch the issuer's discovery document
+func discoverOidc(ctx context.Context, issuer string) (oidcDiscovery, error) {
+	var disc oidcDiscovery
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJson(ctx, http.DefaultClient, u, &disc); err != nil {
+		return disc, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.UserinfoEndpoint == "" {
+		return disc, fmt.Errorf("oidc discovery failed: %s is missing endpoints", u)
+	}
+	return disc, nil
+}
+
+// Get the user's verified email from the userinfo endpoint. Handles both OIDC userinfo
+// objects and GitHub's list of emails.
+func fetchEmail(ctx context.Context, client *http.Client, userInfoUrl string) (string, error) {
+	type emailInfo struct {
+		Email string `json:"email"`
+		// OIDC
+		EmailVerified *bool `json:"email_verified"`
+		// GitHub
+		Verified bool `json:"verified"`
+		Primary  bool `json:"primary"`
+	}
+	var raw json.RawMessage
+	if err := getJson(ctx, client, userInfoUrl, &raw); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+		var list []emailInfo
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return "", err
+		}
+		for _, e := range list {
+			if e.Primary && e.Verified && e.Email != "" {
+				return e.Email, nil
+			}
+		}
+		return "", ErrNoEmail
+	}
+	var info emailInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return "", err
+	}
+	if info.Email == "" || (info.EmailVerified != nil && !*info.EmailVerified) {
+		return "", ErrNoEmail
+	}
+	return info.Email, nil
+}
+
+func getJson(ctx context.Context, client *http.Client, url string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(dest)
+}
+
+func randomState() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal OIDC issuer which logs everyone in as the same user
+func newMockIssuer(t *testing.T, email string) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	writeJson := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, gin.H{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" {
+			w.WriteHeader(400)
+			writeJson(w, gin.H{"error": "invalid_grant"})
+			return
+		}
+		writeJson(w, gin.H{"access_token": "at", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(401)
+			return
+		}
+		writeJson(w, gin.H{"sub": "1", "email": email, "email_verified": true})
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOAuthLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	issuer := newMockIssuer(t, "user@example.com")
+
+	r := gin.New()
+	r.Use(sessions.Sessions("main", cookie.NewStore([]byte("secret"))))
+	cfg := ConfigOAuth{
+		Route: "/oauth",
+		Providers: map[string]ConfigOAuthProvider{
+			"mock": {Issuer: issuer.URL, ClientId: "client", ClientSecret: "shh"},
+		},
+	}
+	NewOAuthLogin(cfg, "http://localhost/oauth/callback", "/").Init(r.Group("/oauth"))
+	r.GET("/whoami", func(c *gin.Context) {
+		c.String(200, SessGetString(sessions.Default(c), SessEmail))
+	})
+
+	do := func(target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown provider
+	assert.Equal(t, 404, do("/oauth/login?provider=nope", nil).Code)
+
+	// Login redirects to the discovered authorization endpoint
+	w := do("/oauth/login?provider=mock&redirect=/runs", nil)
+	require.Equal(t, 302, w.Code)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path)
+	assert.Equal(t, "client", loc.Query().Get("client_id"))
+	assert.Equal(t, "openid email", loc.Query().Get("scope"))
+	state := loc.Query().Get("state")
+	require.NotEmpty(t, state)
+	cookies := w.Result().Cookies()
+
+	// Wrong state and wrong code are rejected
+	assert.Equal(t, 400, do("/oauth/callback?code=good-code&state=wrong", cookies).Code)
+	assert.Equal(t, 401, do("/oauth/callback?code=bad-code&state="+state, cookies).Code)
+
+	// Successful callback stores the email and redirects back
+	w = do("/oauth/callback?code=good-code&state="+state, cookies)
+	require.Equal(t, 302, w.Code)
+	assert.Equal(t, "/runs", w.Header().Get("Location"))
+	cookies = w.Result().Cookies()
+	assert.Equal(t, "user@example.com", do("/whoami", cookies).Body.String())
+
+	// Logout clears the session, and doesn't redirect off-site
+	w = do("/oauth/logout?redirect=//evil.example", cookies)
+	require.Equal(t, 302, w.Code)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	assert.Equal(t, "", do("/whoami", w.Result().Cookies()).Body.String())
+}
+
+func TestFetchEmailGithub(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"email":"a@x","primary":false,"verified":true},{"email":"b@x","primary":true,"verified":true}]`))
+	}))
+	defer srv.Close()
+	email, err := fetchEmail(context.Background(), srv.Client(), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "b@x", email)
+}
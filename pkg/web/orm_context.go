@@ -1,10 +1,13 @@
 package web
 
 import (
+	"context"
 	"regexp"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/samber/lo"
 )
 
 // Regex that splits a card into base name and upgrade count.
@@ -23,6 +26,8 @@ type OrmContext struct {
 	CardSet map[orm.CardSpec]bool
 	// ID of run in database
 	Runid int32
+	// GC epoch the caches were loaded under, see LockForGc
+	gcEpoch *atomic.Int64
 }
 
 type ConvToOrm interface {
@@ -51,6 +56,16 @@ func MapToOrm[T any](oc *OrmContext, inp []ConvToOrm) []T {
 	return out
 }
 
+// Create a new OrmContext with empty caches backed by db
+func NewOrmContext(db *orm.Queries) *OrmContext {
+	oc := &OrmContext{
+		Sc:      NewDbCache(db.StrCacheToId, db.StrCacheAdd),
+		Cc:      NewDbCache(db.CardSpecToId, db.CardSpecAdd),
+		gcEpoch: new(atomic.Int64),
+	}
+	return oc.Copy()
+}
+
 // Makes a copy of the OrmContext with per-run data reset
 func (oc OrmContext) Copy() *OrmContext {
 	return &OrmContext{
@@ -59,7 +74,41 @@ func (oc OrmContext) Copy() *OrmContext {
 		StringSet: make(map[string]bool),
 		CardSet:   make(map[orm.CardSpec]bool),
 		Runid:     0,
+		gcEpoch:   oc.gcEpoch,
+	}
+}
+
+// Clears the string and card caches. They are shared by every copy of the OrmContext.
+func (oc *OrmContext) Invalidate() {
+	oc.Sc.Clear()
+	oc.Cc.Clear()
+}
+
+// Stops strings and card specs from being deleted by GcStrings until tx ends, and clears
+// the caches if GcStrings deleted any since they were loaded. Must be called in the
+// transaction adding a run before anything is loaded into the caches.
+func (oc *OrmContext) LockForGc(ctx context.Context, tx *orm.Queries) error {
+	if err := tx.GcLockShared(ctx); err != nil {
+		return err
+	}
+	// The epoch can't change while we hold the lock
+	epoch, err := tx.GcEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	if oc.gcEpoch.Load() != epoch {
+		oc.Invalidate()
+		oc.gcEpoch.Store(epoch)
+	}
+	return nil
+}
+
+// Loads every value in StringSet and CardSet into the caches
+func (oc *OrmContext) LoadSets(ctx context.Context) error {
+	if err := oc.Sc.Load(ctx, lo.Keys(oc.StringSet)); err != nil {
+		return err
 	}
+	return oc.Cc.Load(ctx, lo.Keys(oc.CardSet))
 }
 
 // Takes a card name that may include an upgrade count
@@ -0,0 +1,410 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Number of rows handled at a time when reconciling
+const reconcilePageSize = 500
+
+// How often pending runs are written to the blob store. Entries younger than this are
+// skipped, since the request that created them is probably still writing them.
+const outboxFlushInterval = time.Minute
+
+// Where an upload is written
+type PersistOptions struct {
+	// Add the parsed run to RunsData and friends
+	Store bool
+	// Add the raw body to RawJsonArchive
+	ArchiveDb bool
+	// Blob store to write the raw body to, nil to skip
+	Blobs blob.BlobStore
+}
+
+// Returns the persist options matching the upload config. blobs should be the store
+// returned by OpenBlobStore.
+func PersistOptionsFromConfig(cfg ConfigUpload, blobs blob.BlobStore) PersistOptions {
+	return PersistOptions{Store: cfg.StoreToDb, ArchiveDb: cfg.SaveRawToDb, Blobs: blobs}
+}
+
+// Returns true if the options write anything at all
+func (o PersistOptions) Any() bool {
+	return o.Store || o.ArchiveDb || o.Blobs != nil
+}
+
+// Write an upload in a single transaction: the parsed run, the raw archive, and an outbox
+// entry for the blob store. The raw body is compressed before it's stored, along with
+// the SHA-256 of the uncompressed body. The blob is
+// written after the transaction commits; if that fails the outbox entry remains and the
+// blob is written later by FlushOutbox.
+//
+// Returns an error wrapping ErrRunAlreadyUploaded if the run is stored and the play_id already exists.
+func PersistRun(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts PersistOptions, runData *RunSchemaJson, body []byte, uploader string) error {
+	var pending *PendingBlob
+	err := pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		pending, err = PersistRunTx(ctx, tx, oc, opts, runData, body, uploader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pending.Write(ctx, pool)
+	return nil
+}
+
+// Same as PersistRun, but writes to the database inside tx, so callers holding a row lock
+// don't need a second connection. The writes are made in a savepoint, so tx can still be
+// used if they fail. The returned blob must be written once tx commits.
+func PersistRunTx(ctx context.Context, tx pgx.Tx, oc *OrmContext, opts PersistOptions, runData *RunSchemaJson, body []byte, uploader string) (*PendingBlob, error) {
+	playId := runData.PlayId.String()
+	var raw, sum []byte
+	if opts.ArchiveDb || opts.Blobs != nil {
+		raw = CompressRaw(body)
+		sum = RunSum(body)
+	}
+	err := tx.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if opts.Store {
+			runId, err := runData.AddToDb(ctx, oc, db)
+			if err != nil {
+				return err
+			}
+			if uploader != "" {
+				err = db.SetRunUploader(ctx, orm.SetRunUploaderParams{ID: runId, Uploader: nullString(uploader)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if opts.ArchiveDb {
+			if err := db.ArchiveAddIfMissing(ctx, orm.ArchiveAddIfMissingParams{Bdata: raw, PlayID: playId, Sha256: sum}); err != nil {
+				return err
+			}
+		}
+		if opts.Blobs != nil {
+			if err := db.OutboxAdd(ctx, orm.OutboxAddParams{PlayID: playId, Bdata: raw, Sha256: sum}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if IsDuplicateRunErr(err) {
+		return nil, fmt.Errorf("%w - play_id = %s", ErrRunAlreadyUploaded, playId)
+	} else if err != nil {
+		return nil, err
+	}
+	if opts.Blobs == nil {
+		return nil, nil
+	}
+	return &PendingBlob{blobs: opts.Blobs, playId: playId, raw: raw, sum: sum}, nil
+}
+
+// A raw run added to the outbox by PersistRunTx
+type PendingBlob struct {
+	blobs  blob.BlobStore
+	playId string
+	raw    []byte
+	sum    []byte
+}
+
+// Write the blob and remove its outbox entry. Failures are only logged, since the entry is
+// written later by FlushOutbox. Does nothing if p is nil.
+func (p *PendingBlob) Write(ctx context.Context, pool *pgxpool.Pool) {
+	if p == nil {
+		return
+	}
+	if err := WriteOutboxEntry(ctx, pool, p.blobs, p.playId, p.raw, p.sum); err != nil {
+		log.Printf("writing %s to the blob store failed, will retry later: %v", p.playId, err)
+	}
+}
+
+// Store a parsed run in the database inside its own transaction, recording the uploader's
+// email if it's not empty. Returns an error wrapping ErrRunAlreadyUploaded if the play_id
+// already exists.
+func StoreRun(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, runData *RunSchemaJson, uploader string) error {
+	return PersistRun(ctx, pool, oc, PersistOptions{Store: true}, runData, nil, uploader)
+}
+
+// Write the stored raw run and its checksum to the blob store and remove its outbox entry.
+//
+// The blob is written before locking the entry, so no connection is held while writing.
+// If DeleteRuns removed the entry in the meantime, the blob is deleted again, since
+// DeleteRuns may have deleted it before it was written.
+func WriteOutboxEntry(ctx context.Context, pool *pgxpool.Pool, blobs blob.BlobStore, playId string, raw []byte, sum []byte) error {
+	if err := blobs.Put(ctx, playId, raw, sum); err != nil {
+		return err
+	}
+	return pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		db := orm.New(tx)
+		if _, err := db.OutboxLock(ctx, playId); errors.Is(err, pgx.ErrNoRows) {
+			_, err = blobs.Delete(ctx, playId)
+			return err
+		} else if err != nil {
+			return err
+		}
+		return db.OutboxDelete(ctx, playId)
+	})
+}
+
+// Write every outbox entry older than minAge to the blob store, returning the number written
+func FlushOutbox(ctx context.Context, pool *pgxpool.Pool, blobs blob.BlobStore, minAge time.Duration) (int, error) {
+	db := orm.New(pool)
+	written := 0
+	for {
+		rows, err := db.OutboxList(ctx, orm.OutboxListParams{AgeSecs: minAge.Seconds(), Limit: reconcilePageSize})
+		if err != nil {
+			return written, err
+		}
+		for _, row := range rows {
+			if err := WriteOutboxEntry(ctx, pool, blobs, row.PlayID, row.Bdata, row.Sha256); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if len(rows) < reconcilePageSize {
+			return written, nil
+		}
+	}
+}
+
+type ReconcileOptions struct {
+	PersistOptions
+	// Also make sure every archived run is in the blob store, and every run in the blob
+	// store is stored. Reads the entire archive and blob store, so it's slow.
+	CheckFiles bool
+}
+
+type ReconcileResult struct {
+	// Outbox entries written to the blob store
+	OutboxWritten int
+	// Archived runs that were missing from RunsData and have been stored
+	Parsed int
+	// Archived runs that were missing from RunsData and couldn't be parsed
+	Unparseable int
+	// Stored runs whose missing archive was restored from the blob store
+	Archived int
+	// Stored runs with no raw data in the archive or blob store
+	MissingRaw int
+	// Archived runs written to the blob store because they were missing
+	FilesWritten int
+}
+
+func (r ReconcileResult) String() string {
+	return fmt.Sprintf("outbox=%d parsed=%d unparseable=%d archived=%d missing_raw=%d files_written=%d",
+		r.OutboxWritten, r.Parsed, r.Unparseable, r.Archived, r.MissingRaw, r.FilesWritten)
+}
+
+// Repair inconsistencies between RunsData, RawJsonArchive and the blob store left by
+// older versions, or by failures while writing blobs.
+func Reconcile(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts ReconcileOptions) (ReconcileResult, error) {
+	var res ReconcileResult
+	var err error
+	if opts.Blobs != nil {
+		if res.OutboxWritten, err = FlushOutbox(ctx, pool, opts.Blobs, 0); err != nil {
+			return res, err
+		}
+	}
+	if opts.Store && opts.ArchiveDb {
+		if err := reconcileArchivedNotParsed(ctx, pool, oc, &res); err != nil {
+			return res, err
+		}
+	}
+	if opts.ArchiveDb {
+		if err := reconcileParsedNotArchived(ctx, pool, opts.Blobs, &res); err != nil {
+			return res, err
+		}
+	}
+	if opts.CheckFiles && opts.Blobs != nil {
+		if opts.ArchiveDb {
+			if err := reconcileArchiveFiles(ctx, pool, opts.Blobs, &res); err != nil {
+				return res, err
+			}
+		}
+		if opts.Store {
+			if err := reconcileUnparsedFiles(ctx, pool, oc, opts, &res); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// Store archived runs which aren't in RunsData
+func reconcileArchivedNotParsed(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, res *ReconcileResult) error {
+	db := orm.New(pool)
+	var lastId int32
+	for {
+		rows, err := db.ArchivedNotParsed(ctx, orm.ArchivedNotParsedParams{ID: lastId, Limit: reconcilePageSize})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			lastId = row.ID
+			body, err := DecompressRaw(row.Bdata)
+			if err == nil {
+				err = storeRawRun(ctx, pool, oc, PersistOptions{Store: true}, body)
+			}
+			if err != nil && !errors.Is(err, ErrRunAlreadyUploaded) {
+				log.Printf("reconcile: archived run %s: %v", row.PlayID, err)
+				res.Unparseable++
+			} else if err == nil {
+				res.Parsed++
+			}
+		}
+		if len(rows) < reconcilePageSize {
+			return nil
+		}
+	}
+}
+
+// Restore the archive of stored runs from the blob store, if possible
+func reconcileParsedNotArchived(ctx context.Context, pool *pgxpool.Pool, blobs blob.BlobStore, res *ReconcileResult) error {
+	db := orm.New(pool)
+	var lastId int32
+	for {
+		rows, err := db.ParsedNotArchived(ctx, orm.ParsedNotArchivedParams{ID: lastId, Limit: reconcilePageSize})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			lastId = row.ID
+			var body, sum []byte
+			if blobs != nil {
+				body, sum, err = blobs.Get(ctx, row.PlayID)
+				if err != nil && !errors.Is(err, blob.ErrNotFound) {
+					return err
+				}
+			}
+			if body == nil {
+				res.MissingRaw++
+				continue
+			}
+			if sum == nil {
+				// Blobs written by older versions have no checksum
+				if plain, err := DecompressRaw(body); err == nil {
+					sum = RunSum(plain)
+				}
+			}
+			if !IsCompressedRaw(body) {
+				body = CompressRaw(body)
+			}
+			err := db.ArchiveAddIfMissing(ctx, orm.ArchiveAddIfMissingParams{Bdata: body, PlayID: row.PlayID, Sha256: sum})
+			if err != nil {
+				return err
+			}
+			res.Archived++
+		}
+		if len(rows) < reconcilePageSize {
+			return nil
+		}
+	}
+}
+
+// Write archived runs which are missing from the blob store
+func reconcileArchiveFiles(ctx context.Context, pool *pgxpool.Pool, blobs blob.BlobStore, res *ReconcileResult) error {
+	db := orm.New(pool)
+	var lastId int32
+	for {
+		rows, err := db.ArchiveList(ctx, orm.ArchiveListParams{ID: lastId, Limit: reconcilePageSize})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			lastId = row.ID
+			if ok, err := blobs.Exists(ctx, row.PlayID); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+			if err := blobs.Put(ctx, row.PlayID, row.Bdata, row.Sha256); err != nil {
+				return err
+			}
+			res.FilesWritten++
+		}
+		if len(rows) < reconcilePageSize {
+			return nil
+		}
+	}
+}
+
+// Store runs from the blob store which aren't in RunsData, archiving them too if enabled
+func reconcileUnparsedFiles(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts ReconcileOptions, res *ReconcileResult) error {
+	db := orm.New(pool)
+	popts := PersistOptions{Store: true, ArchiveDb: opts.ArchiveDb}
+	return opts.Blobs.List(ctx, func(playId string) error {
+		exists, err := db.DoesRunExist(ctx, playId)
+		if err != nil || exists {
+			return err
+		}
+		raw, _, err := opts.Blobs.Get(ctx, playId)
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		body, err := DecompressRaw(raw)
+		if err == nil {
+			err = storeRawRun(ctx, pool, oc, popts, body)
+		}
+		if err != nil && !errors.Is(err, ErrRunAlreadyUploaded) {
+			log.Printf("reconcile: blob %s: %v", playId, err)
+			res.Unparseable++
+		} else if err == nil {
+			res.Parsed++
+		}
+		return nil
+	})
+}
+
+// Parse, validate and persist a raw run
+func storeRawRun(ctx context.Context, pool *pgxpool.Pool, oc *OrmContext, opts PersistOptions, body []byte) error {
+	var run RunSchemaJson
+	if err := ParseRun(body, &run); err != nil {
+		return err
+	}
+	if err := ValidateRun(body, &run); err != nil {
+		return err
+	}
+	return PersistRun(ctx, pool, oc.Copy(), opts, &run, body, "")
+}
+
+// Repair inconsistent runs on startup if enabled, then periodically write pending runs
+// to the blob store. Runs until ctx is cancelled.
+func (s *MainController) runReconcile(ctx context.Context) {
+	cfg := s.Srv.Config.Upload
+	opts := PersistOptionsFromConfig(cfg, s.blobs)
+	if cfg.Reconcile {
+		res, err := Reconcile(ctx, s.Srv.Pool, s.ormCtx, ReconcileOptions{PersistOptions: opts})
+		if err != nil {
+			log.Printf("reconcile: %v", err)
+		}
+		log.Printf("reconcile: %s", res)
+	}
+	if opts.Blobs == nil {
+		return
+	}
+	ticker := time.NewTicker(outboxFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := FlushOutbox(ctx, s.Srv.Pool, opts.Blobs, outboxFlushInterval); err != nil {
+			log.Printf("flush outbox: %v", err)
+		} else if n > 0 {
+			log.Printf("flush outbox: wrote %d runs", n)
+		}
+	}
+}
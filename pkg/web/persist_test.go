@@ -0,0 +1,42 @@
+package web
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bindernews/sts-msr/pkg/blob"
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOutboxEntry(t *testing.T) {
+	pool := testPool(t, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	blobs, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	opts := PersistOptions{Store: true, Blobs: blobs}
+
+	// The blob is written and the outbox entry removed after the run is stored
+	run, body := testRun(t, pool)
+	require.NoError(t, PersistRun(ctx, pool, NewOrmContext(orm.New(pool)), opts, run, body, ""))
+	data, sum, err := blobs.Get(ctx, run.PlayId.String())
+	require.NoError(t, err)
+	assert.Equal(t, CompressRaw(body), data)
+	assert.Equal(t, RunSum(body), sum)
+	pending, err := orm.New(pool).OutboxList(ctx, orm.OutboxListParams{Limit: 10000})
+	require.NoError(t, err)
+	for _, p := range pending {
+		assert.NotEqual(t, run.PlayId.String(), p.PlayID)
+	}
+
+	// If DeleteRuns removed the entry while the blob was written, the blob is removed too
+	deleted, body := testRun(t, pool)
+	playId := deleted.PlayId.String()
+	require.NoError(t, WriteOutboxEntry(ctx, pool, blobs, playId, CompressRaw(body), RunSum(body)))
+	exists, err := blobs.Exists(ctx, playId)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
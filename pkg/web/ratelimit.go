@@ -0,0 +1,143 @@
+package web
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Error when a client has made too many requests
+var ErrRateLimited = errors.New("too many requests")
+
+// How long a per-IP limiter is kept after its last request
+const ipLimiterIdle = 10 * time.Minute
+
+// Token-bucket rate limiter with one bucket per client IP and one shared by all clients
+type RateLimiter struct {
+	cfg    ConfigRateLimit
+	global *rate.Limiter
+	lock   sync.Mutex
+	perIp  map[string]*ipLimiter
+	// Next time idle per-IP limiters will be removed
+	nextSweep time.Time
+	// Used in tests
+	now func() time.Time
+}
+
+type ipLimiter struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// Error when a batch could be larger than a rate limit's burst
+var ErrBurstTooSmall = errors.New("rate limit bursts must be at least batch_max")
+
+// Returns ErrBurstTooSmall if a request taking n tokens would never be allowed
+func (cfg ConfigRateLimit) CheckBurst(n int) error {
+	if (cfg.PerIpRate > 0 && cfg.PerIpBurst < n) || (cfg.GlobalRate > 0 && cfg.GlobalBurst < n) {
+		return ErrBurstTooSmall
+	}
+	return nil
+}
+
+// Create a new rate limiter, or returns nil if both limits are disabled
+func NewRateLimiter(cfg ConfigRateLimit) *RateLimiter {
+	if cfg.PerIpRate <= 0 && cfg.GlobalRate <= 0 {
+		return nil
+	}
+	rl := &RateLimiter{
+		cfg:   cfg,
+		perIp: make(map[string]*ipLimiter),
+		now:   time.Now,
+	}
+	if cfg.GlobalRate > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(cfg.GlobalRate), cfg.GlobalBurst)
+	}
+	return rl
+}
+
+// Gin handler that aborts with 429 and a Retry-After header if the client is over the limit
+func (rl *RateLimiter) Handler(c *gin.Context) {
+	if !rl.TakeN(c, 1) {
+		AbortMsg(c, 429, ErrRateLimited)
+	}
+}
+
+// Takes n tokens for the client. If it's over the limit, sets the Retry-After header and
+// returns false, leaving the response to the caller. Always returns true if rl is nil.
+//
+// Clients are identified by c.ClientIP, so the engine's trusted proxies must be set,
+// otherwise anyone could pick their own IP with X-Forwarded-For.
+func (rl *RateLimiter) TakeN(c *gin.Context, n int) bool {
+	if rl == nil {
+		return true
+	}
+	if wait := rl.ReserveN(c.ClientIP(), n); wait > 0 {
+		secs := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(secs))
+		return false
+	}
+	return true
+}
+
+// Takes a token for ip from both buckets, see ReserveN
+func (rl *RateLimiter) Reserve(ip string) time.Duration {
+	return rl.ReserveN(ip, 1)
+}
+
+// Takes n tokens for ip from both buckets. If either doesn't have enough, nothing is taken
+// and the time to wait before retrying is returned. Otherwise returns 0.
+func (rl *RateLimiter) ReserveN(ip string, n int) time.Duration {
+	now := rl.now()
+	var reservations []*rate.Reservation
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	for _, lim := range []*rate.Limiter{rl.ipLimiter(ip, now), rl.global} {
+		if lim == nil {
+			continue
+		}
+		r := lim.ReserveN(now, n)
+		if !r.OK() {
+			// n is more than the burst, so this will never be allowed
+			cancel()
+			return time.Minute
+		}
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > 0 {
+			cancel()
+			return d
+		}
+	}
+	return 0
+}
+
+func (rl *RateLimiter) ipLimiter(ip string, now time.Time) *rate.Limiter {
+	if rl.cfg.PerIpRate <= 0 {
+		return nil
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if now.After(rl.nextSweep) {
+		for k, v := range rl.perIp {
+			if now.Sub(v.lastSeen) > ipLimiterIdle {
+				delete(rl.perIp, k)
+			}
+		}
+		rl.nextSweep = now.Add(ipLimiterIdle)
+	}
+	il := rl.perIp[ip]
+	if il == nil {
+		il = &ipLimiter{lim: rate.NewLimiter(rate.Limit(rl.cfg.PerIpRate), rl.cfg.PerIpBurst)}
+		rl.perIp[ip] = il
+	}
+	il.lastSeen = now
+	return il.lim
+}
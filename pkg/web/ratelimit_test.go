@@ -0,0 +1,67 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := NewRateLimiter(ConfigRateLimit{PerIpRate: 1, PerIpBurst: 2, GlobalRate: 10, GlobalBurst: 3})
+	rl.now = func() time.Time { return now }
+
+	// Burst, then limited per IP
+	assert.Zero(t, rl.Reserve("a"))
+	assert.Zero(t, rl.Reserve("a"))
+	assert.Equal(t, time.Second, rl.Reserve("a"))
+	// Other IPs have their own bucket, until the global one runs out
+	assert.Zero(t, rl.Reserve("b"))
+	assert.Equal(t, 100*time.Millisecond, rl.Reserve("b"))
+	// A rejected request doesn't use up the IP's token
+	now = now.Add(time.Second)
+	assert.Zero(t, rl.Reserve("b"))
+
+	assert.Nil(t, NewRateLimiter(ConfigRateLimit{}))
+}
+
+func TestRateLimiterBatch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := NewRateLimiter(ConfigRateLimit{PerIpRate: 1, PerIpBurst: 10})
+	rl.now = func() time.Time { return now }
+
+	// Each run costs a token
+	assert.Zero(t, rl.ReserveN("a", 8))
+	assert.Equal(t, 2*time.Second, rl.ReserveN("a", 4))
+	assert.Zero(t, rl.ReserveN("a", 2))
+
+	assert.NoError(t, ConfigRateLimit{PerIpRate: 1, PerIpBurst: 10}.CheckBurst(10))
+	assert.ErrorIs(t, ConfigRateLimit{PerIpRate: 1, PerIpBurst: 10, GlobalRate: 1, GlobalBurst: 5}.CheckBurst(10), ErrBurstTooSmall)
+	assert.NoError(t, ConfigRateLimit{PerIpBurst: 1}.CheckBurst(10))
+}
+
+func TestRateLimiterSpoofedIp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	assert.NoError(t, r.SetTrustedProxies([]string{"127.0.0.0/8"}))
+	rl := NewRateLimiter(ConfigRateLimit{PerIpRate: 1, PerIpBurst: 1})
+	r.POST("/", rl.Handler, func(c *gin.Context) { c.Status(200) })
+
+	send := func(remote, forwarded string) int {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = remote + ":1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	// A client can't get a fresh bucket by making up an IP
+	assert.Equal(t, 200, send("10.0.0.1", "1.1.1.1"))
+	assert.Equal(t, 429, send("10.0.0.1", "2.2.2.2"))
+	// But a trusted proxy can forward it
+	assert.Equal(t, 200, send("127.0.0.1", "3.3.3.3"))
+	assert.Equal(t, 429, send("127.0.0.1", "3.3.3.3"))
+}
@@ -0,0 +1,161 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+)
+
+// Kinds of JsonDiff
+const (
+	// The field is in the uploaded run but not the reconstructed one
+	DiffMissing = "missing"
+	// The field is only in the reconstructed run
+	DiffExtra = "extra"
+	// The field has a different value or type
+	DiffChanged = "changed"
+)
+
+// A difference between an uploaded run and the run rebuilt by RunToJson
+type JsonDiff struct {
+	// Location of the field, ex. "card_choices[2].not_picked"
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	Want any    `json:"want,omitempty"`
+	Got  any    `json:"got,omitempty"`
+}
+
+func (d JsonDiff) String() string {
+	switch d.Kind {
+	case DiffMissing:
+		return fmt.Sprintf("%s: missing, want %s", d.Path, jsonString(d.Want))
+	case DiffExtra:
+		return fmt.Sprintf("%s: extra, got %s", d.Path, jsonString(d.Got))
+	default:
+		return fmt.Sprintf("%s: want %s, got %s", d.Path, jsonString(d.Want), jsonString(d.Got))
+	}
+}
+
+func jsonString(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// Rebuild a stored run with RunToJson and compare it to its raw upload, which may be
+// compressed. Returns pgx.ErrNoRows if the run isn't in RunsData.
+func VerifyRoundTrip(ctx context.Context, db *orm.Queries, playId string, raw []byte) ([]JsonDiff, error) {
+	body, err := DecompressRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	var want any
+	if err := json.Unmarshal(body, &want); err != nil {
+		return nil, err
+	}
+	rebuilt, err := RunToJson(ctx, db, playId)
+	if err != nil {
+		return nil, err
+	}
+	got, err := normalizeJson(rebuilt)
+	if err != nil {
+		return nil, err
+	}
+	return DiffJson(want, got), nil
+}
+
+// Convert v to the types json.Unmarshal produces, so it can be compared with DiffJson
+func normalizeJson(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// Compares two values decoded by json.Unmarshal, returning each difference sorted by path
+func DiffJson(want, got any) []JsonDiff {
+	var diffs []JsonDiff
+	diffJson("", want, got, &diffs)
+	return diffs
+}
+
+func diffJson(path string, want, got any, diffs *[]JsonDiff) {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			wv, inWant := w[k]
+			gv, inGot := g[k]
+			if !inGot {
+				*diffs = append(*diffs, JsonDiff{Path: sub, Kind: DiffMissing, Want: wv})
+			} else if !inWant {
+				*diffs = append(*diffs, JsonDiff{Path: sub, Kind: DiffExtra, Got: gv})
+			} else {
+				diffJson(sub, wv, gv, diffs)
+			}
+		}
+		return
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(w) || i < len(g); i++ {
+			sub := fmt.Sprintf("%s[%d]", path, i)
+			if i >= len(g) {
+				*diffs = append(*diffs, JsonDiff{Path: sub, Kind: DiffMissing, Want: w[i]})
+			} else if i >= len(w) {
+				*diffs = append(*diffs, JsonDiff{Path: sub, Kind: DiffExtra, Got: g[i]})
+			} else {
+				diffJson(sub, w[i], g[i], diffs)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(want, got) {
+		*diffs = append(*diffs, JsonDiff{Path: path, Kind: DiffChanged, Want: want, Got: got})
+	}
+}
+
+// Matches array indexes in a diff path
+var diffIndexRe = regexp.MustCompile(`\[\d+\]`)
+
+// Returns path with every array index replaced by "[]", ex. "card_choices[].floor"
+func DiffField(path string) string {
+	return diffIndexRe.ReplaceAllString(path, "[]")
+}
+
+// Returns true if the field at path is pattern, or inside it. Patterns use "[]" for
+// any array index, see DiffField.
+func DiffFieldMatches(path, pattern string) bool {
+	field := DiffField(path)
+	return field == pattern || strings.HasPrefix(field, pattern+".") || strings.HasPrefix(field, pattern+"[")
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffJson(t *testing.T) {
+	var want, got any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"gold": 99, "victory": true, "extra_field": "x",
+		"card_choices": [{"floor": 1, "picked": "Bash"}, {"floor": 2, "picked": "SKIP"}],
+		"relics": ["Burning Blood"]
+	}`), &want))
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"gold": 99.0, "victory": 1, "new_field": null,
+		"card_choices": [{"floor": 1, "picked": "Bash+1"}],
+		"relics": ["Burning Blood"]
+	}`), &got))
+
+	assert.Equal(t, []JsonDiff{
+		{Path: "card_choices[0].picked", Kind: DiffChanged, Want: "Bash", Got: "Bash+1"},
+		{Path: "card_choices[1]", Kind: DiffMissing, Want: map[string]any{"floor": 2.0, "picked": "SKIP"}},
+		{Path: "extra_field", Kind: DiffMissing, Want: "x"},
+		{Path: "new_field", Kind: DiffExtra},
+		{Path: "victory", Kind: DiffChanged, Want: true, Got: 1.0},
+	}, DiffJson(want, got))
+	assert.Empty(t, DiffJson(want, want))
+}
+
+func TestDiffFieldMatches(t *testing.T) {
+	assert.Equal(t, "card_choices[].not_picked[]", DiffField("card_choices[12].not_picked[0]"))
+	assert.True(t, DiffFieldMatches("card_choices[12].not_picked[0]", "card_choices[].not_picked"))
+	assert.True(t, DiffFieldMatches("card_choices[12].floor", "card_choices"))
+	assert.True(t, DiffFieldMatches("timestamp", "timestamp"))
+	assert.False(t, DiffFieldMatches("timestamp_2", "timestamp"))
+	assert.False(t, DiffFieldMatches("card_choices[1].floor", "card_choices[].picked"))
+}
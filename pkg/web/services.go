@@ -5,13 +5,15 @@ import (
 	"os"
 
 	"github.com/bindernews/sts-msr/pkg/orm"
-	"github.com/bindernews/sts-msr/pkg/tools"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// Environment variable to get postgres connection
+const EnvPostgresConn = "POSTGRES_CONN"
+
 type Services struct {
 	Pool    *pgxpool.Pool
 	SeStore sessions.Store
@@ -20,18 +22,8 @@ type Services struct {
 
 func (s *Services) LoadDefaults() error {
 	// Connect to DB
-	ctx := context.Background()
-	poolCfg, err := pgxpool.ParseConfig(os.Getenv(tools.EnvPostgresConn))
-	if err != nil {
-		return err
-	}
-	poolCfg.AfterConnect = func(ctx context.Context, c *pgx.Conn) error {
-		if err := (orm.CardSpec{}).RegisterType(ctx, c); err != nil {
-			return err
-		}
-		return nil
-	}
-	s.Pool, err = pgxpool.ConnectConfig(ctx, poolCfg)
+	var err error
+	s.Pool, err = ConnectPool(context.Background(), os.Getenv(EnvPostgresConn))
 	if err != nil {
 		return err
 	}
@@ -43,3 +35,22 @@ func (s *Services) LoadDefaults() error {
 	s.Config = NewConfig()
 	return nil
 }
+
+// Connect to the database, registering the custom types used by the orm package.
+// Each function in opts may modify the pool config before connecting.
+func ConnectPool(ctx context.Context, connString string, opts ...func(*pgxpool.Config)) (*pgxpool.Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(poolCfg)
+	}
+	poolCfg.AfterConnect = func(ctx context.Context, c *pgx.Conn) error {
+		if err := (orm.CardSpec{}).RegisterType(ctx, c); err != nil {
+			return err
+		}
+		return nil
+	}
+	return pgxpool.ConnectConfig(ctx, poolCfg)
+}
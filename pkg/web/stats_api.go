@@ -0,0 +1,164 @@
+package web
+
+import (
+	"errors"
+
+	"github.com/bindernews/sts-msr/pkg/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// Error when the requested character has no runs
+var ErrUnknownCharacter = errors.New("unknown character")
+
+// Query parameters shared by the stats routes
+type StatsQuery struct {
+	// Character name, as it appears in character_chosen
+	Character string `form:"character"`
+	// If true, cards with different upgrade counts are counted as the same card
+	MergeUpgrades bool `form:"merge_upgrades"`
+}
+
+type StatsOverviewJson struct {
+	Character     string    `json:"character"`
+	Runs          int64     `json:"runs"`
+	Wins          int64     `json:"wins"`
+	AvgWinRate    float64   `json:"avg_win_rate"`
+	PDeckSize     []float32 `json:"p_deck_size"`
+	PFloorReached []float32 `json:"p_floor_reached"`
+}
+
+type CardCountJson struct {
+	Card     string `json:"card"`
+	Total    int64  `json:"total"`
+	Upgrades int64  `json:"upgrades"`
+}
+
+type CardStatsJson struct {
+	Card  string    `json:"card"`
+	Runs  int32     `json:"runs"`
+	Wins  int32     `json:"wins"`
+	Deck  []float32 `json:"deck"`
+	Floor []float32 `json:"floor"`
+}
+
+type CardPickJson struct {
+	Card string `json:"card"`
+	Pick int32  `json:"pick"`
+	Skip int32  `json:"skip"`
+}
+
+// Register the stats API routes on the group
+func (s *MainController) initStatsApi(g *gin.RouterGroup) {
+	g.GET("/overview", s.GetStatsOverview)
+	g.GET("/card-counts", s.GetStatsCardCounts)
+	g.GET("/card-stats", s.GetStatsCardStats)
+	g.GET("/card-picks", s.GetStatsCardPicks)
+}
+
+// Per-character overview, optionally filtered to one character
+func (s *MainController) GetStatsOverview(c *gin.Context) {
+	var query StatsQuery
+	if err := c.BindQuery(&query); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	rows, err := orm.New(s.Srv.Pool).StatsOverview(c.Request.Context(), nullString(query.Character))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, lo.Map(rows, func(r orm.StatsOverview, _ int) StatsOverviewJson {
+		return StatsOverviewJson{
+			Character:     r.Name,
+			Runs:          r.Runs,
+			Wins:          r.Wins,
+			AvgWinRate:    r.AvgWinRate,
+			PDeckSize:     r.PDeckSize,
+			PFloorReached: r.PFloorReached,
+		}
+	}))
+}
+
+// How often each card appears in the final deck of a character
+func (s *MainController) GetStatsCardCounts(c *gin.Context) {
+	query, charId, ok := s.bindStatsQuery(c)
+	if !ok {
+		return
+	}
+	rows, err := orm.New(s.Srv.Pool).StatsCardCounts(c.Request.Context(), orm.StatsCardCountsParams{
+		MergeUpgrades: query.MergeUpgrades,
+		CharID:        charId,
+	})
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, lo.Map(rows, func(r orm.StatsCardCountsRow, _ int) CardCountJson {
+		return CardCountJson(r)
+	}))
+}
+
+// Run, win, deck size and floor statistics for each card a character used
+func (s *MainController) GetStatsCardStats(c *gin.Context) {
+	_, charId, ok := s.bindStatsQuery(c)
+	if !ok {
+		return
+	}
+	rows, err := orm.New(s.Srv.Pool).PerCharacterCardStats(c.Request.Context(), charId)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, lo.Map(rows, func(r orm.PerCharacterCardStatsRow, _ int) CardStatsJson {
+		return CardStatsJson{
+			Card:  r.Card,
+			Runs:  r.Runs,
+			Wins:  r.Wins,
+			Deck:  r.Deck,
+			Floor: r.Floor,
+		}
+	}))
+}
+
+// How often each card was picked or skipped when offered
+func (s *MainController) GetStatsCardPicks(c *gin.Context) {
+	query, charId, ok := s.bindStatsQuery(c)
+	if !ok {
+		return
+	}
+	rows, err := orm.New(s.Srv.Pool).CardPickStats(c.Request.Context(), orm.CardPickStatsParams{
+		CharID:        charId,
+		MergeUpgrades: query.MergeUpgrades,
+	})
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, lo.Map(rows, func(r orm.CardPickStatsRow, _ int) CardPickJson {
+		return CardPickJson(r)
+	}))
+}
+
+// Parse the query parameters and resolve the character ID. Aborts the request
+// and returns false if that fails.
+func (s *MainController) bindStatsQuery(c *gin.Context) (query StatsQuery, charId int32, ok bool) {
+	if err := c.BindQuery(&query); err != nil {
+		AbortMsg(c, 400, err)
+		return
+	}
+	if query.Character == "" {
+		AbortMsg(c, 400, ErrUnknownCharacter)
+		return
+	}
+	charId, err := orm.New(s.Srv.Pool).CharacterIdByName(c.Request.Context(), query.Character)
+	if errors.Is(err, pgx.ErrNoRows) {
+		AbortMsg(c, 404, ErrUnknownCharacter)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	return query, charId, true
+}
@@ -0,0 +1,151 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header containing the signature of the email header, formatted as "<unix time>.<hex hmac>"
+const HeaderEmailSignature = "X-Email-Signature"
+
+// Header with the verified email, sent to the stats server
+const HeaderForwardedEmail = "X-Forwarded-Email"
+
+// Headers which identify the user, removed from every request so they can't be spoofed
+var identityHeaders = []string{
+	"X-Email",
+	HeaderEmailSignature,
+	HeaderForwardedEmail,
+	"X-Forwarded-User",
+	"X-Forwarded-Preferred-Username",
+	"X-Auth-Request-Email",
+	"X-Auth-Request-User",
+}
+
+// Error when trusting any peer without requiring a signature
+var ErrInsecureProxyConfig = errors.New("proxy: trusted_cidrs is empty and there's no signature_secret, anyone could set the email header")
+
+// Decides whether to trust the email header set by an auth proxy
+type IdentityHeaders struct {
+	header  string
+	trusted []*net.IPNet
+	secret  []byte
+	maxAge  time.Duration
+	now     func() time.Time
+}
+
+func NewIdentityHeaders(cfg ConfigProxy) (*IdentityHeaders, error) {
+	ih := &IdentityHeaders{
+		header: cfg.EmailHeader,
+		maxAge: time.Duration(cfg.SignatureMaxAge) * time.Second,
+		now:    time.Now,
+	}
+	for _, cidr := range cfg.TrustedCidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		ih.trusted = append(ih.trusted, ipnet)
+	}
+	secret := cfg.SignatureSecret
+	if secret == "" {
+		secret = os.Getenv("IDENTITY_HMAC_SECRET")
+	}
+	if secret != "" {
+		ih.secret = []byte(secret)
+	}
+	if ih.header != "" && ih.trusted == nil && ih.secret == nil {
+		return nil, ErrInsecureProxyConfig
+	}
+	return ih, nil
+}
+
+// Returns the email from the identity header if the request came from a trusted
+// peer and is correctly signed, otherwise returns the empty string.
+func (ih *IdentityHeaders) Email(r *http.Request) string {
+	if ih.header == "" {
+		return ""
+	}
+	email := r.Header.Get(ih.header)
+	if email == "" || !ih.trustedPeer(r.RemoteAddr) {
+		return ""
+	}
+	if ih.secret != nil && !ih.verify(email, r.Header.Get(HeaderEmailSignature)) {
+		return ""
+	}
+	return email
+}
+
+// Removes all identity headers from h
+func (ih *IdentityHeaders) Strip(h http.Header) {
+	for _, name := range identityHeaders {
+		h.Del(name)
+	}
+	if ih.header != "" {
+		h.Del(ih.header)
+	}
+}
+
+func (ih *IdentityHeaders) trustedPeer(remoteAddr string) bool {
+	if ih.trusted == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range ih.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ih *IdentityHeaders) verify(email string, signature string) bool {
+	tsStr, _, ok := strings.Cut(signature, ".")
+	if !ok {
+		return false
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := ih.now().Sub(time.Unix(ts, 0))
+	if age > ih.maxAge || age < -ih.maxAge {
+		return false
+	}
+	expect := SignIdentity(ih.secret, email, time.Unix(ts, 0))
+	return hmac.Equal([]byte(signature), []byte(expect))
+}
+
+// Returns the value of HeaderEmailSignature for email, signed at time t
+func SignIdentity(secret []byte, email string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "." + email))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware which passes the verified email upstream in HeaderForwardedEmail.
+// Must run after CtxInject, which strips any client-supplied identity headers.
+func ForwardIdentity(c *gin.Context) {
+	if email := c.GetString(CtxEmail); email != "" {
+		c.Request.Header.Set(HeaderForwardedEmail, email)
+	}
+}
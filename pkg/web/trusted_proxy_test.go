@@ -0,0 +1,63 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityHeadersCidr(t *testing.T) {
+	ih, err := NewIdentityHeaders(ConfigProxy{EmailHeader: "X-Email", TrustedCidrs: []string{"10.0.0.0/8", "::1/128"}})
+	require.NoError(t, err)
+
+	email := func(remote string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Email", "admin@x")
+		return ih.Email(r)
+	}
+	assert.Equal(t, "admin@x", email("10.1.2.3:5555"))
+	assert.Equal(t, "admin@x", email("[::1]:5555"))
+	assert.Equal(t, "", email("192.168.0.1:5555"))
+	assert.Equal(t, "", email("garbage"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Email", "admin@x")
+	r.Header.Set(HeaderForwardedEmail, "admin@x")
+	r.Header.Set("Accept", "*/*")
+	ih.Strip(r.Header)
+	assert.Empty(t, r.Header.Get("X-Email"))
+	assert.Empty(t, r.Header.Get(HeaderForwardedEmail))
+	assert.Equal(t, "*/*", r.Header.Get("Accept"))
+}
+
+func TestIdentityHeadersSigned(t *testing.T) {
+	_, err := NewIdentityHeaders(ConfigProxy{EmailHeader: "X-Email"})
+	assert.ErrorIs(t, err, ErrInsecureProxyConfig)
+	_, err = NewIdentityHeaders(ConfigProxy{EmailHeader: "X-Email", TrustedCidrs: []string{"nope"}})
+	assert.Error(t, err)
+
+	secret := []byte("secret")
+	ih, err := NewIdentityHeaders(ConfigProxy{EmailHeader: "X-Email", SignatureSecret: "secret", SignatureMaxAge: 60})
+	require.NoError(t, err)
+	now := time.Unix(10000, 0)
+	ih.now = func() time.Time { return now }
+
+	email := func(value, sig string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Email", value)
+		r.Header.Set(HeaderEmailSignature, sig)
+		return ih.Email(r)
+	}
+	assert.Equal(t, "a@x", email("a@x", SignIdentity(secret, "a@x", now)))
+	assert.Equal(t, "a@x", email("a@x", SignIdentity(secret, "a@x", now.Add(-30*time.Second))))
+	// Expired, wrong email, wrong secret, malformed
+	assert.Equal(t, "", email("a@x", SignIdentity(secret, "a@x", now.Add(-2*time.Minute))))
+	assert.Equal(t, "", email("b@x", SignIdentity(secret, "a@x", now)))
+	assert.Equal(t, "", email("a@x", SignIdentity([]byte("other"), "a@x", now)))
+	assert.Equal(t, "", email("a@x", "abc"))
+	assert.Equal(t, "", email("a@x", ""))
+}
@@ -0,0 +1,209 @@
+package web
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+// Error when an uploaded file isn't a run or an archive of runs
+var ErrUnknownFileType = errors.New("expected a .run, .tar.gz or .tgz file")
+
+// Error when a run is larger than max_body_size
+var ErrRunTooLarge = errors.New("run is too large")
+
+// Limits for the files sent to the upload form
+type fileUploadLimits struct {
+	// Largest single run, after decompression
+	RunSize int64
+	// Total size of all runs, after decompression
+	TotalSize int64
+	// Maximum number of runs
+	Runs int
+}
+
+// A run read from an uploaded file. If Err is set the run couldn't be read.
+type UploadedRun struct {
+	// Name of the uploaded file, with the path of the run appended for archives
+	File string
+	Body []byte
+	Err  error
+}
+
+// Result for a single run sent with the upload form
+type FileUploadResult struct {
+	File string
+	BatchResult
+}
+
+// Reads every run from the file parts of a multipart form. Each file may be a single
+// run, which may be compressed, or a .tar.gz of runs. Problems with a single run are
+// returned in its Err field, while an error is returned if a limit is exceeded or the
+// form can't be read.
+func ReadUploadedRuns(mr *multipart.Reader, limits fileUploadLimits) ([]UploadedRun, error) {
+	var runs []UploadedRun
+	var total int64
+	add := func(run UploadedRun) error {
+		if len(runs) >= limits.Runs {
+			return fmt.Errorf("%w - max = %d", ErrBatchTooLarge, limits.Runs)
+		}
+		total += int64(len(run.Body))
+		if limits.TotalSize > 0 && total > limits.TotalSize {
+			return fmt.Errorf("%w: limit is %d bytes", ErrDecompressedTooLarge, limits.TotalSize)
+		}
+		runs = append(runs, run)
+		return nil
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return runs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name := part.FileName()
+		switch {
+		case name == "":
+			// Not a file
+		case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+			err = readUploadedTar(part, name, limits, add)
+		case strings.HasSuffix(name, ".run"):
+			body, rerr := readUploadedRun(part, limits.RunSize)
+			err = add(UploadedRun{File: name, Body: body, Err: rerr})
+		default:
+			err = add(UploadedRun{File: name, Err: ErrUnknownFileType})
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads each .run file in a .tar.gz archive. The archive is rejected once the total size
+// of its runs exceeds the limit, so a small archive can't expand forever.
+func readUploadedTar(rd io.Reader, name string, limits fileUploadLimits, add func(UploadedRun) error) error {
+	gz, err := gzip.NewReader(rd)
+	if err != nil {
+		return add(UploadedRun{File: name, Err: err})
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return add(UploadedRun{File: name, Err: err})
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Ext(hdr.Name) != ".run" {
+			continue
+		}
+		total += hdr.Size
+		if limits.TotalSize > 0 && total > limits.TotalSize {
+			return fmt.Errorf("%s: %w: limit is %d bytes", name, ErrDecompressedTooLarge, limits.TotalSize)
+		}
+		run := UploadedRun{File: name + "/" + hdr.Name}
+		if limits.RunSize > 0 && hdr.Size > limits.RunSize {
+			run.Err = ErrRunTooLarge
+		} else {
+			run.Body, run.Err = readUploadedRun(tr, limits.RunSize)
+		}
+		if err := add(run); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads a single run, decompressing it if needed
+func readUploadedRun(rd io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = maxRawSize
+	}
+	data, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrRunTooLarge
+	}
+	if data, err = DecompressRaw(data); err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrRunTooLarge
+	}
+	return data, nil
+}
+
+// Store the runs from the browser upload form, then show the result of each one
+func (s *MainController) postUploadFile(c *gin.Context) {
+	cfg := s.Srv.Config.Upload
+	if cfg.BatchMaxBodySize > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.BatchMaxBodySize)
+	}
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		s.renderUploadResult(c, 400, nil, err)
+		return
+	}
+	runs, err := ReadUploadedRuns(mr, fileUploadLimits{
+		RunSize:   cfg.MaxBodySize,
+		TotalSize: cfg.BatchMaxBodySize,
+		Runs:      cfg.BatchMax,
+	})
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) || errors.Is(err, ErrDecompressedTooLarge) {
+		s.renderUploadResult(c, 413, nil, err)
+		return
+	} else if err != nil {
+		s.renderUploadResult(c, 400, nil, err)
+		return
+	}
+
+	if !s.batchLimit.TakeN(c, lo.Max([]int{len(runs), 1})) {
+		s.renderUploadResult(c, 429, nil, ErrRateLimited)
+		return
+	}
+
+	// Store the runs which could be read, then put the results back in order
+	readable := lo.Filter(runs, func(r UploadedRun, _ int) bool { return r.Err == nil })
+	stored, err := s.storeBatch(c, lo.Map(readable, func(r UploadedRun, _ int) []byte { return r.Body }))
+	if err != nil {
+		c.Error(err)
+		s.renderUploadResult(c, 500, nil, err)
+		return
+	}
+	results := make([]FileUploadResult, len(runs))
+	for i, run := range runs {
+		results[i].File = run.File
+		if run.Err != nil {
+			results[i].BatchResult = BatchResult{Status: BatchInvalid, Reason: run.Err.Error()}
+			s.metrics.RecordUpload(UploadInvalid)
+		} else {
+			results[i].BatchResult, stored = stored[0], stored[1:]
+		}
+	}
+	s.renderUploadResult(c, 200, results, nil)
+}
+
+func (s *MainController) renderUploadResult(c *gin.Context, code int, results []FileUploadResult, err error) {
+	data := gin.H{
+		"Results": results,
+		"Back":    s.routeUrl("/"),
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	c.HTML(code, "upload_result.html", data)
+}
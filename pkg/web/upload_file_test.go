@@ -0,0 +1,73 @@
+package web
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"mime/multipart"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tarGzBytes(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(content)), Mode: 0644}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func multipartReader(t *testing.T, files [][2]string) *multipart.Reader {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	require.NoError(t, mw.WriteField("other", "ignored"))
+	for _, f := range files {
+		w, err := mw.CreateFormFile("run-file", f[0])
+		require.NoError(t, err)
+		w.Write([]byte(f[1]))
+	}
+	require.NoError(t, mw.Close())
+	return multipart.NewReader(buf, mw.Boundary())
+}
+
+func TestReadUploadedRuns(t *testing.T) {
+	limits := fileUploadLimits{RunSize: 64, TotalSize: 1024, Runs: 10}
+	archive := tarGzBytes(t, map[string]string{"runs/b.run": `{"b":1}`, "README": "not a run"})
+	mr := multipartReader(t, [][2]string{
+		{"a.run", `{"a":1}`},
+		{"c.run", string(CompressRaw([]byte(`{"c":1}`)))},
+		{"runs.tar.gz", string(archive)},
+		{"notes.txt", "hello"},
+		{"big.run", string(bytes.Repeat([]byte("x"), 100))},
+	})
+	runs, err := ReadUploadedRuns(mr, limits)
+	require.NoError(t, err)
+	require.Len(t, runs, 5)
+
+	assert.Equal(t, UploadedRun{File: "a.run", Body: []byte(`{"a":1}`)}, runs[0])
+	assert.Equal(t, UploadedRun{File: "c.run", Body: []byte(`{"c":1}`)}, runs[1])
+	assert.Equal(t, UploadedRun{File: "runs.tar.gz/runs/b.run", Body: []byte(`{"b":1}`)}, runs[2])
+	assert.Equal(t, "notes.txt", runs[3].File)
+	assert.ErrorIs(t, runs[3].Err, ErrUnknownFileType)
+	assert.ErrorIs(t, runs[4].Err, ErrRunTooLarge)
+}
+
+func TestReadUploadedRunsLimits(t *testing.T) {
+	files := [][2]string{{"a.run", "{}"}, {"b.run", "{}"}, {"c.run", "{}"}}
+	_, err := ReadUploadedRuns(multipartReader(t, files), fileUploadLimits{RunSize: 64, TotalSize: 1024, Runs: 2})
+	assert.ErrorIs(t, err, ErrBatchTooLarge)
+
+	// The sizes in the archive count towards the total before anything is read
+	archive := tarGzBytes(t, map[string]string{"a.run": string(bytes.Repeat([]byte(" "), 2000))})
+	_, err = ReadUploadedRuns(multipartReader(t, [][2]string{{"runs.tgz", string(archive)}}),
+		fileUploadLimits{RunSize: 64, TotalSize: 1024, Runs: 2})
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+}
@@ -0,0 +1,329 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	stsmsr "github.com/bindernews/sts-msr"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+// Parts of a JSON schema node checked by ValidateRun
+type schemaNode struct {
+	Ref         string                 `json:"$ref"`
+	Type        schemaTypes            `json:"type"`
+	Format      string                 `json:"format"`
+	Minimum     *float64               `json:"minimum"`
+	Required    []string               `json:"required"`
+	Properties  map[string]*schemaNode `json:"properties"`
+	Items       *schemaNode            `json:"items"`
+	Definitions map[string]*schemaNode `json:"definitions"`
+}
+
+// Either a single type name or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// Parsed run.schema.json
+var runSchema = mustParseSchema(stsmsr.RunSchema)
+
+func mustParseSchema(data []byte) *schemaNode {
+	var node schemaNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		panic(fmt.Errorf("parsing run schema: %w", err))
+	}
+	return &node
+}
+
+// A single problem found while validating a run
+type Violation struct {
+	// JSON path of the offending field, ex. "card_choices[3].floor"
+	Field string `json:"field"`
+	// What's wrong with it
+	Message string `json:"message"`
+}
+
+// Returned by ValidateRun when a run has one or more violations
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Field + ": " + v.Message
+	}
+	return "invalid run: " + strings.Join(parts, "; ")
+}
+
+// Parses a run. If it can't be parsed because it doesn't match run.schema.json, returns a
+// *ValidationError listing every violation rather than the first decoding error.
+func ParseRun(body []byte, run *RunSchemaJson) error {
+	err := json.Unmarshal(body, run)
+	if err != nil {
+		if err2 := checkRunSchema(body); err2 != nil {
+			return err2
+		}
+	}
+	return err
+}
+
+// Checks the raw run against run.schema.json (required keys, types and minimums of the
+// run and every nested element), and the parsed run against semantic rules the database
+// code depends on (non-negative values, matching array lengths, floors that fit in a
+// smallint). Returns a *ValidationError listing every violation, or nil if the run is valid.
+func ValidateRun(body []byte, run *RunSchemaJson) error {
+	var raw any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	rv := runValidator{}
+	rv.schema("", runSchema, raw)
+	rv.validate(run)
+	if len(rv.out) > 0 {
+		return &ValidationError{Violations: rv.out}
+	}
+	return nil
+}
+
+// Checks the raw run against run.schema.json only
+func checkRunSchema(body []byte) error {
+	var raw any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	rv := runValidator{}
+	rv.schema("", runSchema, raw)
+	if len(rv.out) > 0 {
+		return &ValidationError{Violations: rv.out}
+	}
+	return nil
+}
+
+type runValidator struct {
+	out []Violation
+}
+
+func (rv *runValidator) add(field string, format string, args ...any) {
+	rv.out = append(rv.out, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (rv *runValidator) validate(r *RunSchemaJson) {
+	if r.AscensionLevel < 0 || r.AscensionLevel > 20 {
+		rv.add("ascension_level", "must be between 0 and 20")
+	}
+	if len(r.LocalTime) != 14 || strings.Trim(r.LocalTime, "0123456789") != "" {
+		rv.add("local_time", "must be in YYYYmmddHHMMSS format")
+	}
+	rv.nonNegative("floor_reached", r.FloorReached)
+	rv.nonNegative("gold", r.Gold)
+	rv.nonNegative("playtime", r.Playtime)
+	rv.nonNegative("campfire_rested", r.CampfireRested)
+	rv.nonNegative("campfire_upgraded", r.CampfireUpgraded)
+	rv.nonNegative("circlet_count", float64(r.CircletCount))
+	rv.nonNegative("purchased_purges", float64(r.PurchasedPurges))
+
+	// Per-floor stats are stored together, one row per floor
+	rv.sameLength("current_hp_per_floor", len(r.CurrentHpPerFloor), "gold_per_floor", len(r.GoldPerFloor))
+	rv.sameLength("current_hp_per_floor", len(r.CurrentHpPerFloor), "max_hp_per_floor", len(r.MaxHpPerFloor))
+	rv.nonNegativeAll("gold_per_floor", r.GoldPerFloor)
+	rv.nonNegativeAll("current_hp_per_floor", r.CurrentHpPerFloor)
+	rv.nonNegativeAll("max_hp_per_floor", r.MaxHpPerFloor)
+	if len(r.CurrentHpPerFloor) > math.MaxInt16 {
+		rv.add("current_hp_per_floor", "too many floors")
+	}
+
+	rv.sameLength("item_purchase_floors", len(r.ItemPurchaseFloors), "items_purchased", len(r.ItemsPurchased))
+	rv.sameLength("items_purged_floors", len(r.ItemsPurgedFloors), "items_purged", len(r.ItemsPurged))
+	rv.floorAll("item_purchase_floors", r.ItemPurchaseFloors)
+	rv.floorAll("items_purged_floors", r.ItemsPurgedFloors)
+	rv.floorAll("potions_floor_spawned", r.PotionsFloorSpawned)
+	rv.floorAll("potions_floor_usage", r.PotionsFloorUsage)
+
+	for i, v := range r.CampfireChoices {
+		rv.floor(fmt.Sprintf("campfire_choices[%d].floor", i), v.Floor)
+	}
+	for i, v := range r.CardChoices {
+		rv.floor(fmt.Sprintf("card_choices[%d].floor", i), v.Floor)
+	}
+	for i, v := range r.DamageTaken {
+		rv.floor(fmt.Sprintf("damage_taken[%d].floor", i), v.Floor)
+	}
+	for i, v := range r.EventChoices {
+		rv.floor(fmt.Sprintf("event_choices[%d].floor", i), v.Floor)
+	}
+	for i, v := range r.PotionsObtained {
+		rv.floor(fmt.Sprintf("potions_obtained[%d].floor", i), v.Floor)
+	}
+	for i, v := range r.RelicsObtained {
+		rv.floor(fmt.Sprintf("relics_obtained[%d].floor", i), v.Floor)
+	}
+}
+
+// Checks v against a schema node, and its properties or items against theirs
+func (rv *runValidator) schema(field string, node *schemaNode, v any) {
+	if ref, ok := strings.CutPrefix(node.Ref, "#/definitions/"); ok {
+		node = runSchema.Definitions[ref]
+	}
+	if len(node.Type) > 0 && !lo.ContainsBy(node.Type, func(t string) bool { return schemaTypeMatches(t, v) }) {
+		rv.add(field, "must be %s", strings.Join(node.Type, " or "))
+		return
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, key := range node.Required {
+			if _, ok := v[key]; !ok {
+				rv.add(joinField(field, key), "required")
+			}
+		}
+		keys := lo.Keys(node.Properties)
+		sort.Strings(keys)
+		for _, key := range keys {
+			if pv, ok := v[key]; ok {
+				rv.schema(joinField(field, key), node.Properties[key], pv)
+			}
+		}
+	case []any:
+		if node.Items != nil {
+			for i, item := range v {
+				rv.schema(fmt.Sprintf("%s[%d]", field, i), node.Items, item)
+			}
+		}
+	case float64:
+		if node.Minimum != nil && v < *node.Minimum {
+			rv.add(field, "must be at least %v", *node.Minimum)
+		}
+	case string:
+		if node.Format == "uuid" {
+			if _, err := uuid.Parse(v); err != nil {
+				rv.add(field, "must be a UUID")
+			}
+		}
+	}
+}
+
+func schemaTypeMatches(typ string, v any) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "null":
+		return v == nil
+	default:
+		return true
+	}
+}
+
+func joinField(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func (rv *runValidator) nonNegative(field string, v float64) {
+	if v < 0 {
+		rv.add(field, "must not be negative")
+	}
+}
+
+func (rv *runValidator) nonNegativeAll(field string, ar []float64) {
+	for i, v := range ar {
+		rv.nonNegative(fmt.Sprintf("%s[%d]", field, i), v)
+	}
+}
+
+// Floors are stored as smallint
+func (rv *runValidator) floor(field string, v float64) {
+	if v < 0 || v > math.MaxInt16 {
+		rv.add(field, "floor must be between 0 and %d", math.MaxInt16)
+	}
+}
+
+func (rv *runValidator) floorAll(field string, ar []float64) {
+	for i, v := range ar {
+		rv.floor(fmt.Sprintf("%s[%d]", field, i), v)
+	}
+}
+
+func (rv *runValidator) sameLength(field1 string, len1 int, field2 string, len2 int) {
+	if len1 != len2 {
+		rv.add(field1, "length %d does not match %s length %d", len1, field2, len2)
+	}
+}
+
+// Checks that no array in the run is longer than max, returning a *ValidationError if any are.
+// This is abuse protection, so unlike ValidateRun it's checked even if validation is disabled.
+func CheckArrayLengths(r *RunSchemaJson, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	lengths := []struct {
+		field string
+		n     int
+	}{
+		{"boss_relics", len(r.BossRelics)},
+		{"campfire_choices", len(r.CampfireChoices)},
+		{"card_choices", len(r.CardChoices)},
+		{"current_hp_per_floor", len(r.CurrentHpPerFloor)},
+		{"daily_mods", len(r.DailyMods)},
+		{"damage_taken", len(r.DamageTaken)},
+		{"event_choices", len(r.EventChoices)},
+		{"gold_per_floor", len(r.GoldPerFloor)},
+		{"item_purchase_floors", len(r.ItemPurchaseFloors)},
+		{"items_purchased", len(r.ItemsPurchased)},
+		{"items_purged", len(r.ItemsPurged)},
+		{"items_purged_floors", len(r.ItemsPurgedFloors)},
+		{"master_deck", len(r.MasterDeck)},
+		{"max_hp_per_floor", len(r.MaxHpPerFloor)},
+		{"path_per_floor", len(r.PathPerFloor)},
+		{"path_taken", len(r.PathTaken)},
+		{"potions_floor_spawned", len(r.PotionsFloorSpawned)},
+		{"potions_floor_usage", len(r.PotionsFloorUsage)},
+		{"potions_obtained", len(r.PotionsObtained)},
+		{"relics", len(r.Relics)},
+		{"relics_obtained", len(r.RelicsObtained)},
+	}
+	rv := runValidator{}
+	for _, v := range lengths {
+		if v.n > max {
+			rv.add(v.field, "length %d is over the limit of %d", v.n, max)
+		}
+	}
+	for i, v := range r.CardChoices {
+		if len(v.NotPicked) > max {
+			rv.add(fmt.Sprintf("card_choices[%d].not_picked", i), "length %d is over the limit of %d", len(v.NotPicked), max)
+		}
+	}
+	if len(rv.out) > 0 {
+		return &ValidationError{Violations: rv.out}
+	}
+	return nil
+}
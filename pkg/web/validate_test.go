@@ -0,0 +1,99 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validRunMap() map[string]any {
+	m := lo.SliceToMap(runSchema.Required, func(k string) (string, any) {
+		return k, 0
+	})
+	for _, k := range []string{"items_purged", "campfire_choices", "master_deck", "relics",
+		"potions_floor_usage", "damage_taken", "potions_obtained", "path_per_floor", "items_purchased",
+		"item_purchase_floors", "path_taken", "card_choices", "relics_obtained", "event_choices",
+		"boss_relics", "items_purged_floors", "potions_floor_spawned"} {
+		m[k] = []any{}
+	}
+	for _, k := range []string{"is_ascension_mode", "is_trial", "chose_seed", "victory", "is_beta", "is_endless"} {
+		m[k] = false
+	}
+	for _, k := range []string{"neow_cost", "seed_played", "character_chosen", "neow_bonus", "build_version", "killed_by"} {
+		m[k] = "X"
+	}
+	m["play_id"] = "69aa9b89-aa88-48b3-bc91-d9f6b4cd0c7b"
+	m["local_time"] = "20230102030405"
+	m["gold_per_floor"] = []any{99, 120}
+	m["current_hp_per_floor"] = []any{70, 65}
+	m["max_hp_per_floor"] = []any{72, 72}
+	return m
+}
+
+func validateMap(t *testing.T, m map[string]any) error {
+	body, err := json.Marshal(m)
+	require.NoError(t, err)
+	var run RunSchemaJson
+	if err := ParseRun(body, &run); err != nil {
+		return err
+	}
+	return ValidateRun(body, &run)
+}
+
+func TestValidateRun(t *testing.T) {
+	assert.NoError(t, validateMap(t, validRunMap()))
+
+	m := validRunMap()
+	delete(m, "timestamp")
+	m["floor_reached"] = -1
+	m["items_purchased"] = []any{"Strike_R"}
+	m["max_hp_per_floor"] = []any{72}
+	m["card_choices"] = []any{map[string]any{"floor": -3, "picked": "SKIP", "not_picked": []any{}}}
+
+	err := validateMap(t, m)
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	fields := lo.Map(verr.Violations, func(v Violation, _ int) string { return v.Field })
+	assert.ElementsMatch(t, []string{
+		"timestamp", "floor_reached", "current_hp_per_floor", "item_purchase_floors", "card_choices[0].floor",
+	}, fields)
+}
+
+func TestValidateRunSchema(t *testing.T) {
+	m := validRunMap()
+	m["campfire_choices"] = []any{
+		map[string]any{"floor": 6, "key": "SMITH", "data": "Bash"},
+		map[string]any{"floor": 12},
+	}
+	m["damage_taken"] = []any{map[string]any{"damage": 7, "enemies": "Cultist", "floor": 1, "turns": 2.5}}
+	m["path_per_floor"] = []any{"M", nil, 3}
+	m["play_id"] = "nope"
+
+	err := validateMap(t, m)
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Violation{
+		{"campfire_choices[1].key", "required"},
+		{"path_per_floor[2]", "must be string or null"},
+		{"play_id", "must be a UUID"},
+	}, verr.Violations)
+
+	// Type errors are reported as violations instead of the decoding error
+	m = validRunMap()
+	m["gold"] = "lots"
+	m["card_choices"] = []any{map[string]any{"floor": 1, "picked": "SKIP", "not_picked": "Strike_R"}}
+	err = validateMap(t, m)
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Violation{
+		{"card_choices[0].not_picked", "must be array"},
+		{"gold", "must be number"},
+	}, verr.Violations)
+
+	rv := runValidator{}
+	rv.schema("x", &schemaNode{Type: schemaTypes{"integer"}, Minimum: lo.ToPtr(0.0)}, -1.0)
+	rv.schema("y", &schemaNode{Type: schemaTypes{"integer"}}, 1.5)
+	assert.Equal(t, []Violation{{"x", "must be at least 0"}, {"y", "must be integer"}}, rv.out)
+}
@@ -0,0 +1,9 @@
+// Package stsmsr holds files from the repository root which the server is built with.
+package stsmsr
+
+import _ "embed"
+
+// JSON schema of an uploaded run
+//
+//go:embed run.schema.json
+var RunSchema []byte
@@ -0,0 +1,57 @@
+-- Delete parsed child rows along with their run, so a run can be removed or re-parsed
+-- with a single DELETE on RunsData.
+ALTER TABLE RunFlags DROP CONSTRAINT runflags_run_id_fkey,
+    ADD CONSTRAINT runflags_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE PerFloorData DROP CONSTRAINT perfloordata_run_id_fkey,
+    ADD CONSTRAINT perfloordata_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE RunArrays DROP CONSTRAINT runarrays_run_id_fkey,
+    ADD CONSTRAINT runarrays_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE runs_extra DROP CONSTRAINT runs_extra_run_id_fkey,
+    ADD CONSTRAINT runs_extra_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE CampfireChoice DROP CONSTRAINT campfirechoice_run_id_fkey,
+    ADD CONSTRAINT campfirechoice_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE DamageTaken DROP CONSTRAINT damagetaken_run_id_fkey,
+    ADD CONSTRAINT damagetaken_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE BossRelics DROP CONSTRAINT bossrelics_run_id_fkey,
+    ADD CONSTRAINT bossrelics_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE CardChoices DROP CONSTRAINT cardchoices_run_id_fkey,
+    ADD CONSTRAINT cardchoices_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE EventChoices DROP CONSTRAINT eventchoices_run_id_fkey,
+    ADD CONSTRAINT eventchoices_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE ItemsPurchased DROP CONSTRAINT itemspurchased_run_id_fkey,
+    ADD CONSTRAINT itemspurchased_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE ItemsPurged DROP CONSTRAINT itemspurged_run_id_fkey,
+    ADD CONSTRAINT itemspurged_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE PotionObtains DROP CONSTRAINT potionobtains_run_id_fkey,
+    ADD CONSTRAINT potionobtains_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+ALTER TABLE RelicObtains DROP CONSTRAINT relicobtains_run_id_fkey,
+    ADD CONSTRAINT relicobtains_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id) ON DELETE CASCADE;
+
+---- create above / drop below ----
+
+ALTER TABLE RunFlags DROP CONSTRAINT runflags_run_id_fkey,
+    ADD CONSTRAINT runflags_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE PerFloorData DROP CONSTRAINT perfloordata_run_id_fkey,
+    ADD CONSTRAINT perfloordata_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE RunArrays DROP CONSTRAINT runarrays_run_id_fkey,
+    ADD CONSTRAINT runarrays_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE runs_extra DROP CONSTRAINT runs_extra_run_id_fkey,
+    ADD CONSTRAINT runs_extra_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE CampfireChoice DROP CONSTRAINT campfirechoice_run_id_fkey,
+    ADD CONSTRAINT campfirechoice_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE DamageTaken DROP CONSTRAINT damagetaken_run_id_fkey,
+    ADD CONSTRAINT damagetaken_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE BossRelics DROP CONSTRAINT bossrelics_run_id_fkey,
+    ADD CONSTRAINT bossrelics_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE CardChoices DROP CONSTRAINT cardchoices_run_id_fkey,
+    ADD CONSTRAINT cardchoices_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE EventChoices DROP CONSTRAINT eventchoices_run_id_fkey,
+    ADD CONSTRAINT eventchoices_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE ItemsPurchased DROP CONSTRAINT itemspurchased_run_id_fkey,
+    ADD CONSTRAINT itemspurchased_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE ItemsPurged DROP CONSTRAINT itemspurged_run_id_fkey,
+    ADD CONSTRAINT itemspurged_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE PotionObtains DROP CONSTRAINT potionobtains_run_id_fkey,
+    ADD CONSTRAINT potionobtains_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
+ALTER TABLE RelicObtains DROP CONSTRAINT relicobtains_run_id_fkey,
+    ADD CONSTRAINT relicobtains_run_id_fkey FOREIGN KEY (run_id) REFERENCES RunsData(id);
@@ -0,0 +1,9 @@
+-- Email of the authenticated user who uploaded the run, if any.
+-- Used to find all runs from one person, e.g. for takedown requests.
+ALTER TABLE RunsData ADD COLUMN uploader text;
+CREATE INDEX runsdata_uploader_index ON RunsData (uploader) WHERE uploader IS NOT NULL;
+
+---- create above / drop below ----
+
+DROP INDEX IF EXISTS runsdata_uploader_index;
+ALTER TABLE RunsData DROP COLUMN IF EXISTS uploader;
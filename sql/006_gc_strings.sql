@@ -0,0 +1,87 @@
+-- Incremented each time unused strings or card specs are deleted. Servers compare it with
+-- the value their caches were loaded under, and clear them if it changed.
+CREATE SEQUENCE str_cache_gc_epoch;
+
+-- Number of distinct runs that reference each StrCache id in str_ids.
+-- Array columns aren't covered by foreign keys, so this is the only reliable way
+-- to know a string is unused.
+CREATE OR REPLACE FUNCTION str_cache_usage(str_ids int[]) RETURNS TABLE(id int, runs bigint)
+LANGUAGE SQL STABLE AS $$
+    WITH refs(id, run_id) AS (
+        SELECT build_version, id FROM RunsData WHERE build_version = ANY(str_ids)
+        UNION ALL SELECT character_id, id FROM RunsData WHERE character_id = ANY(str_ids)
+        UNION ALL SELECT killed_by, id FROM RunsData WHERE killed_by = ANY(str_ids)
+        UNION ALL SELECT neow_bonus_id, id FROM RunsData WHERE neow_bonus_id = ANY(str_ids)
+        UNION ALL SELECT neow_cost_id, id FROM RunsData WHERE neow_cost_id = ANY(str_ids)
+        UNION ALL SELECT unnest(daily_mods), run_id FROM RunArrays WHERE daily_mods && str_ids
+        UNION ALL SELECT unnest(relic_ids), run_id FROM RunArrays WHERE relic_ids && str_ids
+        UNION ALL SELECT str_data, run_id FROM CampfireChoice WHERE str_data = ANY(str_ids)
+        UNION ALL SELECT "key", run_id FROM CampfireChoice WHERE "key" = ANY(str_ids)
+        UNION ALL SELECT enemies, run_id FROM DamageTaken WHERE enemies = ANY(str_ids)
+        UNION ALL SELECT picked, run_id FROM BossRelics WHERE picked = ANY(str_ids)
+        UNION ALL SELECT unnest(not_picked), run_id FROM BossRelics WHERE not_picked && str_ids
+        UNION ALL SELECT event_name_id, run_id FROM EventChoices WHERE event_name_id = ANY(str_ids)
+        UNION ALL SELECT player_choice_id, run_id FROM EventChoices WHERE player_choice_id = ANY(str_ids)
+        UNION ALL SELECT unnest(relics_obtained_ids), run_id FROM EventChoices WHERE relics_obtained_ids && str_ids
+        UNION ALL SELECT "key", run_id FROM PotionObtains WHERE "key" = ANY(str_ids)
+        UNION ALL SELECT "key", run_id FROM RelicObtains WHERE "key" = ANY(str_ids)
+    )
+    SELECT i.id, count(DISTINCT r.run_id)
+    FROM unnest(str_ids) i(id)
+    LEFT JOIN refs r ON r.id = i.id
+    GROUP BY i.id;
+$$;
+
+-- Number of distinct runs that reference each CardSpecs id in card_ids.
+CREATE OR REPLACE FUNCTION card_specs_usage(card_ids int[]) RETURNS TABLE(id int, runs bigint)
+LANGUAGE SQL STABLE AS $$
+    WITH refs(id, run_id) AS (
+        SELECT unnest(master_deck), run_id FROM RunArrays WHERE master_deck && card_ids
+        UNION ALL SELECT card_data, run_id FROM CampfireChoice WHERE card_data = ANY(card_ids)
+        UNION ALL SELECT picked, run_id FROM CardChoices WHERE picked = ANY(card_ids)
+        UNION ALL SELECT unnest(not_picked), run_id FROM CardChoices WHERE not_picked && card_ids
+        UNION ALL SELECT card_id, run_id FROM ItemsPurchased WHERE card_id = ANY(card_ids)
+        UNION ALL SELECT card_id, run_id FROM ItemsPurged WHERE card_id = ANY(card_ids)
+    )
+    SELECT i.id, count(DISTINCT r.run_id)
+    FROM unnest(card_ids) i(id)
+    LEFT JOIN refs r ON r.id = i.id
+    GROUP BY i.id;
+$$;
+
+-- Deletes the strings in str_ids that no run references, returning how many were deleted.
+-- The empty string is never deleted since it's the default for several columns.
+CREATE OR REPLACE FUNCTION str_cache_delete_unused(str_ids int[]) RETURNS int
+LANGUAGE plpgsql AS $$
+DECLARE
+    unused int[];
+BEGIN
+    SELECT array(
+        SELECT u.id FROM str_cache_usage(str_ids) u
+        JOIN StrCache s ON s.id = u.id
+        WHERE u.runs = 0 AND s.str <> ''
+    ) INTO unused;
+    DELETE FROM StrCacheNew WHERE id = ANY(unused);
+    DELETE FROM StrCache WHERE id = ANY(unused);
+    RETURN cardinality(unused);
+END $$;
+
+-- Deletes the card specs in card_ids that no run references, returning how many were deleted.
+CREATE OR REPLACE FUNCTION card_specs_delete_unused(card_ids int[]) RETURNS int
+LANGUAGE plpgsql AS $$
+DECLARE
+    unused int[];
+BEGIN
+    SELECT array(SELECT u.id FROM card_specs_usage(card_ids) u WHERE u.runs = 0) INTO unused;
+    DELETE FROM CardSpecsNew WHERE id = ANY(unused);
+    DELETE FROM CardSpecs WHERE id = ANY(unused);
+    RETURN cardinality(unused);
+END $$;
+
+---- create above / drop below ----
+
+DROP FUNCTION IF EXISTS card_specs_delete_unused(int[]);
+DROP FUNCTION IF EXISTS str_cache_delete_unused(int[]);
+DROP FUNCTION IF EXISTS card_specs_usage(int[]);
+DROP FUNCTION IF EXISTS str_cache_usage(int[]);
+DROP SEQUENCE IF EXISTS str_cache_gc_epoch;
@@ -0,0 +1,20 @@
+-- Tokens for machine clients (scripts, the upload mod) which can't log in through oauth2-proxy.
+-- Only the sha256 hash of each token is stored.
+CREATE TABLE auth.api_tokens(
+    id serial primary key,
+    user_id int not null references auth.users(id) on delete cascade,
+    token_hash bytea not null unique,
+    -- Description of what the token is for
+    name text not null default '',
+    -- Scopes the token is restricted to, or NULL for all of the user's scopes
+    scopes text[],
+    created timestamp not null default now(),
+    -- NULL if the token never expires
+    expires timestamp,
+    last_used timestamp
+);
+CREATE INDEX api_tokens_user_id_index ON auth.api_tokens (user_id);
+
+---- create above / drop below ----
+
+DROP TABLE IF EXISTS auth.api_tokens;
@@ -0,0 +1,48 @@
+-- A scope grants all of its descendants, e.g. "admin" grants "stats:view" and "getrun".
+
+-- Returns the given scopes and all of their descendants
+CREATE OR REPLACE FUNCTION auth.scopes_expand(scope_list text[]) RETURNS SETOF text
+LANGUAGE SQL STABLE AS $$
+    WITH RECURSIVE tree(id, key) AS (
+        SELECT id, key FROM auth.scopes WHERE key = ANY(scope_list)
+        UNION
+        SELECT c.id, c.key FROM auth.scopes c JOIN tree t ON c.parent = t.id
+    )
+    SELECT key FROM tree ORDER BY key
+$$;
+
+-- Returns all scopes the user has, either directly or through a parent scope
+CREATE OR REPLACE FUNCTION auth.user_effective_scopes(email_ text) RETURNS SETOF text
+LANGUAGE SQL STABLE AS $$
+    SELECT auth.scopes_expand(array(
+        SELECT s.key
+        FROM auth.users u
+        JOIN auth.users_to_scopes us ON us.user_id = u.id
+        JOIN auth.scopes s ON s.id = us.scope_id
+        WHERE u.email = email_
+    ))
+$$;
+
+CREATE OR REPLACE FUNCTION auth.user_has_scopes(email_ text, scope_list text[]) RETURNS bool
+LANGUAGE SQL STABLE AS $$
+    SELECT scope_list <@ array(SELECT auth.user_effective_scopes(email_))
+$$;
+
+UPDATE auth.scopes SET parent = (SELECT id FROM auth.scopes WHERE key = 'admin')
+WHERE key IN ('stats:view', 'getrun') AND parent IS NULL;
+
+---- create above / drop below ----
+
+UPDATE auth.scopes SET parent = NULL WHERE key IN ('stats:view', 'getrun');
+
+CREATE OR REPLACE FUNCTION auth.user_has_scopes(email_ text, scope_list text[]) RETURNS bool
+LANGUAGE SQL AS $$
+    SELECT bool_and(scope_id is not null)
+    FROM auth.scopes s
+        CROSS JOIN (SELECT id FROM auth.users WHERE email = email_) uid
+        RIGHT JOIN (SELECT unnest(scope_list) t) txt ON txt.t = s.key
+        LEFT JOIN auth.users_to_scopes uts ON s.id = uts.scope_id AND uid.id = uts.user_id
+$$;
+
+DROP FUNCTION IF EXISTS auth.user_effective_scopes;
+DROP FUNCTION IF EXISTS auth.scopes_expand;
@@ -0,0 +1,28 @@
+-- Durable queue of uploaded runs waiting to be added to the database, used when
+-- uploads are processed asynchronously.
+CREATE TABLE IngestQueue(
+    id bigint primary key generated by default as identity,
+    play_id text not null,
+    -- Random token given to the uploader to check the job's status, so job ids can't be guessed
+    token text not null,
+    -- Raw upload, cleared once the run is stored or the job fails
+    body json,
+    -- Email of the uploader, if any
+    uploader text,
+    -- 0 = queued, 1 = in progress, 2 = done, 3 = failed
+    status int2 not null default 0,
+    attempts int not null default 0,
+    last_error text,
+    created timestamp not null default now(),
+    updated timestamp not null default now(),
+    -- Don't retry the job until after this time
+    run_after timestamp not null default now()
+);
+CREATE INDEX ingestqueue_pending_index ON IngestQueue (run_after) WHERE status = 0;
+-- Only one job per run can be waiting at a time
+CREATE UNIQUE INDEX ingestqueue_play_id_index ON IngestQueue (play_id) WHERE status < 2;
+CREATE UNIQUE INDEX ingestqueue_token_index ON IngestQueue (token);
+
+---- create above / drop below ----
+
+DROP TABLE IF EXISTS IngestQueue;
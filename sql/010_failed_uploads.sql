@@ -0,0 +1,22 @@
+-- Dead-letter store for uploads which passed validation but couldn't be added to the
+-- database, so they can be retried once the problem is fixed.
+CREATE TABLE FailedUploads(
+    id bigint primary key generated by default as identity,
+    play_id text not null,
+    body json not null,
+    -- Email of the uploader, if any
+    uploader text,
+    -- Where the upload failed: "store", "batch" or "queue"
+    stage text not null,
+    -- Most recent error
+    error text not null,
+    -- Number of times adding the run has failed
+    attempts int not null default 1,
+    created timestamp not null default now(),
+    updated timestamp not null default now(),
+    unique (play_id)
+);
+
+---- create above / drop below ----
+
+DROP TABLE IF EXISTS FailedUploads;
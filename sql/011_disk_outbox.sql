@@ -0,0 +1,11 @@
+-- Raw uploads waiting to be written to runs_dir. A row is added in the same transaction
+-- as the run, and removed once the file has been written.
+CREATE TABLE RawDiskOutbox(
+    play_id text primary key,
+    bdata json not null,
+    created timestamp not null default now()
+);
+
+---- create above / drop below ----
+
+DROP TABLE IF EXISTS RawDiskOutbox;
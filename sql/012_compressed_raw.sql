@@ -0,0 +1,10 @@
+-- Raw runs are now stored compressed with zstd. Existing rows keep their plain JSON,
+-- readers tell the two apart by the zstd magic number.
+ALTER TABLE RawJsonArchive ALTER COLUMN bdata TYPE bytea USING convert_to(bdata::text, 'UTF8');
+ALTER TABLE RawDiskOutbox ALTER COLUMN bdata TYPE bytea USING convert_to(bdata::text, 'UTF8');
+
+---- create above / drop below ----
+
+-- Fails if any rows are compressed, export the archive and flush the outbox first.
+ALTER TABLE RawDiskOutbox ALTER COLUMN bdata TYPE json USING convert_from(bdata, 'UTF8')::json;
+ALTER TABLE RawJsonArchive ALTER COLUMN bdata TYPE json USING convert_from(bdata, 'UTF8')::json;
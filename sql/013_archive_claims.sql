@@ -0,0 +1,17 @@
+-- Exports now claim rows with status 1 and a claim id, so a crashed export can be
+-- resumed, and rows it never finished can be found by claimed_at and reclaimed.
+ALTER TABLE RawJsonArchive ADD COLUMN claimed_by text;
+ALTER TABLE RawJsonArchive ADD COLUMN claimed_at timestamp;
+-- Old exports marked done rows as -1, and in-progress rows with a random status from
+-- 1 to 32760, which may be 1 or 2. Release those first, then mark the done rows.
+UPDATE RawJsonArchive SET status = 0 WHERE status NOT IN (-1, 0);
+UPDATE RawJsonArchive SET status = 2 WHERE status = -1;
+ALTER TABLE RawJsonArchive ADD CONSTRAINT rawjsonarchive_status_check CHECK (status IN (0, 1, 2));
+CREATE INDEX rawjsonarchive_status_index ON RawJsonArchive (status, id);
+
+---- create above / drop below ----
+
+DROP INDEX IF EXISTS rawjsonarchive_status_index;
+ALTER TABLE RawJsonArchive DROP CONSTRAINT IF EXISTS rawjsonarchive_status_check;
+ALTER TABLE RawJsonArchive DROP COLUMN IF EXISTS claimed_at;
+ALTER TABLE RawJsonArchive DROP COLUMN IF EXISTS claimed_by;
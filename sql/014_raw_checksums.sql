@@ -0,0 +1,9 @@
+-- SHA-256 of the uncompressed upload body, NULL for runs archived before checksums
+-- were recorded.
+ALTER TABLE RawJsonArchive ADD COLUMN sha256 bytea;
+ALTER TABLE RawDiskOutbox ADD COLUMN sha256 bytea;
+
+---- create above / drop below ----
+
+ALTER TABLE RawDiskOutbox DROP COLUMN IF EXISTS sha256;
+ALTER TABLE RawJsonArchive DROP COLUMN IF EXISTS sha256;
@@ -0,0 +1,57 @@
+-- name: ListUsers :many
+SELECT u.id, u.email,
+       array(SELECT s.key FROM auth.users_to_scopes us JOIN auth.scopes s ON s.id = us.scope_id
+             WHERE us.user_id = u.id ORDER BY s.key)::text[] AS scopes
+FROM auth.users u
+ORDER BY u.email;
+
+-- name: GetUser :one
+SELECT u.id, u.email,
+       array(SELECT s.key FROM auth.users_to_scopes us JOIN auth.scopes s ON s.id = us.scope_id
+             WHERE us.user_id = u.id ORDER BY s.key)::text[] AS scopes
+FROM auth.users u
+WHERE u.email = $1;
+
+-- name: UserAdd :one
+SELECT auth.user_add(sqlc.arg('email')::text)::int AS id;
+
+-- name: UserDelete :execrows
+DELETE FROM auth.users WHERE email = $1;
+
+-- name: UserSetScopes :exec
+SELECT auth.user_set_scopes(sqlc.arg('email')::text, sqlc.arg('scopes')::text[]);
+
+-- name: ListScopes :many
+SELECT s.id, s.key, s."desc", p.key AS parent
+FROM auth.scopes s
+LEFT JOIN auth.scopes p ON p.id = s.parent
+ORDER BY s.key;
+
+-- name: ApiTokenCreate :one
+INSERT INTO auth.api_tokens (user_id, token_hash, name, scopes, expires)
+SELECT u.id, sqlc.arg('token_hash'), sqlc.arg('name'), sqlc.narg('scopes')::text[],
+    now() + make_interval(secs => sqlc.narg('expires_secs')::float8)
+FROM auth.users u
+WHERE u.email = sqlc.arg('email')
+RETURNING id, created, expires;
+
+-- name: ApiTokenList :many
+SELECT t.id, u.email, t.name, t.scopes, t.created, t.expires, t.last_used
+FROM auth.api_tokens t
+JOIN auth.users u ON u.id = t.user_id
+WHERE sqlc.narg('email')::text IS NULL OR u.email = sqlc.narg('email')
+ORDER BY t.id;
+
+-- name: ApiTokenRevoke :execrows
+DELETE FROM auth.api_tokens WHERE id = $1;
+
+-- name: ApiTokenLookup :one
+UPDATE auth.api_tokens t SET last_used = now()
+FROM auth.users u
+WHERE u.id = t.user_id AND t.token_hash = $1 AND (t.expires IS NULL OR t.expires > now())
+RETURNING t.id, u.email, t.scopes;
+
+-- name: UserEffectiveScopes :many
+SELECT s::text FROM auth.user_effective_scopes(sqlc.arg('email')) s
+WHERE sqlc.narg('token_scopes')::text[] IS NULL
+   OR s IN (SELECT auth.scopes_expand(sqlc.narg('token_scopes')::text[]));
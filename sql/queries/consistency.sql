@@ -0,0 +1,40 @@
+-- name: ArchiveAddIfMissing :exec
+INSERT INTO RawJsonArchive(bdata, play_id, sha256) VALUES ($1, $2, $3)
+ON CONFLICT (play_id) DO NOTHING;
+
+-- name: OutboxAdd :exec
+INSERT INTO RawDiskOutbox(play_id, bdata, sha256) VALUES ($1, $2, $3)
+ON CONFLICT (play_id) DO NOTHING;
+
+-- name: OutboxDelete :exec
+DELETE FROM RawDiskOutbox WHERE play_id = $1;
+
+-- name: OutboxDeleteByPlayId :execrows
+DELETE FROM RawDiskOutbox WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
+
+-- name: OutboxLock :one
+-- Held while the entry is removed after writing its blob, so DeleteRuns waits for it
+SELECT play_id FROM RawDiskOutbox WHERE play_id = $1 FOR UPDATE;
+
+-- name: OutboxList :many
+SELECT play_id, bdata, sha256 FROM RawDiskOutbox
+WHERE created < now() - make_interval(secs => sqlc.arg('age_secs')::float8)
+ORDER BY created
+LIMIT sqlc.arg('limit_');
+
+-- name: ArchivedNotParsed :many
+SELECT a.id, a.play_id, a.bdata
+FROM RawJsonArchive a
+WHERE a.id > $1 AND NOT EXISTS (SELECT 1 FROM RunsData r WHERE r.play_id = a.play_id)
+ORDER BY a.id
+LIMIT $2;
+
+-- name: ParsedNotArchived :many
+SELECT r.id, r.play_id
+FROM RunsData r
+WHERE r.id > $1 AND NOT EXISTS (SELECT 1 FROM RawJsonArchive a WHERE a.play_id = r.play_id)
+ORDER BY r.id
+LIMIT $2;
+
+-- name: ArchiveSums :many
+SELECT play_id, sha256 FROM RawJsonArchive WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
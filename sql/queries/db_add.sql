@@ -59,9 +59,56 @@ SELECT str_cache_to_id($1::text[]);
 SELECT r.raw::json, r.path_per_floor::text, r.path_taken::text, r.extra::json
 FROM run_to_json((SELECT id FROM runsdata WHERE play_id = $1)) r;
 
--- name: ArchiveBegin :many
-UPDATE rawjsonarchive ra SET status = $1 WHERE status = 0 RETURNING ra.*;
--- name: ArchiveComplete :many
-UPDATE rawjsonarchive ra SET status = -1 WHERE status = $1 RETURNING ra.id;
+-- name: ArchiveClaim :many
+-- Claims the next unexported rows after after_id, optionally only runs matching the filters.
+UPDATE RawJsonArchive ra SET status = 1, claimed_by = sqlc.arg('claimed_by'), claimed_at = now()
+WHERE ra.id IN (
+    SELECT a.id FROM RawJsonArchive a
+    LEFT JOIN RunsData r ON r.play_id = a.play_id
+    WHERE a.status = 0 AND a.id > sqlc.arg('after_id')
+      AND (sqlc.narg('since')::timestamp IS NULL OR r."timestamp" >= sqlc.narg('since'))
+      AND (sqlc.narg('until')::timestamp IS NULL OR r."timestamp" < sqlc.narg('until'))
+      AND (sqlc.narg('character')::text IS NULL OR r.character_id = (SELECT id FROM StrCache WHERE str = sqlc.narg('character')))
+      AND (sqlc.narg('build')::text IS NULL OR r.build_version = (SELECT id FROM StrCache WHERE str = sqlc.narg('build')))
+    ORDER BY a.id
+    LIMIT sqlc.arg('limit_')
+    FOR UPDATE OF a SKIP LOCKED
+)
+RETURNING ra.*;
+-- name: ArchiveClaimed :many
+SELECT * FROM RawJsonArchive WHERE status = 1 AND claimed_by = $1 AND id > $2 ORDER BY id LIMIT $3;
+-- name: ArchiveComplete :execrows
+UPDATE RawJsonArchive SET status = 2, claimed_at = NULL
+WHERE status = 1 AND claimed_by = sqlc.arg('claimed_by') AND id = ANY(sqlc.arg('ids')::int[]);
+-- name: ArchiveRelease :execrows
+-- Releases claimed rows which couldn't be exported, so they're not claimed by the export again
+UPDATE RawJsonArchive SET status = 0, claimed_by = NULL, claimed_at = NULL
+WHERE status = 1 AND claimed_by = sqlc.arg('claimed_by') AND id = ANY(sqlc.arg('ids')::int[]);
+-- name: ArchiveReclaim :execrows
+UPDATE RawJsonArchive SET status = 0, claimed_by = NULL, claimed_at = NULL
+WHERE status = 1 AND claimed_at < now() - make_interval(secs => sqlc.arg('age_secs')::float8);
 -- name: ArchiveAdd :exec
 INSERT INTO RawJsonArchive(bdata, play_id) VALUES ($1, $2);
+-- name: ArchiveGet :one
+SELECT bdata FROM RawJsonArchive WHERE play_id = $1;
+-- name: ArchiveList :many
+SELECT * FROM RawJsonArchive WHERE id > $1 ORDER BY id LIMIT $2;
+-- name: ArchiveEstimate :one
+-- Estimated number of archived runs, from the planner statistics
+SELECT reltuples::int8 FROM pg_class WHERE oid = 'rawjsonarchive'::regclass;
+-- name: ArchiveSample :many
+-- Picks the ids from a sample of about percent of the rows, so only the sampled ids are sorted
+SELECT play_id, bdata FROM RawJsonArchive WHERE id IN (
+    SELECT id FROM RawJsonArchive TABLESAMPLE BERNOULLI (sqlc.arg('percent')::float4)
+    ORDER BY random() LIMIT sqlc.arg('limit')
+);
+
+-- name: DeleteRunsParsed :execrows
+DELETE FROM RunsData WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
+
+-- name: SetRunUploader :exec
+UPDATE RunsData SET uploader = $2 WHERE id = $1;
+-- name: PlayIdsByUploader :many
+SELECT play_id FROM RunsData WHERE uploader = $1;
+-- name: DeleteRunsArchive :execrows
+DELETE FROM RawJsonArchive WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
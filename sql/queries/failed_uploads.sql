@@ -0,0 +1,34 @@
+-- name: FailedUploadAdd :exec
+INSERT INTO FailedUploads (play_id, body, uploader, stage, error, attempts)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (play_id) DO UPDATE
+SET body = excluded.body, uploader = excluded.uploader, stage = excluded.stage, error = excluded.error,
+    attempts = FailedUploads.attempts + excluded.attempts, updated = now();
+
+-- name: FailedUploadList :many
+SELECT id, play_id, uploader, stage, error, attempts, created, updated
+FROM FailedUploads
+ORDER BY id
+LIMIT $1;
+
+-- name: FailedUploadsForRetry :many
+SELECT id, play_id, body, uploader
+FROM FailedUploads
+WHERE id > sqlc.arg('after_id')
+  AND (sqlc.narg('ids')::bigint[] IS NULL OR id = ANY(sqlc.narg('ids')::bigint[]))
+ORDER BY id
+LIMIT sqlc.arg('limit');
+
+-- name: FailedUploadLock :one
+-- Held while retrying the upload, so DeleteRuns waits for it to finish
+SELECT id FROM FailedUploads WHERE id = $1 FOR UPDATE;
+
+-- name: FailedUploadRecordAttempt :exec
+UPDATE FailedUploads SET error = $2, attempts = attempts + 1, updated = now()
+WHERE id = $1;
+
+-- name: FailedUploadDelete :execrows
+DELETE FROM FailedUploads WHERE id = $1;
+
+-- name: FailedUploadDeleteByPlayId :execrows
+DELETE FROM FailedUploads WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
@@ -0,0 +1,46 @@
+-- name: StrCacheNewUsage :many
+SELECT s.id, s.str, n.added, u.runs::bigint AS runs
+FROM StrCacheNew n
+JOIN StrCache s ON s.id = n.id
+JOIN str_cache_usage(array(SELECT id FROM StrCacheNew WHERE added >= sqlc.arg('since'))) u ON u.id = n.id
+WHERE n.added >= sqlc.arg('since')
+ORDER BY n.added;
+
+-- name: CardSpecsNewUsage :many
+SELECT c.id, c.card, c.upgrades, n.added, u.runs::bigint AS runs
+FROM CardSpecsNew n
+JOIN CardSpecs c ON c.id = n.id
+JOIN card_specs_usage(array(SELECT id FROM CardSpecsNew WHERE added >= sqlc.arg('since'))) u ON u.id = n.id
+WHERE n.added >= sqlc.arg('since')
+ORDER BY n.added;
+
+-- name: StrCacheDeleteUnused :one
+SELECT str_cache_delete_unused(sqlc.arg('ids')::int[])::int AS deleted;
+
+-- name: CardSpecsDeleteUnused :one
+SELECT card_specs_delete_unused(sqlc.arg('ids')::int[])::int AS deleted;
+
+-- name: PruneStrCacheNew :execrows
+DELETE FROM StrCacheNew WHERE added < sqlc.arg('before');
+
+-- name: PruneCardSpecsNew :execrows
+DELETE FROM CardSpecsNew WHERE added < sqlc.arg('before');
+
+-- name: NotifyCacheInvalidate :exec
+SELECT pg_notify('orm_cache_invalidate', '');
+
+-- name: GcLockShared :exec
+-- Taken by every upload for the rest of its transaction, so strings and card specs can't be
+-- deleted while an upload may still reference them. Must use the same key as GcLock.
+SELECT pg_advisory_xact_lock_shared(hashtext('str_cache_gc'));
+
+-- name: GcLock :exec
+-- Taken by gc-strings for the rest of its transaction, waiting for every upload in progress.
+SELECT pg_advisory_xact_lock(hashtext('str_cache_gc'));
+
+-- name: GcEpoch :one
+-- last_value is 1 both before and after the first nextval, so use is_called to tell them apart
+SELECT (CASE WHEN is_called THEN last_value ELSE 0 END)::bigint AS epoch FROM str_cache_gc_epoch;
+
+-- name: GcNextEpoch :exec
+SELECT nextval('str_cache_gc_epoch');
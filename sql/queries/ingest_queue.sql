@@ -0,0 +1,72 @@
+-- name: IngestEnqueue :one
+INSERT INTO IngestQueue (play_id, token, body, uploader)
+VALUES ($1, $2, $3, $4)
+RETURNING id;
+
+-- name: IngestClaim :many
+UPDATE IngestQueue SET status = 1, attempts = attempts + 1, updated = now()
+WHERE id IN (
+    SELECT q.id FROM IngestQueue q
+    WHERE q.status = 0 AND q.run_after <= now()
+    ORDER BY q.id
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING id, play_id, body, uploader, attempts;
+
+-- name: IngestLock :one
+-- Held by a worker while it processes the job, so DeleteRuns waits for it to finish
+SELECT id FROM IngestQueue WHERE id = $1 FOR UPDATE;
+
+-- name: IngestDone :exec
+UPDATE IngestQueue SET status = 2, body = NULL, last_error = NULL, updated = now()
+WHERE id = $1;
+
+-- name: IngestRetry :exec
+UPDATE IngestQueue
+SET status = 0, last_error = sqlc.arg('last_error'), updated = now(),
+    run_after = now() + make_interval(secs => sqlc.arg('delay_secs')::float8)
+WHERE id = sqlc.arg('id');
+
+-- name: IngestFail :exec
+UPDATE IngestQueue SET status = 3, body = NULL, last_error = $2, updated = now()
+WHERE id = $1;
+
+-- name: IngestStatus :one
+SELECT token, play_id, status, attempts, last_error, created, updated
+FROM IngestQueue
+WHERE token = $1;
+
+-- name: IngestPendingCount :one
+SELECT count(*) FROM IngestQueue WHERE status < 2;
+
+-- name: IngestRequeueStale :execrows
+-- Jobs being processed are locked by IngestLock, so they're never stale
+UPDATE IngestQueue SET status = 0, updated = now()
+WHERE id IN (
+    SELECT q.id FROM IngestQueue q
+    WHERE q.status = 1 AND q.attempts < sqlc.arg('max_attempts')
+      AND q.updated < now() - make_interval(secs => sqlc.arg('age_secs')::float8)
+    FOR UPDATE SKIP LOCKED
+);
+
+-- name: IngestFailStale :many
+-- Fails stale jobs which have used up their attempts, most likely because they crash the
+-- worker, returning them with their body
+WITH stale AS (
+    SELECT q.id, q.body FROM IngestQueue q
+    WHERE q.status = 1 AND q.attempts >= sqlc.arg('max_attempts')
+      AND q.updated < now() - make_interval(secs => sqlc.arg('age_secs')::float8)
+    FOR UPDATE SKIP LOCKED
+)
+UPDATE IngestQueue q
+SET status = 3, body = NULL, last_error = sqlc.arg('last_error'), updated = now()
+FROM stale
+WHERE q.id = stale.id
+RETURNING q.id, q.play_id, stale.body, q.uploader, q.attempts;
+
+-- name: IngestPruneFinished :execrows
+DELETE FROM IngestQueue WHERE status >= 2 AND updated < now() - make_interval(secs => sqlc.arg('age_secs')::float8);
+
+-- name: IngestDeleteByPlayId :execrows
+DELETE FROM IngestQueue WHERE play_id = ANY(sqlc.arg('play_ids')::text[]);
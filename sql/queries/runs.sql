@@ -0,0 +1,22 @@
+-- name: ListRuns :many
+SELECT r.id, r.play_id, c.str AS character, r.ascension_level, r.victory, b.str AS build_version,
+       r.floor_reached, r.score, r.playtime, r."timestamp", r.added,
+       array(SELECT f.flag::text FROM RunFlags f WHERE f.run_id = r.id ORDER BY f.flag)::text[] AS flags
+FROM RunsData r
+JOIN StrCache c ON c.id = r.character_id
+JOIN StrCache b ON b.id = r.build_version
+WHERE r.id < sqlc.arg('after_id')
+  AND (sqlc.narg('character')::text IS NULL OR c.str = sqlc.narg('character'))
+  AND (sqlc.narg('min_ascension')::int IS NULL OR r.ascension_level >= sqlc.narg('min_ascension'))
+  AND (sqlc.narg('max_ascension')::int IS NULL OR r.ascension_level <= sqlc.narg('max_ascension'))
+  AND (sqlc.narg('victory')::boolean IS NULL OR r.victory = sqlc.narg('victory'))
+  AND (sqlc.narg('build_version')::text IS NULL OR b.str = sqlc.narg('build_version'))
+  AND (sqlc.narg('min_floor')::int IS NULL OR r.floor_reached >= sqlc.narg('min_floor'))
+  AND (sqlc.narg('max_floor')::int IS NULL OR r.floor_reached <= sqlc.narg('max_floor'))
+  AND (sqlc.narg('since')::timestamp IS NULL OR r."timestamp" >= sqlc.narg('since'))
+  AND (sqlc.narg('until')::timestamp IS NULL OR r."timestamp" < sqlc.narg('until'))
+  AND (sqlc.narg('flags')::text[] IS NULL OR NOT exists(
+      SELECT unnest(sqlc.narg('flags')::text[])
+      EXCEPT SELECT f.flag::text FROM RunFlags f WHERE f.run_id = r.id))
+ORDER BY r.id DESC
+LIMIT sqlc.arg('row_limit');
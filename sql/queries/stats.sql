@@ -0,0 +1,28 @@
+-- name: CharacterIdByName :one
+SELECT id FROM character_list WHERE name = $1;
+
+-- name: StatsOverview :many
+SELECT * FROM stats_overview
+WHERE sqlc.narg('name')::text IS NULL OR name = sqlc.narg('name')
+ORDER BY name;
+
+-- name: StatsCardCounts :many
+SELECT (CASE WHEN sqlc.arg('merge_upgrades')::boolean THEN s.card ELSE s.card_full END)::text AS card,
+       sum(c.total)::bigint AS total,
+       sum(c.upgrades)::bigint AS upgrades
+FROM stats_card_counts c
+JOIN CardSpecsEx s ON s.id = c.card_id
+WHERE c.char_id = sqlc.arg('char_id')
+GROUP BY 1
+ORDER BY total DESC;
+
+-- name: PerCharacterCardStats :many
+SELECT s.card_id::int AS card_id, s.card::text AS card, s.runs::int AS runs, s.wins::int AS wins,
+       s.deck::float4[] AS deck, s.floor::float4[] AS floor
+FROM per_character_card_stats($1) s
+ORDER BY s.card;
+
+-- name: CardPickStats :many
+SELECT p.card::text AS card, p.pick::int AS pick, p.skip::int AS skip
+FROM card_pick_stats(sqlc.arg('char_id'), sqlc.arg('merge_upgrades')) p
+ORDER BY p.card;